@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fimreal/comfyui-api/src/infotext"
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+
+	"github.com/spf13/cobra"
+)
+
+// newImportCommand 创建 import-a1111 命令，将 A1111 / Forge 的 PNG 或 infotext 文件转换为 ComfyUI 工作流
+func newImportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import-a1111 FILE",
+		Short: "Convert Automatic1111/Forge generation parameters into a ComfyUI workflow.",
+		Long: "Reads a PNG with a parameters text chunk, or a text file with infotext (\"-\" for stdin), " +
+			"and prints the equivalent ComfyUI API-format workflow. Warnings are printed to stderr.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			checkpoint, _ := cmd.Flags().GetString("checkpoint")
+			prefix, _ := cmd.Flags().GetString("prefix")
+			job, _ := cmd.Flags().GetBool("job")
+
+			data, err := readInput(args[0])
+			if err != nil {
+				return err
+			}
+			text := string(data)
+			if chunks, err := pngmeta.Text(data); err == nil {
+				if text = chunks[pngmeta.KeyParameters]; text == "" {
+					return errors.New("image has no parameters text chunk")
+				}
+			} else if !errors.Is(err, pngmeta.ErrNotPNG) {
+				return err
+			}
+
+			params, err := infotext.Parse(text)
+			if err != nil {
+				return err
+			}
+			workflow, warnings, err := params.Workflow(infotext.Options{Checkpoint: checkpoint, FilenamePrefix: prefix})
+			if err != nil {
+				return err
+			}
+			for _, warning := range warnings {
+				fmt.Fprintln(os.Stderr, "warning:", warning)
+			}
+
+			var out interface{} = workflow
+			if job {
+				// 可直接作为 POST /api/jobs 的请求体
+				out = map[string]interface{}{"workflow": workflow}
+			}
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(out)
+		},
+	}
+	cmd.Flags().String("checkpoint", "", "ckpt_name to use instead of the Model in the parameters")
+	cmd.Flags().String("prefix", "", "filename_prefix of the SaveImage node (default \"ComfyUI\")")
+	cmd.Flags().Bool("job", false, "wrap the workflow in a /api/jobs request body")
+	return cmd
+}
+
+// readInput 读取文件，"-" 表示标准输入
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
@@ -18,8 +18,14 @@ func main() {
 		Version: version,
 		Short:   "A CLI tool for interacting with ComfyUI.",
 		Run: func(cmd *cobra.Command, args []string) {
+			configPath, _ := cmd.Flags().GetString("config")
+			cfg, err := serve.LoadConfig(configPath)
+			if err != nil {
+				log.Fatalf("Failed to load config: %v", err)
+			}
+
 			// 启动 HTTP 服务器
-			if err := serve.StartServer(); err != nil {
+			if err := serve.StartServer(cfg); err != nil {
 				log.Fatalf("Failed to start server: %v", err)
 			}
 		},
@@ -27,6 +33,7 @@ func main() {
 
 	// 添加更多命令，比如配置文件路径等
 	rootCmd.Flags().StringP("config", "c", "", "Path to configuration file")
+	rootCmd.AddCommand(newImportCommand(), newVerifyCommand(), newWatermarkCommand())
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Command execution failed: %v", err)
 	}
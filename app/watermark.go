@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/fimreal/comfyui-api/src/watermark"
+	"github.com/google/uuid"
+	_ "golang.org/x/image/webp"
+
+	"github.com/spf13/cobra"
+)
+
+// newWatermarkCommand 创建 watermark-detect 命令，读取图片中不可见水印嵌入的任务 ID
+func newWatermarkCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watermark-detect FILE",
+		Short: "Read the job ID from an image's invisible watermark.",
+		Long: "Reads a PNG, JPEG or WebP image (\"-\" for stdin) and prints the job ID embedded by the invisible watermark. " +
+			"--key must match watermark.key in the server config. Exits non-zero if no watermark is found.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, _ := cmd.Flags().GetString("key")
+			data, err := readInput(args[0])
+			if err != nil {
+				return err
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			payload, err := watermark.Detect(img, key)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), uuid.UUID(payload).String())
+			return nil
+		},
+	}
+	cmd.Flags().String("key", "", "watermark key from the server config")
+	return cmd
+}
@@ -3,9 +3,16 @@ package comfyui
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -17,105 +24,382 @@ var ServerAddress string
 // ClientID 是客户端的唯一标识符
 var ClientID = uuid.New().String()
 
-// QueuePrompt 发送提示到 ComfyUI 服务器
-func QueuePrompt(prompt Prompt) (map[string]interface{}, error) {
-	requestPayload := map[string]interface{}{
-		"prompt":    prompt,
-		"client_id": ClientID,
+// ErrStalled 表示提示长时间没有进展，已被中断
+var ErrStalled = errors.New("prompt stalled")
+
+// StatusError 表示 ComfyUI 返回了非 200 的响应
+type StatusError struct {
+	Code   int
+	Status string
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return "unexpected response status: " + e.Status
+	}
+	return "unexpected response status: " + e.Status + ": " + e.Body
+}
+
+// newStatusError 读取响应体的开头作为错误详情
+func newStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{Code: resp.StatusCode, Status: resp.Status, Body: string(bytes.TrimSpace(body))}
+}
+
+// Client 是单个 ComfyUI 服务器的客户端
+type Client struct {
+	Address    string       // 服务器地址，如 127.0.0.1:8188
+	ClientID   string       // WebSocket 与提交提示时使用的客户端标识
+	HTTPClient *http.Client // 为空时使用 http.DefaultClient
+}
+
+// NewClient 创建指向指定服务器的客户端，地址可带 http:// 前缀
+func NewClient(address string) *Client {
+	address = strings.TrimPrefix(address, "http://")
+	address = strings.TrimPrefix(address, "https://")
+	address = strings.TrimRight(address, "/")
+	return &Client{
+		Address:  address,
+		ClientID: uuid.New().String(),
+	}
+}
+
+// defaultClient 返回使用包级 ServerAddress 和 ClientID 的客户端
+func defaultClient() *Client {
+	return &Client{Address: ServerAddress, ClientID: ClientID}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
 	}
-	data, err := json.Marshal(requestPayload)
+	return http.DefaultClient
+}
+
+func (c *Client) url(path string) string {
+	return fmt.Sprintf("http://%s%s", c.Address, path)
+}
+
+// getJSON 发送 GET 请求并解码 JSON 响应
+func (c *Client) getJSON(path string, v interface{}) error {
+	resp, err := c.httpClient().Get(c.url(path))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
 	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
-	resp, err := http.Post(fmt.Sprintf("http://%s/prompt", ServerAddress), "application/json", bytes.NewBuffer(data))
+// postJSON 发送 JSON 格式的 POST 请求，v 不为空时解码响应
+func (c *Client) postJSON(path string, payload, v interface{}) error {
+	data, err := json.Marshal(payload)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	resp, err := c.httpClient().Post(c.url(path), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
+// Connect 建立接收执行事件的 WebSocket 连接
+func (c *Client) Connect() (*websocket.Conn, error) {
+	wsURL := "ws://" + c.Address + "/ws?clientId=" + url.QueryEscape(c.ClientID)
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	return ws, err
+}
+
+// QueuePrompt 发送提示到 ComfyUI 服务器
+func (c *Client) QueuePrompt(prompt Prompt) (map[string]interface{}, error) {
+	requestPayload := map[string]interface{}{
+		"prompt":    prompt,
+		"client_id": c.ClientID,
+	}
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := c.postJSON("/prompt", requestPayload, &result); err != nil {
 		return nil, err
 	}
+	if _, ok := result["prompt_id"].(string); !ok {
+		return nil, fmt.Errorf("prompt_id missing in response")
+	}
 	return result, nil
 }
 
 // GetImage 根据文件名和类型从服务器获取图像
-func GetImage(filename, subfolder, folderType string) ([]byte, error) {
-	url := fmt.Sprintf("http://%s/view?filename=%s&subfolder=%s&type=%s", ServerAddress, filename, subfolder, folderType)
-	resp, err := http.Get(url)
+func (c *Client) GetImage(filename, subfolder, folderType string) ([]byte, error) {
+	query := url.Values{}
+	query.Set("filename", filename)
+	query.Set("subfolder", subfolder)
+	query.Set("type", folderType)
+	resp, err := c.httpClient().Get(c.url("/view?" + query.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	return io.ReadAll(resp.Body)
 }
 
-// GetHistory 获取提示执行的历史记录
-func GetHistory(promptID string) (map[string]interface{}, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/history/%s", ServerAddress, promptID))
+// UploadImage 上传图像到服务器的 input、temp 或 output 目录，同名文件会被覆盖，返回服务器保存的文件引用
+func (c *Client) UploadImage(filename string, data []byte, folderType string) (ImageRef, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", filename)
 	if err != nil {
-		return nil, err
+		return ImageRef{}, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return ImageRef{}, err
+	}
+	_ = form.WriteField("type", folderType)
+	_ = form.WriteField("overwrite", "true")
+	if err := form.Close(); err != nil {
+		return ImageRef{}, err
+	}
+
+	resp, err := c.httpClient().Post(c.url("/upload/image"), form.FormDataContentType(), &body)
+	if err != nil {
+		return ImageRef{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ImageRef{}, newStatusError(resp)
+	}
+	var result struct {
+		Name      string `json:"name"`
+		Subfolder string `json:"subfolder"`
+		Type      string `json:"type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ImageRef{}, err
+	}
+	return ImageRef{Filename: result.Name, Subfolder: result.Subfolder, Type: result.Type}, nil
+}
 
+// GetHistory 获取提示执行的历史记录
+func (c *Client) GetHistory(promptID string) (map[string]interface{}, error) {
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := c.getJSON("/history/"+url.PathEscape(promptID), &result); err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
+// GetOutputImages 从历史记录中提取提示的输出图像引用，按节点 ID 排序
+func (c *Client) GetOutputImages(promptID string) ([]ImageRef, error) {
+	history, err := c.GetHistory(promptID)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := history[promptID].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("prompt %s not found in history", promptID)
+	}
+	outputs, _ := entry["outputs"].(map[string]interface{})
+
+	nodeIDs := make([]string, 0, len(outputs))
+	for nodeID := range outputs {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	var refs []ImageRef
+	for _, nodeID := range nodeIDs {
+		nodeOutputMap, ok := outputs[nodeID].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		images, _ := nodeOutputMap["images"].([]interface{})
+		for _, imgData := range images {
+			imgDetails, ok := imgData.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ref := ImageRef{NodeID: nodeID}
+			ref.Filename, _ = imgDetails["filename"].(string)
+			ref.Subfolder, _ = imgDetails["subfolder"].(string)
+			ref.Type, _ = imgDetails["type"].(string)
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// GetHistoryStatus 获取提示在历史记录中的执行状态，提示尚未完成时返回 nil
+func (c *Client) GetHistoryStatus(promptID string) (*HistoryStatus, error) {
+	var history map[string]struct {
+		Status HistoryStatus `json:"status"`
+	}
+	if err := c.getJSON("/history/"+url.PathEscape(promptID), &history); err != nil {
+		return nil, err
+	}
+	entry, ok := history[promptID]
+	if !ok {
+		return nil, nil
+	}
+	return &entry.Status, nil
+}
+
+// GetQueue 获取服务器当前的执行队列
+func (c *Client) GetQueue() (*QueueInfo, error) {
+	var raw struct {
+		Running []json.RawMessage `json:"queue_running"`
+		Pending []json.RawMessage `json:"queue_pending"`
+	}
+	if err := c.getJSON("/queue", &raw); err != nil {
+		return nil, err
+	}
+	info := &QueueInfo{}
+	var err error
+	if info.Running, err = parseQueueItems(raw.Running); err != nil {
+		return nil, err
+	}
+	if info.Pending, err = parseQueueItems(raw.Pending); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// parseQueueItems 解析队列条目，每个条目形如 [number, prompt_id, prompt, extra_data, outputs]
+func parseQueueItems(raw []json.RawMessage) ([]QueueItem, error) {
+	items := make([]QueueItem, 0, len(raw))
+	for _, entry := range raw {
+		var fields []json.RawMessage
+		if err := json.Unmarshal(entry, &fields); err != nil {
+			return nil, err
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed queue entry")
+		}
+		var item QueueItem
+		if err := json.Unmarshal(fields[0], &item.Number); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(fields[1], &item.PromptID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// GetSystemStats 获取服务器的系统与设备信息
+func (c *Client) GetSystemStats() (*SystemStats, error) {
+	var stats SystemStats
+	if err := c.getJSON("/system_stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// GetObjectInfo 获取服务器上全部节点类型的定义，键为 class_type
+func (c *Client) GetObjectInfo() (map[string]*NodeInfo, error) {
+	info := make(map[string]*NodeInfo)
+	if err := c.getJSON("/object_info", &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Interrupt 中断服务器上当前正在执行的提示
+func (c *Client) Interrupt() error {
+	return c.postJSON("/interrupt", map[string]interface{}{}, nil)
+}
+
+// DeleteFromQueue 从服务器等待队列中删除指定的提示
+func (c *Client) DeleteFromQueue(promptIDs ...string) error {
+	return c.postJSON("/queue", map[string]interface{}{"delete": promptIDs}, nil)
+}
+
+// DeleteHistory 从服务器历史记录中删除指定的提示
+func (c *Client) DeleteHistory(promptIDs ...string) error {
+	return c.postJSON("/history", map[string]interface{}{"delete": promptIDs}, nil)
+}
+
+// QueuePrompt 发送提示到 ComfyUI 服务器
+func QueuePrompt(prompt Prompt) (map[string]interface{}, error) {
+	return defaultClient().QueuePrompt(prompt)
+}
+
+// GetImage 根据文件名和类型从服务器获取图像
+func GetImage(filename, subfolder, folderType string) ([]byte, error) {
+	return defaultClient().GetImage(filename, subfolder, folderType)
+}
+
+// GetHistory 获取提示执行的历史记录
+func GetHistory(promptID string) (map[string]interface{}, error) {
+	return defaultClient().GetHistory(promptID)
+}
+
 // GetImages 监听 WebSocket 消息并处理它们
 func GetImages(ws *websocket.Conn, prompt Prompt) (map[string][][]byte, error) {
-	result, err := QueuePrompt(prompt)
+	return GetImagesTimeout(ws, prompt, 0)
+}
+
+// GetImagesTimeout 与 GetImages 相同，但提示超过 stall 没有任何进展时中断执行并返回 ErrStalled，stall 为 0 时不限制
+func GetImagesTimeout(ws *websocket.Conn, prompt Prompt, stall time.Duration) (map[string][][]byte, error) {
+	client := defaultClient()
+	result, err := client.QueuePrompt(prompt)
 	if err != nil {
 		return nil, err
 	}
 	promptID := result["prompt_id"].(string)
 
-	outputImages := make(map[string][][]byte)
-
+	lastProgress := time.Now()
 	for {
-		_, message, err := ws.ReadMessage()
+		if stall > 0 {
+			_ = ws.SetReadDeadline(lastProgress.Add(stall))
+		}
+		event, err := ReadEvent(ws)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			_ = client.Interrupt()
+			return nil, ErrStalled
+		}
 		if err != nil {
 			return nil, err
 		}
-
-		var msgData map[string]interface{}
-		if err := json.Unmarshal(message, &msgData); err != nil {
+		if event == nil {
 			continue // Ignore invalid messages
 		}
+		if event.PromptID() == promptID {
+			lastProgress = time.Now()
+		}
 
-		if msgData["type"] == "executing" {
-			data := msgData["data"].(map[string]interface{})
-			if data["node"] == nil && data["prompt_id"] == promptID {
+		if event.Type == EventExecuting {
+			data, err := event.Executing()
+			if err == nil && data.Node == nil && data.PromptID == promptID {
 				break // Execution is done
 			}
 		}
 	}
 
-	history, err := GetHistory(promptID)
+	refs, err := client.GetOutputImages(promptID)
 	if err != nil {
 		return nil, err
 	}
 
-	for nodeID, nodeOutput := range history[promptID].(map[string]interface{})["outputs"].(map[string]interface{}) {
-		if nodeOutputMap, ok := nodeOutput.(map[string]interface{}); ok {
-			if images, exists := nodeOutputMap["images"]; exists {
-				var imagesOutput [][]byte
-				for _, imgData := range images.([]interface{}) {
-					imgDetails := imgData.(map[string]interface{})
-					image, err := GetImage(imgDetails["filename"].(string), imgDetails["subfolder"].(string), imgDetails["type"].(string))
-					if err != nil {
-						return nil, err
-					}
-					imagesOutput = append(imagesOutput, image)
-				}
-				outputImages[nodeID] = imagesOutput
-			}
+	outputImages := make(map[string][][]byte)
+	for _, ref := range refs {
+		image, err := client.GetImage(ref.Filename, ref.Subfolder, ref.Type)
+		if err != nil {
+			return nil, err
 		}
+		outputImages[ref.NodeID] = append(outputImages[ref.NodeID], image)
 	}
 
 	return outputImages, nil
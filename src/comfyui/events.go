@@ -0,0 +1,195 @@
+package comfyui
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// ComfyUI WebSocket 事件类型
+const (
+	EventStatus               = "status"
+	EventExecutionStart       = "execution_start"
+	EventExecutionCached      = "execution_cached"
+	EventExecuting            = "executing"
+	EventProgress             = "progress"
+	EventExecuted             = "executed"
+	EventExecutionError       = "execution_error"
+	EventExecutionInterrupted = "execution_interrupted"
+	EventExecutionSuccess     = "execution_success"
+	EventPreview              = "preview" // 二进制预览图像，非 ComfyUI 原生名称
+)
+
+// 二进制消息中的事件与图像类型
+const (
+	binaryPreviewImage = 1
+	previewTypeJPEG    = 1
+	previewTypePNG     = 2
+)
+
+// Event 是从 ComfyUI WebSocket 读取的一条事件
+type Event struct {
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+	Preview *Preview        `json:"-"` // 仅 EventPreview 有效
+}
+
+// Preview 是采样过程中推送的预览图像
+type Preview struct {
+	MimeType string
+	Image    []byte
+}
+
+// StatusData 对应 status 事件
+type StatusData struct {
+	Status struct {
+		ExecInfo struct {
+			QueueRemaining int `json:"queue_remaining"`
+		} `json:"exec_info"`
+	} `json:"status"`
+	SID string `json:"sid,omitempty"`
+}
+
+// ExecutionStartData 对应 execution_start 与 execution_success 事件
+type ExecutionStartData struct {
+	PromptID  string `json:"prompt_id"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// ExecutionCachedData 对应 execution_cached 事件
+type ExecutionCachedData struct {
+	PromptID string   `json:"prompt_id"`
+	Nodes    []string `json:"nodes"`
+}
+
+// ExecutingData 对应 executing 事件，Node 为空表示提示执行完毕
+type ExecutingData struct {
+	PromptID string  `json:"prompt_id"`
+	Node     *string `json:"node"`
+}
+
+// ProgressData 对应 progress 事件
+type ProgressData struct {
+	PromptID string `json:"prompt_id"`
+	Node     string `json:"node"`
+	Value    int    `json:"value"`
+	Max      int    `json:"max"`
+}
+
+// ExecutedData 对应 executed 事件
+type ExecutedData struct {
+	PromptID string                 `json:"prompt_id"`
+	Node     string                 `json:"node"`
+	Output   map[string]interface{} `json:"output"`
+}
+
+// ExecutionErrorData 对应 execution_error 与 execution_interrupted 事件
+type ExecutionErrorData struct {
+	PromptID         string   `json:"prompt_id"`
+	NodeID           string   `json:"node_id"`
+	NodeType         string   `json:"node_type"`
+	Executed         []string `json:"executed"`
+	ExceptionMessage string   `json:"exception_message,omitempty"`
+	ExceptionType    string   `json:"exception_type,omitempty"`
+	Traceback        []string `json:"traceback,omitempty"`
+}
+
+// String 返回便于阅读的错误描述
+func (d *ExecutionErrorData) String() string {
+	return fmt.Sprintf("execution error in node %s (%s): %s: %s",
+		d.NodeID, d.NodeType, d.ExceptionType, d.ExceptionMessage)
+}
+
+// ReadEvent 从 WebSocket 读取下一条事件，无法解析的消息返回 nil 事件
+func ReadEvent(ws *websocket.Conn) (*Event, error) {
+	messageType, message, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return ParseEvent(messageType, message), nil
+}
+
+// ParseEvent 解析一条 WebSocket 消息，无法识别时返回 nil
+func ParseEvent(messageType int, message []byte) *Event {
+	if messageType == websocket.BinaryMessage {
+		return parseBinaryEvent(message)
+	}
+
+	var event Event
+	if err := json.Unmarshal(message, &event); err != nil || event.Type == "" {
+		return nil
+	}
+	return &event
+}
+
+// parseBinaryEvent 解析二进制预览消息：4 字节事件类型 + 4 字节图像类型 + 图像数据
+func parseBinaryEvent(message []byte) *Event {
+	if len(message) < 8 || binary.BigEndian.Uint32(message[:4]) != binaryPreviewImage {
+		return nil
+	}
+	preview := &Preview{Image: message[8:]}
+	switch binary.BigEndian.Uint32(message[4:8]) {
+	case previewTypeJPEG:
+		preview.MimeType = "image/jpeg"
+	case previewTypePNG:
+		preview.MimeType = "image/png"
+	default:
+		return nil
+	}
+	return &Event{Type: EventPreview, Preview: preview}
+}
+
+// PromptID 返回事件所属提示的 ID，不属于任何提示时为空
+func (e *Event) PromptID() string {
+	var data struct {
+		PromptID string `json:"prompt_id"`
+	}
+	if len(e.Data) == 0 || json.Unmarshal(e.Data, &data) != nil {
+		return ""
+	}
+	return data.PromptID
+}
+
+// Status 解析 status 事件
+func (e *Event) Status() (*StatusData, error) {
+	var data StatusData
+	return &data, json.Unmarshal(e.Data, &data)
+}
+
+// ExecutionStart 解析 execution_start 与 execution_success 事件
+func (e *Event) ExecutionStart() (*ExecutionStartData, error) {
+	var data ExecutionStartData
+	return &data, json.Unmarshal(e.Data, &data)
+}
+
+// ExecutionCached 解析 execution_cached 事件
+func (e *Event) ExecutionCached() (*ExecutionCachedData, error) {
+	var data ExecutionCachedData
+	return &data, json.Unmarshal(e.Data, &data)
+}
+
+// Executing 解析 executing 事件
+func (e *Event) Executing() (*ExecutingData, error) {
+	var data ExecutingData
+	return &data, json.Unmarshal(e.Data, &data)
+}
+
+// Progress 解析 progress 事件
+func (e *Event) Progress() (*ProgressData, error) {
+	var data ProgressData
+	return &data, json.Unmarshal(e.Data, &data)
+}
+
+// Executed 解析 executed 事件
+func (e *Event) Executed() (*ExecutedData, error) {
+	var data ExecutedData
+	return &data, json.Unmarshal(e.Data, &data)
+}
+
+// ExecutionError 解析 execution_error 与 execution_interrupted 事件
+func (e *Event) ExecutionError() (*ExecutionErrorData, error) {
+	var data ExecutionErrorData
+	return &data, json.Unmarshal(e.Data, &data)
+}
@@ -1,5 +1,11 @@
 package comfyui
 
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
 // PromptNode 表示提示节点的结构
 type PromptNode struct {
 	ClassType string `json:"class_type"`
@@ -8,7 +14,7 @@ type PromptNode struct {
 
 // Inputs 包含每个节点的输入字段
 type Inputs struct {
-	Cfg            int           `json:"cfg,omitempty"`
+	Cfg            float64       `json:"cfg,omitempty"`
 	Denoise        float64       `json:"denoise,omitempty"`
 	LatentImage    []interface{} `json:"latent_image,omitempty"`
 	Model          []interface{} `json:"model,omitempty"`
@@ -28,9 +34,271 @@ type Inputs struct {
 	Images         []interface{} `json:"images,omitempty"`
 	Samples        []interface{} `json:"samples,omitempty"`
 	Vae            []interface{} `json:"vae,omitempty"`
+
+	// Extra 保存上面未列出的输入，如 lora_name、自定义节点的参数等，序列化时原样输出。
+	// 已列出但为零值的输入（如空的 text）也保存在这里，避免序列化时因 omitempty 丢失。
+	// 数值保存为 json.Number，超过 2^53 的种子等大整数不会丢失精度
+	Extra map[string]interface{} `json:"-"`
+}
+
+// inputsAlias 用于在自定义序列化中使用默认行为
+type inputsAlias Inputs
+
+// MarshalJSON 输出已列出的字段与 Extra 中的输入，已列出的字段有值时优先
+func (in Inputs) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(inputsAlias(in))
+	if err != nil || len(in.Extra) == 0 {
+		return data, err
+	}
+	values, err := decodeValues(data)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range in.Extra {
+		if _, ok := values[name]; !ok {
+			values[name] = value
+		}
+	}
+	return json.Marshal(values)
+}
+
+// UnmarshalJSON 解析已列出的字段，其余输入与为零值的已列出字段保存到 Extra
+func (in *Inputs) UnmarshalJSON(data []byte) error {
+	var alias inputsAlias
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	values, err := decodeValues(data)
+	if err != nil {
+		return err
+	}
+	alias.Extra = nil
+	typed := make(map[string]interface{})
+	if data, err := json.Marshal(alias); err == nil {
+		typed, _ = decodeValues(data)
+	}
+	for name, value := range values {
+		if _, ok := typed[name]; ok {
+			continue
+		}
+		if alias.Extra == nil {
+			alias.Extra = make(map[string]interface{})
+		}
+		alias.Extra[name] = value
+	}
+	*in = Inputs(alias)
+	return nil
+}
+
+// Values 返回全部输入，键为输入名称，数值为 json.Number
+func (in Inputs) Values() map[string]interface{} {
+	values := make(map[string]interface{})
+	if data, err := in.MarshalJSON(); err == nil {
+		if decoded, err := decodeValues(data); err == nil {
+			values = decoded
+		}
+	}
+	return values
+}
+
+// decodeValues 解析 JSON 对象，数值保存为 json.Number 以保留大整数的精度
+func decodeValues(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Int64 将数值输入转为 int64，接受 json.Number、float64 与整数类型，不是整数时返回 false
+func Int64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		return n, err == nil
+	case float64:
+		return int64(v), v == float64(int64(v))
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	default:
+		return 0, false
+	}
 }
 
 // Prompt 是表示所有节点的整体结构
 type Prompt struct {
 	Nodes map[string]PromptNode `json:"nodes"`
 }
+
+// MarshalJSON 按 ComfyUI API 格式输出，即以节点 ID 为键的扁平对象
+func (p Prompt) MarshalJSON() ([]byte, error) {
+	if p.Nodes == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(p.Nodes)
+}
+
+// UnmarshalJSON 同时接受 API 格式与带 nodes 字段的包装格式
+func (p *Prompt) UnmarshalJSON(data []byte) error {
+	var wrapped struct {
+		Nodes map[string]PromptNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err == nil && wrapped.Nodes != nil {
+		p.Nodes = wrapped.Nodes
+		return nil
+	}
+	return json.Unmarshal(data, &p.Nodes)
+}
+
+// ImageRef 引用服务器上由某个节点输出的图像文件
+type ImageRef struct {
+	NodeID    string `json:"node_id"`
+	Filename  string `json:"filename"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// QueueItem 是服务器队列中的一个提示
+type QueueItem struct {
+	Number   float64 `json:"number"`
+	PromptID string  `json:"prompt_id"`
+}
+
+// QueueInfo 是服务器的执行队列
+type QueueInfo struct {
+	Running []QueueItem `json:"queue_running"`
+	Pending []QueueItem `json:"queue_pending"`
+}
+
+// Position 返回提示前面还有多少个提示，不在队列中时返回 -1
+func (q *QueueInfo) Position(promptID string) int {
+	for _, item := range q.Running {
+		if item.PromptID == promptID {
+			return 0
+		}
+	}
+	for _, item := range q.Pending {
+		if item.PromptID != promptID {
+			continue
+		}
+		ahead := len(q.Running)
+		for _, other := range q.Pending {
+			if other.Number < item.Number {
+				ahead++
+			}
+		}
+		return ahead
+	}
+	return -1
+}
+
+// HistoryStatus 是历史记录中提示的执行状态
+type HistoryStatus struct {
+	StatusStr string            `json:"status_str"` // success 或 error
+	Completed bool              `json:"completed"`
+	Messages  []json.RawMessage `json:"messages"` // 每条形如 [事件类型, 数据]
+}
+
+// Error 返回执行失败时的错误信息，成功时为空
+func (s *HistoryStatus) Error() string {
+	if s.StatusStr != "error" {
+		return ""
+	}
+	if data := s.ExecutionError(); data != nil {
+		return data.String()
+	}
+	return "execution error"
+}
+
+// ExecutionError 返回执行失败时的 execution_error 事件数据，没有时返回 nil
+func (s *HistoryStatus) ExecutionError() *ExecutionErrorData {
+	if s.StatusStr != "error" {
+		return nil
+	}
+	for _, raw := range s.Messages {
+		var message []json.RawMessage
+		if json.Unmarshal(raw, &message) != nil || len(message) < 2 {
+			continue
+		}
+		var typ string
+		if json.Unmarshal(message[0], &typ) != nil || typ != EventExecutionError {
+			continue
+		}
+		var data ExecutionErrorData
+		if json.Unmarshal(message[1], &data) == nil {
+			return &data
+		}
+	}
+	return nil
+}
+
+// SystemStats 是 /system_stats 返回的系统信息
+type SystemStats struct {
+	System struct {
+		OS             string `json:"os"`
+		PythonVersion  string `json:"python_version,omitempty"`
+		ComfyUIVersion string `json:"comfyui_version,omitempty"`
+	} `json:"system"`
+	Devices []Device `json:"devices"`
+}
+
+// Device 是服务器上的计算设备
+type Device struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	Index          int    `json:"index"`
+	VRAMTotal      int64  `json:"vram_total"`
+	VRAMFree       int64  `json:"vram_free"`
+	TorchVRAMTotal int64  `json:"torch_vram_total"`
+	TorchVRAMFree  int64  `json:"torch_vram_free"`
+}
+
+// NodeInfo 是 /object_info 中一种节点类型的定义
+type NodeInfo struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Input    struct {
+		Required map[string]json.RawMessage `json:"required"`
+		Optional map[string]json.RawMessage `json:"optional"`
+	} `json:"input"`
+}
+
+// Options 返回节点各枚举输入（如 ckpt_name、lora_name）的可选值
+func (n *NodeInfo) Options() map[string][]string {
+	options := make(map[string][]string)
+	for _, inputs := range []map[string]json.RawMessage{n.Input.Required, n.Input.Optional} {
+		for name, spec := range inputs {
+			if values, ok := parseComboOptions(spec); ok {
+				options[name] = values
+			}
+		}
+	}
+	return options
+}
+
+// parseComboOptions 解析枚举输入的定义，兼容 [[值...], {...}] 与 ["COMBO", {"options": [值...]}] 两种格式
+func parseComboOptions(spec json.RawMessage) ([]string, bool) {
+	var parts []json.RawMessage
+	if json.Unmarshal(spec, &parts) != nil || len(parts) == 0 {
+		return nil, false
+	}
+	var values []string
+	if json.Unmarshal(parts[0], &values) == nil {
+		return values, true
+	}
+	var typ string
+	if json.Unmarshal(parts[0], &typ) != nil || typ != "COMBO" || len(parts) < 2 {
+		return nil, false
+	}
+	var extra struct {
+		Options []string `json:"options"`
+	}
+	if json.Unmarshal(parts[1], &extra) != nil || extra.Options == nil {
+		return nil, false
+	}
+	return extra.Options, true
+}
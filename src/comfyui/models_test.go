@@ -0,0 +1,79 @@
+package comfyui
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInputsRoundTrip(t *testing.T) {
+	// 种子超过 2^53，float64 无法精确表示
+	const workflow = `{
+		"3": {"class_type": "KSampler", "inputs": {"seed": 123456789012345678, "cfg": 7.5, "text": "", "model": ["4", 0]}},
+		"5": {"class_type": "SamplerCustom", "inputs": {"noise_seed": 123456789012345679, "custom": {"scale": 1.25, "count": 9007199254740993}}}
+	}`
+	var prompt Prompt
+	if err := json.Unmarshal([]byte(workflow), &prompt); err != nil {
+		t.Fatal(err)
+	}
+	if seed := prompt.Nodes["3"].Inputs.Seed; seed != 123456789012345678 {
+		t.Fatalf("seed = %d", seed)
+	}
+	if seed, ok := Int64(prompt.Nodes["5"].Inputs.Extra["noise_seed"]); !ok || seed != 123456789012345679 {
+		t.Fatalf("noise_seed = %v, %v", prompt.Nodes["5"].Inputs.Extra["noise_seed"], ok)
+	}
+
+	data, err := json.Marshal(prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got interface{}
+	decode := func(data []byte, v *interface{}) {
+		t.Helper()
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decode([]byte(workflow), &want)
+	decode(data, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip changed the workflow:\n got %s", data)
+	}
+	for _, number := range []string{"123456789012345678", "123456789012345679", "9007199254740993"} {
+		if !strings.Contains(string(data), number) {
+			t.Fatalf("%s lost in %s", number, data)
+		}
+	}
+
+	// Values 中的数值保留精度
+	values := prompt.Nodes["3"].Inputs.Values()
+	if seed, ok := Int64(values["seed"]); !ok || seed != 123456789012345678 {
+		t.Fatalf("Values seed = %v", values["seed"])
+	}
+	if _, ok := values["text"]; !ok {
+		t.Fatal("Values dropped the empty text input")
+	}
+}
+
+func TestInt64(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  int64
+		ok    bool
+	}{
+		{json.Number("123456789012345678"), 123456789012345678, true},
+		{json.Number("1.5"), 0, false},
+		{float64(42), 42, true},
+		{1.5, 1, false},
+		{7, 7, true},
+		{int64(-3), -3, true},
+		{"1", 0, false},
+		{nil, 0, false},
+	} {
+		got, ok := Int64(tc.value)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("Int64(%#v) = %d, %v; want %d, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+// Package infotext 解析 Automatic1111 / Forge 写入图片 parameters 文本块的生成参数（infotext），
+// 并将其转换为 ComfyUI 的标准文生图工作流。
+//
+// infotext 的格式为：正向提示若干行，可选的以 "Negative prompt:" 开头的反向提示，
+// 最后一行为逗号分隔的 "键: 值" 参数，值中含有逗号时用双引号括起。
+package infotext
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// ErrNoParameters 表示文本中没有生成参数
+var ErrNoParameters = errors.New("no generation parameters")
+
+// 未写入 infotext 时使用的 A1111 默认值
+const (
+	defaultSteps    = 20
+	defaultCFGScale = 7
+	defaultSize     = 512
+	defaultSampler  = "Euler a"
+)
+
+// 参数行中的一项，与 A1111 的 re_param 相同
+var paramPattern = regexp.MustCompile(`\s*(\w[\w \-/]+):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+
+// 提示中的 <lora:名称:权重> 等额外网络
+var networkPattern = regexp.MustCompile(`<(\w+):([^>:]+)((?::[^>:]*)*)>`)
+
+// 删除额外网络后留下的连续空格、逗号前的空白与连续的逗号
+var (
+	spacesPattern = regexp.MustCompile(`[ \t]{2,}`)
+	commasPattern = regexp.MustCompile(`\s*,(\s*,)*`)
+)
+
+// Parameters 是解析后的生成参数
+type Parameters struct {
+	Prompt         string            `json:"prompt"`
+	NegativePrompt string            `json:"negative_prompt"`
+	Steps          int               `json:"steps"`
+	Sampler        string            `json:"sampler"`
+	ScheduleType   string            `json:"schedule_type,omitempty"`
+	CFGScale       float64           `json:"cfg_scale"`
+	Seed           int64             `json:"seed"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	Model          string            `json:"model,omitempty"`
+	ModelHash      string            `json:"model_hash,omitempty"`
+	ClipSkip       int               `json:"clip_skip,omitempty"`
+	Settings       map[string]string `json:"settings"` // 参数行中的全部项，包括未识别的
+}
+
+// 转换时使用的参数项，其余项作为警告返回
+var usedSettings = map[string]bool{
+	"Steps": true, "Sampler": true, "Schedule type": true, "CFG scale": true, "Seed": true,
+	"Size": true, "Model": true, "Model hash": true, "Clip skip": true,
+	// 只是记录，不影响生成
+	"Version": true, "Lora hashes": true, "TI hashes": true, "Hashes": true,
+}
+
+// Parse 解析 infotext。只有提示没有参数行时使用 A1111 的默认参数。
+func Parse(text string) (*Parameters, error) {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if text == "" {
+		return nil, ErrNoParameters
+	}
+	lines := strings.Split(text, "\n")
+	last := lines[len(lines)-1]
+	settings := make(map[string]string)
+	if len(paramPattern.FindAllString(last, -1)) >= 3 {
+		lines = lines[:len(lines)-1]
+		for _, match := range paramPattern.FindAllStringSubmatch(last, -1) {
+			key, value := strings.TrimSpace(match[1]), strings.TrimSpace(match[2])
+			if strings.HasPrefix(value, `"`) {
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+			}
+			settings[key] = value
+		}
+	}
+
+	p := &Parameters{
+		Steps:    defaultSteps,
+		Sampler:  defaultSampler,
+		CFGScale: defaultCFGScale,
+		Width:    defaultSize,
+		Height:   defaultSize,
+		Settings: settings,
+	}
+	var prompt, negative []string
+	negativeStarted := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if rest, ok := strings.CutPrefix(line, "Negative prompt:"); ok {
+			negativeStarted = true
+			line = strings.TrimSpace(rest)
+		}
+		if negativeStarted {
+			negative = append(negative, line)
+		} else {
+			prompt = append(prompt, line)
+		}
+	}
+	p.Prompt = strings.Join(prompt, "\n")
+	p.NegativePrompt = strings.Join(negative, "\n")
+
+	var err error
+	if value, ok := settings["Steps"]; ok {
+		if p.Steps, err = strconv.Atoi(value); err != nil || p.Steps <= 0 {
+			return nil, fmt.Errorf("invalid Steps %q", value)
+		}
+	}
+	if value, ok := settings["Sampler"]; ok {
+		p.Sampler = value
+	}
+	p.ScheduleType = settings["Schedule type"]
+	if value, ok := settings["CFG scale"]; ok {
+		if p.CFGScale, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("invalid CFG scale %q", value)
+		}
+	}
+	if value, ok := settings["Seed"]; ok {
+		if p.Seed, err = strconv.ParseInt(value, 10, 64); err != nil || p.Seed < 0 {
+			return nil, fmt.Errorf("invalid Seed %q", value)
+		}
+	}
+	if value, ok := settings["Size"]; ok {
+		width, height, found := strings.Cut(value, "x")
+		p.Width, err = strconv.Atoi(width)
+		if err == nil {
+			p.Height, err = strconv.Atoi(height)
+		}
+		if !found || err != nil || p.Width <= 0 || p.Height <= 0 {
+			return nil, fmt.Errorf("invalid Size %q", value)
+		}
+	}
+	p.Model = settings["Model"]
+	p.ModelHash = settings["Model hash"]
+	if value, ok := settings["Clip skip"]; ok {
+		if p.ClipSkip, err = strconv.Atoi(value); err != nil || p.ClipSkip < 0 {
+			return nil, fmt.Errorf("invalid Clip skip %q", value)
+		}
+	}
+	return p, nil
+}
+
+// sampler 是 A1111 采样器对应的 ComfyUI sampler_name 与 Automatic 时的默认调度器
+type sampler struct {
+	name      string
+	scheduler string
+	note      string // 转换后与 A1111 不完全相同时的说明
+}
+
+// samplers 以小写的 A1111 采样器名称为键
+var samplers = map[string]sampler{
+	"euler a":           {name: "euler_ancestral", scheduler: "normal"},
+	"euler":             {name: "euler", scheduler: "normal"},
+	"lms":               {name: "lms", scheduler: "normal"},
+	"heun":              {name: "heun", scheduler: "normal"},
+	"dpm2":              {name: "dpm_2", scheduler: "normal"},
+	"dpm2 a":            {name: "dpm_2_ancestral", scheduler: "normal"},
+	"dpm++ 2s a":        {name: "dpmpp_2s_ancestral", scheduler: "karras"},
+	"dpm++ 2m":          {name: "dpmpp_2m", scheduler: "karras"},
+	"dpm++ sde":         {name: "dpmpp_sde", scheduler: "karras"},
+	"dpm++ 2m sde":      {name: "dpmpp_2m_sde", scheduler: "exponential"},
+	"dpm++ 2m sde heun": {name: "dpmpp_2m_sde", scheduler: "exponential", note: "KSampler has no heun solver for DPM++ 2M SDE, using midpoint"},
+	"dpm++ 3m sde":      {name: "dpmpp_3m_sde", scheduler: "exponential"},
+	"dpm fast":          {name: "dpm_fast", scheduler: "normal"},
+	"dpm adaptive":      {name: "dpm_adaptive", scheduler: "normal"},
+	"lcm":               {name: "lcm", scheduler: "normal"},
+	"ddim":              {name: "ddim", scheduler: "ddim_uniform"},
+	"ddpm":              {name: "ddpm", scheduler: "normal"},
+	"unipc":             {name: "uni_pc", scheduler: "normal"},
+}
+
+// schedulers 以小写的 A1111 调度类型为键，空值表示使用采样器的默认调度器
+var schedulers = map[string]string{
+	"automatic":   "",
+	"uniform":     "normal",
+	"normal":      "normal",
+	"karras":      "karras",
+	"exponential": "exponential",
+	"sgm uniform": "sgm_uniform",
+	"kl optimal":  "kl_optimal",
+	"simple":      "simple",
+	"ddim":        "ddim_uniform",
+	"beta":        "beta",
+}
+
+// MapSampler 将 A1111 的采样器与调度类型转换为 ComfyUI 的 sampler_name 与 scheduler。
+// 兼容旧版将调度器写在采样器名称后的格式，如 "DPM++ 2M Karras"。返回的说明不为空时结果与 A1111 不完全相同。
+func MapSampler(name, scheduleType string) (string, string, string, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	s, ok := samplers[key]
+	if !ok {
+		// 旧版的 "采样器 调度器"，调度器可能由多个词组成
+		for suffix := range schedulers {
+			if base, found := strings.CutSuffix(key, " "+suffix); found {
+				if s, ok = samplers[base]; ok {
+					if scheduleType == "" {
+						scheduleType = suffix
+					}
+					break
+				}
+			}
+		}
+	}
+	if !ok {
+		return "", "", "", fmt.Errorf("unsupported sampler %q", name)
+	}
+	scheduler := s.scheduler
+	if scheduleType != "" {
+		mapped, ok := schedulers[strings.ToLower(strings.TrimSpace(scheduleType))]
+		if !ok {
+			return "", "", "", fmt.Errorf("unsupported schedule type %q", scheduleType)
+		}
+		if mapped != "" {
+			scheduler = mapped
+		}
+	}
+	return s.name, scheduler, s.note, nil
+}
+
+// Options 是转换为工作流时的选项
+type Options struct {
+	Checkpoint     string // ckpt_name，为空时使用参数中的 Model 加上 .safetensors
+	FilenamePrefix string // SaveImage 的文件名前缀，默认为 ComfyUI
+}
+
+// Workflow 将参数转换为 ComfyUI 的文生图工作流，节点 ID 与 ComfyUI 默认工作流相同。
+// 提示中的 <lora:名称:权重> 转换为串联的 LoraLoader 节点；返回的警告列出未能转换的参数。
+func (p *Parameters) Workflow(opts Options) (comfyui.Prompt, []string, error) {
+	var warnings []string
+	samplerName, scheduler, note, err := MapSampler(p.Sampler, p.ScheduleType)
+	if err != nil {
+		return comfyui.Prompt{}, nil, err
+	}
+	if note != "" {
+		warnings = append(warnings, note)
+	}
+	checkpoint := opts.Checkpoint
+	if checkpoint == "" {
+		if p.Model == "" {
+			return comfyui.Prompt{}, nil, errors.New("parameters have no Model, a checkpoint is required")
+		}
+		checkpoint = modelFile(p.Model)
+	}
+	prefix := opts.FilenamePrefix
+	if prefix == "" {
+		prefix = "ComfyUI"
+	}
+
+	nodes := map[string]comfyui.PromptNode{
+		"4": {ClassType: "CheckpointLoaderSimple", Inputs: comfyui.Inputs{CkptName: checkpoint}},
+	}
+	model, clip := []interface{}{"4", 0}, []interface{}{"4", 1}
+	next := 10
+	newID := func() string {
+		id := strconv.Itoa(next)
+		next++
+		return id
+	}
+
+	prompt, loras, others := extractNetworks(p.Prompt)
+	negative, _, negativeOthers := extractNetworks(p.NegativePrompt)
+	for _, lora := range loras {
+		id := newID()
+		nodes[id] = comfyui.PromptNode{ClassType: "LoraLoader", Inputs: comfyui.Inputs{
+			Model: model,
+			Clip:  clip,
+			Extra: map[string]interface{}{
+				"lora_name":      modelFile(lora.name),
+				"strength_model": lora.unet,
+				"strength_clip":  lora.te,
+			},
+		}}
+		model, clip = []interface{}{id, 0}, []interface{}{id, 1}
+	}
+	for _, network := range append(others, negativeOthers...) {
+		warnings = append(warnings, fmt.Sprintf("unsupported extra network %s", network))
+	}
+	if p.ClipSkip > 1 {
+		id := newID()
+		nodes[id] = comfyui.PromptNode{ClassType: "CLIPSetLastLayer", Inputs: comfyui.Inputs{
+			Clip:  clip,
+			Extra: map[string]interface{}{"stop_at_clip_layer": -p.ClipSkip},
+		}}
+		clip = []interface{}{id, 0}
+	}
+
+	nodes["3"] = comfyui.PromptNode{ClassType: "KSampler", Inputs: comfyui.Inputs{
+		Seed:        p.Seed,
+		Steps:       p.Steps,
+		Cfg:         p.CFGScale,
+		SamplerName: samplerName,
+		Scheduler:   scheduler,
+		Denoise:     1,
+		Model:       model,
+		Positive:    []interface{}{"6", 0},
+		Negative:    []interface{}{"7", 0},
+		LatentImage: []interface{}{"5", 0},
+		// seed 为 0 时仍需输出
+		Extra: map[string]interface{}{"seed": p.Seed},
+	}}
+	nodes["5"] = comfyui.PromptNode{ClassType: "EmptyLatentImage", Inputs: comfyui.Inputs{Width: p.Width, Height: p.Height, BatchSize: 1}}
+	nodes["6"] = comfyui.PromptNode{ClassType: "CLIPTextEncode", Inputs: comfyui.Inputs{
+		// 提示为空时仍需输出 text
+		Text: prompt, Clip: clip, Extra: map[string]interface{}{"text": prompt},
+	}}
+	nodes["7"] = comfyui.PromptNode{ClassType: "CLIPTextEncode", Inputs: comfyui.Inputs{
+		Text: negative, Clip: clip, Extra: map[string]interface{}{"text": negative},
+	}}
+	nodes["8"] = comfyui.PromptNode{ClassType: "VAEDecode", Inputs: comfyui.Inputs{Samples: []interface{}{"3", 0}, Vae: []interface{}{"4", 2}}}
+	nodes["9"] = comfyui.PromptNode{ClassType: "SaveImage", Inputs: comfyui.Inputs{FilenamePrefix: prefix, Images: []interface{}{"8", 0}}}
+
+	var ignored []string
+	for key := range p.Settings {
+		if !usedSettings[key] {
+			ignored = append(ignored, key)
+		}
+	}
+	sort.Strings(ignored)
+	for _, key := range ignored {
+		warnings = append(warnings, fmt.Sprintf("ignored parameter %q", key))
+	}
+	return comfyui.Prompt{Nodes: nodes}, warnings, nil
+}
+
+// modelFile 为没有扩展名的模型名称加上 .safetensors
+func modelFile(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".safetensors", ".ckpt", ".pt", ".pth", ".bin":
+		return name
+	}
+	return name + ".safetensors"
+}
+
+// lora 是提示中的一个 <lora:名称:文本编码器权重:UNet 权重>
+type lora struct {
+	name string
+	te   float64
+	unet float64
+}
+
+// extractNetworks 从提示中删除 <lora:...> 等额外网络，返回删除后的提示、LoRA 与不支持的其他网络
+func extractNetworks(text string) (string, []lora, []string) {
+	var loras []lora
+	var others []string
+	text = networkPattern.ReplaceAllStringFunc(text, func(tag string) string {
+		match := networkPattern.FindStringSubmatch(tag)
+		kind := strings.ToLower(match[1])
+		if kind != "lora" && kind != "lyco" {
+			others = append(others, tag)
+			return ""
+		}
+		l := lora{name: match[2], te: 1}
+		args := strings.Split(strings.TrimPrefix(match[3], ":"), ":")
+		if value, err := strconv.ParseFloat(args[0], 64); err == nil {
+			l.te = value
+		}
+		l.unet = l.te
+		if len(args) > 1 {
+			if value, err := strconv.ParseFloat(args[1], 64); err == nil {
+				l.unet = value
+			}
+		}
+		loras = append(loras, l)
+		return ""
+	})
+	return strings.TrimSpace(collapseSpaces(text)), loras, others
+}
+
+// collapseSpaces 合并删除标签后留下的连续空格与多余逗号
+func collapseSpaces(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text = spacesPattern.ReplaceAllString(strings.Join(lines, "\n"), " ")
+	text = commasPattern.ReplaceAllString(text, ",")
+	return strings.Trim(text, ", ")
+}
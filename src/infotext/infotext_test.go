@@ -0,0 +1,262 @@
+package infotext
+
+import (
+	"errors"
+	"maps"
+	"reflect"
+	"testing"
+)
+
+const example = `masterpiece, a cat <lora:add_detail:0.8>, sitting on a chair,  <lora:film:0.5:0.7>
+Negative prompt: blurry, lowres
+Steps: 20, Sampler: DPM++ 2M Karras, CFG scale: 7, Seed: 123456789012, Size: 512x768, Model hash: 6ce0161689, Model: v1-5-pruned-emaonly, Lora hashes: "add_detail: 7c6bad76eb54, film: 1a2b3c4d", Version: v1.9.4`
+
+func TestParse(t *testing.T) {
+	p, err := Parse(example)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Parameters{
+		Prompt:         "masterpiece, a cat <lora:add_detail:0.8>, sitting on a chair,  <lora:film:0.5:0.7>",
+		NegativePrompt: "blurry, lowres",
+		Steps:          20,
+		Sampler:        "DPM++ 2M Karras",
+		CFGScale:       7,
+		Seed:           123456789012,
+		Width:          512,
+		Height:         768,
+		Model:          "v1-5-pruned-emaonly",
+		ModelHash:      "6ce0161689",
+		Settings: map[string]string{
+			"Steps":       "20",
+			"Sampler":     "DPM++ 2M Karras",
+			"CFG scale":   "7",
+			"Seed":        "123456789012",
+			"Size":        "512x768",
+			"Model hash":  "6ce0161689",
+			"Model":       "v1-5-pruned-emaonly",
+			"Lora hashes": "add_detail: 7c6bad76eb54, film: 1a2b3c4d",
+			"Version":     "v1.9.4",
+		},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("Parse =\n%+v\nwant\n%+v", p, want)
+	}
+}
+
+func TestParseCases(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want Parameters // 只比较 Settings 以外的字段
+	}{
+		{
+			name: "prompt only",
+			text: "a cat",
+			want: Parameters{Prompt: "a cat", Steps: 20, Sampler: "Euler a", CFGScale: 7, Width: 512, Height: 512},
+		},
+		{
+			name: "multi-line prompts and CRLF",
+			text: "a cat,\r\nsitting\r\nNegative prompt: ugly,\r\nblurry\r\nSteps: 30, Sampler: Euler, Schedule type: Karras, CFG scale: 4.5, Seed: 0, Size: 1024x1024, Clip skip: 2",
+			want: Parameters{
+				Prompt: "a cat,\nsitting", NegativePrompt: "ugly,\nblurry", Steps: 30, Sampler: "Euler",
+				ScheduleType: "Karras", CFGScale: 4.5, Width: 1024, Height: 1024, ClipSkip: 2,
+			},
+		},
+		{
+			name: "empty negative prompt",
+			text: "a cat\nNegative prompt:\nSteps: 8, Sampler: LCM, CFG scale: 1.5, Seed: 42",
+			want: Parameters{Prompt: "a cat", Steps: 8, Sampler: "LCM", CFGScale: 1.5, Seed: 42, Width: 512, Height: 512},
+		},
+		{
+			// 少于 3 项的最后一行视为提示
+			name: "short last line",
+			text: "a cat\nstyle: photo, light: soft",
+			want: Parameters{Prompt: "a cat\nstyle: photo, light: soft", Steps: 20, Sampler: "Euler a", CFGScale: 7, Width: 512, Height: 512},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Parse(tc.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Settings = nil
+			if !reflect.DeepEqual(*p, tc.want) {
+				t.Fatalf("Parse =\n%+v\nwant\n%+v", *p, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseQuoting(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want map[string]string
+	}{
+		{`Steps: 20, Hashes: "a, b", Seed: 1`, map[string]string{"Steps": "20", "Hashes": "a, b", "Seed": "1"}},
+		{`Steps: 20, Note: "say \"hi\", ok", Seed: 1`, map[string]string{"Steps": "20", "Note": `say "hi", ok`, "Seed": "1"}},
+		{`Steps: 20, ADetailer model: face_yolov8n.pt, Hires upscaler: 4x-UltraSharp, Seed: 1`, map[string]string{
+			"Steps": "20", "ADetailer model": "face_yolov8n.pt", "Hires upscaler": "4x-UltraSharp", "Seed": "1",
+		}},
+		{`Steps: 20,Seed: 1,  Size: 64x64 , Empty: , Seed2: 3`, map[string]string{"Steps": "20", "Seed": "1", "Size": "64x64", "Empty": "", "Seed2": "3"}},
+	} {
+		p, err := Parse("prompt\n" + tc.line)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.line, err)
+		}
+		if !maps.Equal(p.Settings, tc.want) {
+			t.Errorf("%s: settings %v, want %v", tc.line, p.Settings, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"  \n ",
+		"a\nSteps: x, Sampler: Euler, Seed: 1",
+		"a\nSteps: 0, Sampler: Euler, Seed: 1",
+		"a\nSteps: 20, CFG scale: high, Seed: 1",
+		"a\nSteps: 20, Sampler: Euler, Seed: -1",
+		"a\nSteps: 20, Sampler: Euler, Size: 512",
+		"a\nSteps: 20, Sampler: Euler, Size: 0x512",
+		"a\nSteps: 20, Sampler: Euler, Clip skip: -2",
+	} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("Parse(%q) accepted invalid parameters", text)
+		}
+	}
+	if _, err := Parse(" "); !errors.Is(err, ErrNoParameters) {
+		t.Errorf("Parse(blank) = %v, want %v", err, ErrNoParameters)
+	}
+}
+
+func TestMapSampler(t *testing.T) {
+	for _, tc := range []struct {
+		name, scheduleType string
+		sampler, scheduler string
+		note               bool
+	}{
+		{"Euler a", "", "euler_ancestral", "normal", false},
+		{"euler", "Automatic", "euler", "normal", false},
+		{"DPM++ 2M", "", "dpmpp_2m", "karras", false},
+		{"DPM++ 2M", "Exponential", "dpmpp_2m", "exponential", false},
+		{"DPM++ 2M", "SGM Uniform", "dpmpp_2m", "sgm_uniform", false},
+		{"DPM++ 2M SDE", "", "dpmpp_2m_sde", "exponential", false},
+		{"DPM++ 2M SDE Heun", "Karras", "dpmpp_2m_sde", "karras", true},
+		{"UniPC", "Uniform", "uni_pc", "normal", false},
+		{"DDIM", "", "ddim", "ddim_uniform", false},
+		// 旧版将调度器写在采样器名称之后
+		{"DPM++ 2M Karras", "", "dpmpp_2m", "karras", false},
+		{"DPM++ SDE Karras", "", "dpmpp_sde", "karras", false},
+		{"DPM++ 2M SDE Exponential", "", "dpmpp_2m_sde", "exponential", false},
+		{"Euler SGM Uniform", "", "euler", "sgm_uniform", false},
+		{"DPM2 a Karras", "", "dpm_2_ancestral", "karras", false},
+		// 同时写有调度类型时以调度类型为准
+		{"DPM++ 2M Karras", "Exponential", "dpmpp_2m", "exponential", false},
+	} {
+		sampler, scheduler, note, err := MapSampler(tc.name, tc.scheduleType)
+		if err != nil {
+			t.Errorf("MapSampler(%q, %q): %v", tc.name, tc.scheduleType, err)
+			continue
+		}
+		if sampler != tc.sampler || scheduler != tc.scheduler || (note != "") != tc.note {
+			t.Errorf("MapSampler(%q, %q) = %q, %q, %q; want %q, %q, note %v",
+				tc.name, tc.scheduleType, sampler, scheduler, note, tc.sampler, tc.scheduler, tc.note)
+		}
+	}
+
+	for _, tc := range [][2]string{{"Restart", ""}, {"Karras", ""}, {"Euler", "Cosine"}, {"DPM++ 2M Cosine", ""}} {
+		if _, _, _, err := MapSampler(tc[0], tc[1]); err == nil {
+			t.Errorf("MapSampler(%q, %q) accepted an unsupported sampler", tc[0], tc[1])
+		}
+	}
+}
+
+func TestExtractNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		prompt string
+		loras  []lora
+		others []string
+	}{
+		{"a cat", "a cat", nil, nil},
+		{"a cat,\nsitting", "a cat,\nsitting", nil, nil},
+		{"a cat, <lora:add_detail:0.8>, outdoors", "a cat, outdoors", []lora{{"add_detail", 0.8, 0.8}}, nil},
+		{"<lora:film:0.5:0.7> a cat", "a cat", []lora{{"film", 0.5, 0.7}}, nil},
+		{"a cat <LoRA:style v2>", "a cat", []lora{{"style v2", 1, 1}}, nil},
+		{"a cat <lyco:locon:0.6>  <hypernet:anime:1>", "a cat", []lora{{"locon", 0.6, 0.6}}, []string{"<hypernet:anime:1>"}},
+		{"a <lora:x:bad>,\n<lora:y:-1>, b", "a, b", []lora{{"x", 1, 1}, {"y", -1, -1}}, nil},
+	} {
+		prompt, loras, others := extractNetworks(tc.text)
+		if prompt != tc.prompt || !reflect.DeepEqual(loras, tc.loras) || !reflect.DeepEqual(others, tc.others) {
+			t.Errorf("extractNetworks(%q) = %q, %+v, %v; want %q, %+v, %v",
+				tc.text, prompt, loras, others, tc.prompt, tc.loras, tc.others)
+		}
+	}
+}
+
+func TestWorkflow(t *testing.T) {
+	text := example + ", Clip skip: 2, Hires upscale: 2, Denoising strength: 0.4"
+	p, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt, warnings, err := p.Workflow(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := prompt.Nodes
+
+	if ckpt := nodes["4"].Inputs.CkptName; ckpt != "v1-5-pruned-emaonly.safetensors" {
+		t.Errorf("ckpt_name %q", ckpt)
+	}
+	// LoRA 按提示中的顺序串联，CLIPSetLastLayer 接在最后
+	first, second, clipSkip := nodes["10"], nodes["11"], nodes["12"]
+	if first.ClassType != "LoraLoader" || first.Inputs.Extra["lora_name"] != "add_detail.safetensors" ||
+		first.Inputs.Extra["strength_model"] != 0.8 || !reflect.DeepEqual(first.Inputs.Model, []interface{}{"4", 0}) {
+		t.Errorf("first LoRA %+v", first)
+	}
+	if second.ClassType != "LoraLoader" || second.Inputs.Extra["strength_model"] != 0.7 || second.Inputs.Extra["strength_clip"] != 0.5 ||
+		!reflect.DeepEqual(second.Inputs.Clip, []interface{}{"10", 1}) {
+		t.Errorf("second LoRA %+v", second)
+	}
+	if clipSkip.ClassType != "CLIPSetLastLayer" || clipSkip.Inputs.Extra["stop_at_clip_layer"] != -2 ||
+		!reflect.DeepEqual(clipSkip.Inputs.Clip, []interface{}{"11", 1}) {
+		t.Errorf("clip skip %+v", clipSkip)
+	}
+
+	ksampler := nodes["3"].Inputs
+	if ksampler.Seed != 123456789012 || ksampler.Steps != 20 || ksampler.Cfg != 7 ||
+		ksampler.SamplerName != "dpmpp_2m" || ksampler.Scheduler != "karras" ||
+		!reflect.DeepEqual(ksampler.Model, []interface{}{"11", 0}) {
+		t.Errorf("KSampler %+v", ksampler)
+	}
+	if latent := nodes["5"].Inputs; latent.Width != 512 || latent.Height != 768 || latent.BatchSize != 1 {
+		t.Errorf("latent %+v", latent)
+	}
+	if positive := nodes["6"].Inputs; positive.Text != "masterpiece, a cat, sitting on a chair" ||
+		!reflect.DeepEqual(positive.Clip, []interface{}{"12", 0}) {
+		t.Errorf("positive %+v", positive)
+	}
+	if negative := nodes["7"].Inputs.Text; negative != "blurry, lowres" {
+		t.Errorf("negative %q", negative)
+	}
+	if prefix := nodes["9"].Inputs.FilenamePrefix; prefix != "ComfyUI" {
+		t.Errorf("filename_prefix %q", prefix)
+	}
+	want := []string{`ignored parameter "Denoising strength"`, `ignored parameter "Hires upscale"`}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings %q, want %q", warnings, want)
+	}
+
+	// 指定 checkpoint 时不需要 Model
+	p.Model = ""
+	if _, _, err := p.Workflow(Options{}); err == nil {
+		t.Error("Workflow accepted parameters without a model")
+	}
+	prompt, _, err = p.Workflow(Options{Checkpoint: "sd15.ckpt", FilenamePrefix: "import"})
+	if err != nil || prompt.Nodes["4"].Inputs.CkptName != "sd15.ckpt" || prompt.Nodes["9"].Inputs.FilenamePrefix != "import" {
+		t.Errorf("Workflow with options = %+v, %v", prompt.Nodes["4"], err)
+	}
+}
@@ -0,0 +1,345 @@
+// Package pngmeta 读写 PNG 中的文本块，包括 ComfyUI 保存图片时嵌入的 prompt 与 workflow。
+//
+// ComfyUI（经由 Pillow）将文本写为 tEXt 块，含有非 Latin-1 字符时写为 iTXt 块；
+// 读取时同时支持 tEXt、zTXt 与 iTXt，写入时 ASCII 文本使用 tEXt，其余使用未压缩的 iTXt。
+package pngmeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// 文本块的关键字
+const (
+	KeyPrompt   = "prompt"      // API 格式的工作流
+	KeyWorkflow = "workflow"    // 界面格式的工作流
+	KeyJob      = "comfyui-api" // 本服务写入的任务信息
+
+	KeyParameters = "parameters" // Automatic1111 / Forge 写入的生成参数
+)
+
+// ErrNotPNG 表示数据不是 PNG 图片
+var ErrNotPNG = errors.New("not a PNG image")
+
+var signature = []byte("\x89PNG\r\n\x1a\n")
+
+// 解压文本块时的最大长度，避免压缩炸弹
+const maxTextSize = 64 << 20
+
+// Job 是本服务写入图片的任务信息
+type Job struct {
+	JobID      string    `json:"job_id"`
+	Template   string    `json:"template,omitempty"`
+	PromptHash string    `json:"prompt_hash,omitempty"`
+	Seeds      []int64   `json:"seeds,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+// Metadata 是 PNG 中与工作流相关的元数据
+type Metadata struct {
+	Prompt   *comfyui.Prompt   // API 格式的工作流，可直接重新提交
+	Workflow json.RawMessage   // 界面格式的工作流，可拖入 ComfyUI 打开
+	Job      *Job              // 本服务写入的任务信息
+	Text     map[string]string // 其他文本块
+}
+
+// chunk 是 PNG 中的一个块
+type chunk struct {
+	typ  string
+	data []byte
+}
+
+// parse 拆分 PNG 的各个块，不校验 CRC
+func parse(data []byte) ([]chunk, error) {
+	if !bytes.HasPrefix(data, signature) {
+		return nil, ErrNotPNG
+	}
+	var chunks []chunk
+	rest := data[len(signature):]
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, errors.New("png: truncated chunk")
+		}
+		length := binary.BigEndian.Uint32(rest)
+		if uint64(length) > uint64(len(rest)-12) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		c := chunk{typ: string(rest[4:8]), data: rest[8 : 8+length]}
+		chunks = append(chunks, c)
+		rest = rest[12+length:]
+		if c.typ == "IEND" {
+			break
+		}
+	}
+	if len(chunks) == 0 || chunks[0].typ != "IHDR" {
+		return nil, ErrNotPNG
+	}
+	return chunks, nil
+}
+
+// encode 将各个块重新组成 PNG
+func encode(chunks []chunk) []byte {
+	var buf bytes.Buffer
+	buf.Write(signature)
+	for _, c := range chunks {
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(c.data)))
+		copy(header[4:], c.typ)
+		buf.Write(header[:])
+		buf.Write(c.data)
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(c.data)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+	return buf.Bytes()
+}
+
+// isText 判断是否为文本块
+func isText(typ string) bool {
+	return typ == "tEXt" || typ == "zTXt" || typ == "iTXt"
+}
+
+// decodeText 返回文本块的关键字与 UTF-8 文本
+func decodeText(c chunk) (string, string, error) {
+	keyword, rest, ok := bytes.Cut(c.data, []byte{0})
+	if !ok {
+		return "", "", fmt.Errorf("png: malformed %s chunk", c.typ)
+	}
+	switch c.typ {
+	case "tEXt":
+		return latin1(keyword), latin1(rest), nil
+	case "zTXt":
+		if len(rest) < 1 || rest[0] != 0 {
+			return "", "", errors.New("png: unsupported zTXt compression")
+		}
+		text, err := inflate(rest[1:])
+		return latin1(keyword), latin1(text), err
+	default:
+		// 压缩标志、压缩方法、语言标签、翻译后的关键字、文本
+		if len(rest) < 2 {
+			return "", "", errors.New("png: malformed iTXt chunk")
+		}
+		compressed := rest[0] == 1
+		parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+		if len(parts) != 3 {
+			return "", "", errors.New("png: malformed iTXt chunk")
+		}
+		text := parts[2]
+		if compressed {
+			var err error
+			if text, err = inflate(text); err != nil {
+				return "", "", err
+			}
+		}
+		return latin1(keyword), string(text), nil
+	}
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	text, err := io.ReadAll(io.LimitReader(r, maxTextSize+1))
+	if err == nil && len(text) > maxTextSize {
+		err = errors.New("png: text chunk too large")
+	}
+	return text, err
+}
+
+// latin1 将 ISO-8859-1 编码的字节转为字符串
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// textChunk 生成文本块：ASCII 文本使用 tEXt，其余使用 UTF-8 的 iTXt
+func textChunk(keyword, text string) (chunk, error) {
+	if keyword == "" || len(keyword) > 79 || !isASCII(keyword) || bytes.IndexByte([]byte(keyword), 0) >= 0 {
+		return chunk{}, fmt.Errorf("png: invalid text keyword %q", keyword)
+	}
+	if isASCII(text) {
+		return chunk{typ: "tEXt", data: []byte(keyword + "\x00" + text)}, nil
+	}
+	if !utf8.ValidString(text) {
+		return chunk{}, fmt.Errorf("png: text for %q is not valid UTF-8", keyword)
+	}
+	// 未压缩，语言标签与翻译后的关键字为空
+	return chunk{typ: "iTXt", data: []byte(keyword + "\x00\x00\x00\x00\x00" + text)}, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Text 返回 PNG 中的全部文本块，同一关键字出现多次时取第一个
+func Text(data []byte) (map[string]string, error) {
+	chunks, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	text := make(map[string]string)
+	for _, c := range chunks {
+		if !isText(c.typ) {
+			continue
+		}
+		keyword, value, err := decodeText(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := text[keyword]; !ok {
+			text[keyword] = value
+		}
+	}
+	return text, nil
+}
+
+// SetText 写入文本块并返回新的 PNG，替换已有的同名文本块，值为空字符串时删除该文本块。
+// 新的文本块紧跟在 IHDR 之后，其余块保持原样。
+func SetText(data []byte, text map[string]string) ([]byte, error) {
+	chunks, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	var added []chunk
+	for _, keyword := range sortedKeys(text) {
+		if text[keyword] == "" {
+			continue
+		}
+		c, err := textChunk(keyword, text[keyword])
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, c)
+	}
+	out := []chunk{chunks[0]}
+	out = append(out, added...)
+	for _, c := range chunks[1:] {
+		if isText(c.typ) {
+			if keyword, _, err := decodeText(c); err == nil {
+				if _, ok := text[keyword]; ok {
+					continue
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return encode(out), nil
+}
+
+// Strip 删除指定关键字的文本块，未指定关键字时删除全部文本块
+func Strip(data []byte, keywords ...string) ([]byte, error) {
+	chunks, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	remove := make(map[string]bool)
+	for _, keyword := range keywords {
+		remove[keyword] = true
+	}
+	out := chunks[:0:0]
+	for _, c := range chunks {
+		if isText(c.typ) {
+			keyword, _, err := decodeText(c)
+			if err != nil || len(remove) == 0 || remove[keyword] {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return encode(out), nil
+}
+
+// Extract 读取 PNG 中的 prompt、workflow 与任务信息，没有这些文本块时对应字段为空
+func Extract(data []byte) (*Metadata, error) {
+	text, err := Text(data)
+	if err != nil {
+		return nil, err
+	}
+	meta := &Metadata{Text: make(map[string]string)}
+	for keyword, value := range text {
+		switch keyword {
+		case KeyPrompt:
+			var prompt comfyui.Prompt
+			if err := json.Unmarshal([]byte(value), &prompt); err != nil {
+				return nil, fmt.Errorf("invalid embedded prompt: %w", err)
+			}
+			meta.Prompt = &prompt
+		case KeyWorkflow:
+			if !json.Valid([]byte(value)) {
+				return nil, errors.New("invalid embedded workflow: not JSON")
+			}
+			meta.Workflow = json.RawMessage(value)
+		case KeyJob:
+			var job Job
+			if err := json.Unmarshal([]byte(value), &job); err != nil {
+				return nil, fmt.Errorf("invalid embedded job: %w", err)
+			}
+			meta.Job = &job
+		default:
+			meta.Text[keyword] = value
+		}
+	}
+	return meta, nil
+}
+
+// Inject 将元数据中不为空的 prompt、workflow、任务信息与其他文本写入 PNG，替换已有的同名文本块
+func Inject(data []byte, meta *Metadata) ([]byte, error) {
+	text := make(map[string]string)
+	for keyword, value := range meta.Text {
+		text[keyword] = value
+	}
+	if meta.Prompt != nil {
+		value, err := json.Marshal(meta.Prompt)
+		if err != nil {
+			return nil, err
+		}
+		text[KeyPrompt] = string(value)
+	}
+	if len(meta.Workflow) > 0 {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, meta.Workflow); err != nil {
+			return nil, fmt.Errorf("invalid workflow: %w", err)
+		}
+		text[KeyWorkflow] = compact.String()
+	}
+	if meta.Job != nil {
+		value, err := json.Marshal(meta.Job)
+		if err != nil {
+			return nil, err
+		}
+		text[KeyJob] = string(value)
+	}
+	return SetText(data, text)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,297 @@
+package pngmeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"maps"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// testPNG 返回一张 3x2 的 PNG
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	img.SetNRGBA(1, 1, color.NRGBA{R: 200, G: 10, B: 30, A: 128})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func deflate(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withChunks 在 IHDR 之后插入块
+func withChunks(t *testing.T, data []byte, added ...chunk) []byte {
+	t.Helper()
+	chunks, err := parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append([]chunk{chunks[0]}, added...)
+	return encode(append(out, chunks[1:]...))
+}
+
+// checkPNG 校验每个块的 CRC、块的顺序，并确认图像内容不变
+func checkPNG(t *testing.T, data, original []byte) {
+	t.Helper()
+	rest := data[len(signature):]
+	var types []string
+	for len(rest) > 0 {
+		length := binary.BigEndian.Uint32(rest)
+		body := rest[4 : 8+length]
+		if crc := binary.BigEndian.Uint32(rest[8+length:]); crc != crc32.ChecksumIEEE(body) {
+			t.Fatalf("%s chunk: bad CRC", body[:4])
+		}
+		types = append(types, string(body[:4]))
+		rest = rest[12+length:]
+	}
+	if types[0] != "IHDR" || types[len(types)-1] != "IEND" {
+		t.Fatalf("chunk order %v", types)
+	}
+	got, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := png.Decode(bytes.NewReader(original))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("image content changed")
+	}
+}
+
+func TestText(t *testing.T) {
+	base := testPNG(t)
+	for _, tc := range []struct {
+		name  string
+		chunk chunk
+		key   string
+		want  string
+	}{
+		{"tEXt", chunk{"tEXt", []byte("parameters\x00Steps: 20")}, "parameters", "Steps: 20"},
+		{"tEXt latin1", chunk{"tEXt", []byte("Comment\x00caf\xe9")}, "Comment", "café"},
+		{"zTXt", chunk{"zTXt", append([]byte("prompt\x00\x00"), deflate(t, `{"1":{}}`)...)}, "prompt", `{"1":{}}`},
+		{"iTXt", chunk{"iTXt", []byte("workflow\x00\x00\x00\x00\x00猫 cat")}, "workflow", "猫 cat"},
+		{"iTXt with language", chunk{"iTXt", []byte("Title\x00\x00\x00zh\x00标题\x00你好")}, "Title", "你好"},
+		{"iTXt compressed", chunk{"iTXt", append([]byte("Title\x00\x01\x00\x00\x00"), deflate(t, "ünïcode")...)}, "Title", "ünïcode"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			text, err := Text(withChunks(t, base, tc.chunk))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text[tc.key] != tc.want {
+				t.Fatalf("Text[%q] = %q, want %q", tc.key, text[tc.key], tc.want)
+			}
+		})
+	}
+
+	// 同一关键字出现多次时取第一个
+	text, err := Text(withChunks(t, base, chunk{"tEXt", []byte("a\x00first")}, chunk{"tEXt", []byte("a\x00second")}))
+	if err != nil || text["a"] != "first" {
+		t.Fatalf("Text = %v, %v", text, err)
+	}
+}
+
+func TestTextErrors(t *testing.T) {
+	base := testPNG(t)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"not png", []byte("GIF89a")},
+		{"empty", nil},
+		{"truncated", base[:len(base)-5]},
+		{"no IHDR", encode([]chunk{{"IEND", nil}})},
+		{"tEXt without separator", withChunks(t, base, chunk{"tEXt", []byte("keyword")})},
+		{"zTXt unknown method", withChunks(t, base, chunk{"zTXt", []byte("a\x00\x01xx")})},
+		{"zTXt bad data", withChunks(t, base, chunk{"zTXt", []byte("a\x00\x00xx")})},
+		{"iTXt truncated", withChunks(t, base, chunk{"iTXt", []byte("a\x00\x00")})},
+	} {
+		if _, err := Text(tc.data); err == nil {
+			t.Errorf("%s: Text accepted malformed data", tc.name)
+		}
+	}
+	if _, err := Text([]byte("GIF89a")); !errors.Is(err, ErrNotPNG) {
+		t.Errorf("Text(GIF) = %v, want %v", err, ErrNotPNG)
+	}
+}
+
+func TestSetText(t *testing.T) {
+	base := testPNG(t)
+	original := withChunks(t, base, chunk{"tEXt", []byte("keep\x00old")}, chunk{"tEXt", []byte("replace\x00old")})
+
+	for _, tc := range []struct {
+		name string
+		set  map[string]string
+		want map[string]string
+	}{
+		{"add", map[string]string{"new": "value"}, map[string]string{"keep": "old", "replace": "old", "new": "value"}},
+		{"replace", map[string]string{"replace": "new"}, map[string]string{"keep": "old", "replace": "new"}},
+		{"delete", map[string]string{"replace": ""}, map[string]string{"keep": "old"}},
+		{"utf-8", map[string]string{"prompt": "一只猫"}, map[string]string{"keep": "old", "replace": "old", "prompt": "一只猫"}},
+		{"latin1 range", map[string]string{"prompt": "café"}, map[string]string{"keep": "old", "replace": "old", "prompt": "café"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := SetText(original, tc.set)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPNG(t, out, base)
+			text, err := Text(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(text, tc.want) {
+				t.Fatalf("Text = %v, want %v", text, tc.want)
+			}
+		})
+	}
+
+	// 非 ASCII 文本写为 iTXt，ASCII 文本写为 tEXt
+	out, err := SetText(base, map[string]string{"a": "ascii", "b": "一只猫"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := parse(out)
+	if chunks[1].typ != "tEXt" || chunks[2].typ != "iTXt" {
+		t.Fatalf("chunk types %s, %s; want tEXt, iTXt", chunks[1].typ, chunks[2].typ)
+	}
+
+	for _, keyword := range []string{"", "café", "a\x00b", string(bytes.Repeat([]byte("k"), 80))} {
+		if _, err := SetText(base, map[string]string{keyword: "x"}); err == nil {
+			t.Errorf("SetText accepted keyword %q", keyword)
+		}
+	}
+	if _, err := SetText(base, map[string]string{"a": "\xff\xfe"}); err == nil {
+		t.Error("SetText accepted invalid UTF-8")
+	}
+}
+
+func TestStrip(t *testing.T) {
+	base := testPNG(t)
+	data := withChunks(t, base,
+		chunk{"tEXt", []byte("prompt\x00{}")},
+		chunk{"iTXt", []byte("workflow\x00\x00\x00\x00\x00{}")},
+		chunk{"zTXt", append([]byte("parameters\x00\x00"), deflate(t, "Steps: 20")...)},
+	)
+	for _, tc := range []struct {
+		keywords []string
+		want     map[string]string
+	}{
+		{nil, map[string]string{}},
+		{[]string{"prompt"}, map[string]string{"workflow": "{}", "parameters": "Steps: 20"}},
+		{[]string{"workflow", "parameters"}, map[string]string{"prompt": "{}"}},
+		{[]string{"missing"}, map[string]string{"prompt": "{}", "workflow": "{}", "parameters": "Steps: 20"}},
+	} {
+		out, err := Strip(data, tc.keywords...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPNG(t, out, base)
+		text, err := Text(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(text, tc.want) {
+			t.Errorf("Strip(%v): Text = %v, want %v", tc.keywords, text, tc.want)
+		}
+	}
+
+	// 去掉全部文本块后与原图的块完全相同
+	out, err := Strip(data)
+	if err != nil || !bytes.Equal(out, base) {
+		t.Fatalf("Strip changed the non-text chunks: %v", err)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	base := testPNG(t)
+	var prompt comfyui.Prompt
+	if err := json.Unmarshal([]byte(`{"3": {"class_type": "KSampler", "inputs": {"seed": 123456789012345678, "model": ["4", 0]}}}`), &prompt); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	meta := &Metadata{
+		Prompt:   &prompt,
+		Workflow: json.RawMessage("{\n  \"nodes\": [],\n  \"title\": \"猫\"\n}"),
+		Job:      &Job{JobID: "job-1", Template: "sdxl", Seeds: []int64{123456789012345678}, CreatedAt: created},
+		Text:     map[string]string{"parameters": "Steps: 20"},
+	}
+	out, err := Inject(base, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPNG(t, out, base)
+
+	got, err := Extract(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Prompt == nil || got.Prompt.Nodes["3"].Inputs.Seed != 123456789012345678 {
+		t.Fatalf("prompt = %+v", got.Prompt)
+	}
+	if string(got.Workflow) != `{"nodes":[],"title":"猫"}` {
+		t.Fatalf("workflow = %s", got.Workflow)
+	}
+	if got.Job == nil || !reflect.DeepEqual(*got.Job, *meta.Job) {
+		t.Fatalf("job = %+v", got.Job)
+	}
+	if !maps.Equal(got.Text, meta.Text) {
+		t.Fatalf("text = %v", got.Text)
+	}
+
+	// 再次写入替换而不是重复同名文本块
+	meta.Text = nil
+	meta.Job.JobID = "job-2"
+	out, err = Inject(out, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := parse(out)
+	count := 0
+	for _, c := range chunks {
+		if isText(c.typ) {
+			count++
+		}
+	}
+	if count != 4 {
+		t.Fatalf("%d text chunks after injecting twice, want 4", count)
+	}
+	if got, err := Extract(out); err != nil || got.Job.JobID != "job-2" {
+		t.Fatalf("Extract after reinject = %+v, %v", got, err)
+	}
+
+	if _, err := Inject(base, &Metadata{Workflow: json.RawMessage("{")}); err == nil {
+		t.Fatal("Inject accepted an invalid workflow")
+	}
+	for _, key := range []string{KeyPrompt, KeyWorkflow, KeyJob} {
+		bad, _ := SetText(base, map[string]string{key: "not json"})
+		if _, err := Extract(bad); err == nil {
+			t.Errorf("Extract accepted invalid %s", key)
+		}
+	}
+	// 没有元数据时各字段为空
+	if got, err := Extract(base); err != nil || got.Prompt != nil || got.Workflow != nil || got.Job != nil || len(got.Text) != 0 {
+		t.Fatalf("Extract(plain) = %+v, %v", got, err)
+	}
+}
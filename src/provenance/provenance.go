@@ -0,0 +1,237 @@
+// Package provenance 用 Ed25519 签名输出的来源清单（内容哈希、提示哈希、模板、后端与时间），并校验签名。
+//
+// PNG 输出的签名写入 comfyui-api-provenance 文本块，清单中的哈希为去掉全部文本块后的内容哈希，
+// 增删 prompt、workflow 等元数据不影响校验；其他格式无法嵌入，签名单独保存，校验时需要同时提供。
+package provenance
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+)
+
+// KeyProvenance 是 PNG 中保存签名的文本块关键字
+const KeyProvenance = "comfyui-api-provenance"
+
+// Algorithm 是签名算法
+const Algorithm = "ed25519"
+
+// 校验签名的错误
+var (
+	ErrNoSignature      = errors.New("image has no provenance signature")      // PNG 中没有签名
+	ErrInvalidSignature = errors.New("invalid provenance signature")           // 签名无效或不是由该公钥签名
+	ErrHashMismatch     = errors.New("content does not match the signed hash") // 签名有效，但内容已被修改
+)
+
+// Manifest 是被签名的来源清单
+type Manifest struct {
+	SHA256          string    `json:"sha256"` // 内容哈希，PNG 为去掉全部文本块后的哈希
+	ContentType     string    `json:"content_type"`
+	PromptHash      string    `json:"prompt_hash"`
+	Template        string    `json:"template,omitempty"`
+	TemplateVersion string    `json:"template_version,omitempty"`
+	Backend         string    `json:"backend"`
+	JobID           string    `json:"job_id"`
+	ParentJobID     string    `json:"parent_job_id,omitempty"` // 批量与分块任务的子任务所属的任务
+	Output          int       `json:"output"`                  // 输出序号
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// Signature 是清单与其签名。清单保存为签名时的原始 JSON，校验时不需要重新序列化。
+type Signature struct {
+	Algorithm string          `json:"alg"`
+	KeyID     string          `json:"key_id"`
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"` // base64
+}
+
+// KeyID 返回公钥的标识：公钥 SHA-256 的前 8 字节的十六进制
+func KeyID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Signer 用私钥签名清单
+type Signer struct {
+	key ed25519.PrivateKey
+	id  string
+}
+
+// NewSigner 创建签名器
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key, id: KeyID(key.Public().(ed25519.PublicKey))}
+}
+
+// LoadSigner 从 PEM 文件（PKCS#8，如 openssl genpkey -algorithm ed25519 生成的私钥）创建签名器
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+	return NewSigner(private), nil
+}
+
+// Public 返回公钥
+func (s *Signer) Public() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// KeyID 返回公钥的标识
+func (s *Signer) KeyID() string {
+	return s.id
+}
+
+// Sign 签名清单
+func (s *Signer) Sign(manifest Manifest) (*Signature, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		Algorithm: Algorithm,
+		KeyID:     s.id,
+		Manifest:  data,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data)),
+	}, nil
+}
+
+// contentHash 返回签名的内容哈希：PNG 去掉全部文本块后计算，其他格式为原始内容的哈希
+func contentHash(data []byte) (string, bool, error) {
+	png := true
+	base, err := pngmeta.Strip(data)
+	if errors.Is(err, pngmeta.ErrNotPNG) {
+		png, base = false, data
+	} else if err != nil {
+		return "", false, err
+	}
+	sum := sha256.Sum256(base)
+	return hex.EncodeToString(sum[:]), png, nil
+}
+
+// SignContent 计算内容哈希并签名。PNG 的签名同时写入图片，返回写入后的内容；其他格式原样返回。
+func (s *Signer) SignContent(data []byte, manifest Manifest) ([]byte, *Signature, error) {
+	sum, png, err := contentHash(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest.SHA256 = sum
+	signature, err := s.Sign(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !png {
+		return data, signature, nil
+	}
+	text, err := json.Marshal(signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := pngmeta.SetText(data, map[string]string{KeyProvenance: string(text)})
+	if err != nil {
+		return nil, nil, err
+	}
+	return signed, signature, nil
+}
+
+// Extract 读取 PNG 中的签名
+func Extract(data []byte) (*Signature, error) {
+	text, err := pngmeta.Text(data)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := text[KeyProvenance]
+	if !ok {
+		return nil, ErrNoSignature
+	}
+	var signature Signature
+	if err := json.Unmarshal([]byte(value), &signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return &signature, nil
+}
+
+// Verify 用公钥校验内容的签名并返回清单。signature 为空时从 PNG 中读取；
+// 去掉了签名文本块的 PNG（如删除元数据后下载的）需要提供签名。
+func Verify(data []byte, signature *Signature, public ed25519.PublicKey) (*Manifest, error) {
+	if signature == nil {
+		var err error
+		if signature, err = Extract(data); err != nil {
+			return nil, err
+		}
+	}
+	if signature.Algorithm != Algorithm {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, signature.Algorithm)
+	}
+	if signature.KeyID != KeyID(public) {
+		return nil, fmt.Errorf("%w: signed by key %s, expected %s", ErrInvalidSignature, signature.KeyID, KeyID(public))
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil || !ed25519.Verify(public, signature.Manifest, sig) {
+		return nil, ErrInvalidSignature
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(signature.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	sum, _, err := contentHash(data)
+	if err != nil {
+		return nil, err
+	}
+	if sum != manifest.SHA256 {
+		return &manifest, ErrHashMismatch
+	}
+	return &manifest, nil
+}
+
+// ParsePublicKey 解析公钥：PEM（PKIX）或 base64 编码的 32 字节公钥
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 public key")
+		}
+		return public, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("public key must be PEM or base64 of 32 bytes")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// MarshalPublicKey 返回公钥的 PEM 编码
+func MarshalPublicKey(public ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,68 @@
+package serve
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// backendPool 是服务使用的后端池，由 StartServer 初始化
+var backendPool *Pool
+
+// adminAuth 校验管理接口的 Bearer 令牌，token 为空时拒绝全部请求
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled: admin_token is not configured"})
+			return
+		}
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// listBackends 返回全部后端的健康状况
+func listBackends(c *gin.Context) {
+	backends := backendPool.Backends()
+	statuses := make([]BackendStatus, 0, len(backends))
+	for _, backend := range backends {
+		statuses = append(statuses, backend.Status())
+	}
+	c.JSON(http.StatusOK, gin.H{"backends": statuses})
+}
+
+// getBackend 返回单个后端的健康状况
+func getBackend(c *gin.Context) {
+	backend, ok := backendPool.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "backend not found"})
+		return
+	}
+	c.JSON(http.StatusOK, backend.Status())
+}
+
+// drainBackend 将后端置为排空模式，不再调度新任务，已提交的任务继续执行
+func drainBackend(c *gin.Context) {
+	setDraining(c, true)
+}
+
+// undrainBackend 取消后端的排空模式
+func undrainBackend(c *gin.Context) {
+	setDraining(c, false)
+}
+
+func setDraining(c *gin.Context, draining bool) {
+	backend, ok := backendPool.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "backend not found"})
+		return
+	}
+	backend.SetDraining(draining)
+	c.JSON(http.StatusOK, backend.Status())
+}
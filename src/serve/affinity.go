@@ -0,0 +1,119 @@
+package serve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+const (
+	// loaderWeight 是加载模型类节点在亲和评分中的权重，加载模型远比其他节点耗时
+	loaderWeight = 10
+	// affinityMinScore 是亲和调度生效的最低评分，只共享个别廉价节点时不值得打破负载均衡
+	affinityMinScore = loaderWeight
+)
+
+// promptSignatures 计算提示中每个节点的签名及其在亲和评分中的权重。
+// 签名由节点类型、自身输入与上游节点的签名共同决定，与 ComfyUI 判断节点能否复用缓存的方式一致：
+// 同一后端上签名相同的节点（如加载 checkpoint、编码提示词）不会重新执行。
+func promptSignatures(prompt comfyui.Prompt) map[string]int {
+	memo := make(map[string]string, len(prompt.Nodes))
+	visiting := make(map[string]bool)
+
+	var sign func(id string) string
+	sign = func(id string) string {
+		if sig, ok := memo[id]; ok {
+			return sig
+		}
+		node, ok := prompt.Nodes[id]
+		if !ok || visiting[id] {
+			return "missing:" + id
+		}
+		visiting[id] = true
+		defer delete(visiting, id)
+
+		inputs := node.Inputs.Values()
+		for name, value := range inputs {
+			if from, index, ok := parseLink(value); ok {
+				inputs[name] = fmt.Sprintf("link:%s:%d", sign(from), index)
+			}
+		}
+		// json.Marshal 按键排序，输出是稳定的
+		data, _ := json.Marshal(struct {
+			ClassType string                 `json:"class_type"`
+			Inputs    map[string]interface{} `json:"inputs"`
+		}{node.ClassType, inputs})
+		sum := sha256.Sum256(data)
+		memo[id] = hex.EncodeToString(sum[:])
+		return memo[id]
+	}
+
+	signatures := make(map[string]int, len(prompt.Nodes))
+	for id, node := range prompt.Nodes {
+		weight := 1
+		if strings.Contains(node.ClassType, "Loader") {
+			weight = loaderWeight
+		}
+		signatures[sign(id)] = weight
+	}
+	return signatures
+}
+
+// parseLink 解析形如 [节点 ID, 输出序号] 的连线输入
+func parseLink(value interface{}) (string, int, bool) {
+	link, ok := value.([]interface{})
+	if !ok || len(link) != 2 {
+		return "", 0, false
+	}
+	from, ok := link[0].(string)
+	if !ok {
+		return "", 0, false
+	}
+	index, ok := comfyui.Int64(link[1])
+	if !ok {
+		return "", 0, false
+	}
+	return from, int(index), true
+}
+
+// affinity 返回提示与后端最近执行的提示中相同节点的权重之和
+func (b *Backend) affinity(signatures map[string]int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	score := 0
+	for sig, weight := range signatures {
+		if _, ok := b.recent[sig]; ok {
+			score += weight
+		}
+	}
+	return score
+}
+
+// remember 记录分配给后端的提示的节点签名。ComfyUI 默认只缓存最近一次执行的结果，因此只保留最后一个提示。
+func (b *Backend) remember(signatures map[string]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recent = signatures
+}
+
+// pickAffinity 选择与提示共享节点最多的后端；若该后端比最空闲的后端多出 MaxSkew 个以上的任务，返回 nil 交由调度策略选择
+func (p *Pool) pickAffinity(candidates []*Backend, signatures map[string]int) *Backend {
+	var best *Backend
+	bestScore, minLoad := affinityMinScore-1, -1
+	for _, backend := range candidates {
+		if score := backend.affinity(signatures); score > bestScore {
+			best, bestScore = backend, score
+		}
+		if load := backend.Inflight(); minLoad < 0 || load < minLoad {
+			minLoad = load
+		}
+	}
+	if best == nil || best.Inflight()-minLoad > p.affinity.MaxSkew {
+		return nil
+	}
+	return best
+}
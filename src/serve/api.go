@@ -1,12 +1,9 @@
 package serve
 
 import (
-	"encoding/json"
 	"net/http"
 
-	"github.com/fimreal/comfyui-api/src/comfyui"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 )
 
 // showIndexPage 渲染首页
@@ -14,11 +11,11 @@ func showIndexPage(c *gin.Context) {
 	c.HTML(http.StatusOK, "index.html", nil)
 }
 
-// processWorkflow 处理工作流请求
+// processWorkflow 处理工作流请求，同步等待任务结束后返回各输出的下载地址
 func processWorkflow(c *gin.Context) {
 	var workflow struct {
 		Workflow string `json:"workflow"`
-		Server   string `json:"server"` // 新增字段，用于接收服务器地址
+		Cache    string `json:"cache"`
 	}
 
 	if err := c.ShouldBindJSON(&workflow); err != nil {
@@ -26,34 +23,46 @@ func processWorkflow(c *gin.Context) {
 		return
 	}
 
-	// 设置 ComfyUI 服务器地址
-	comfyui.ServerAddress = workflow.Server // 从请求中获取服务器地址
-
 	// 解析工作流 JSON
-	var prompt comfyui.Prompt
-	if err := json.Unmarshal([]byte(workflow.Workflow), &prompt); err != nil {
+	prompt, err := parseWorkflow([]byte(workflow.Workflow))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workflow JSON"})
 		return
 	}
 
-	// 创建 WebSocket 连接
-	wsURL := "ws://" + comfyui.ServerAddress + "/ws?clientId=" + comfyui.ClientID
-	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	// 由后端池调度执行，并等待任务结束
+	// 同步请求有用户在等待，优先于批量任务调度
+	if err := validCacheMode(workflow.Cache); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	job, err := jobs.Submit(JobSpec{Prompt: prompt, Priority: PriorityInteractive, Tenant: currentTenant(c), Cache: workflow.Cache})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to WebSocket: " + err.Error()})
+		jobError(c, err)
+		return
+	}
+	select {
+	case <-job.Done():
+	case <-c.Request.Context().Done():
+		_ = jobs.Cancel(job.ID())
 		return
 	}
-	defer ws.Close()
 
-	// 使用 WebSocket 和轮询获取图像
-	outputImages, err := comfyui.GetImages(ws, prompt)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	status := job.Status()
+	if status.State != JobSucceeded {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": status.Error, "job_id": job.ID()})
 		return
 	}
 
+	// 输出已存入输出存储，返回下载地址而不是文件内容
+	outputURLs := make(map[string][]string)
+	for _, output := range status.Outputs {
+		outputURLs[output.NodeID] = append(outputURLs[output.NodeID], output.URL)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Workflow processed successfully!",
-		"output":  outputImages,
+		"job_id":  job.ID(),
+		"output":  outputURLs,
 	})
 }
@@ -0,0 +1,327 @@
+package serve
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/gin-gonic/gin"
+)
+
+// 一次打包的最大任务数
+const maxArchiveJobs = 500
+
+// ArchiveManifest 是打包文件中描述一个任务的 manifest.json
+type ArchiveManifest struct {
+	JobID      string                            `json:"job_id"`
+	State      JobState                          `json:"state"`
+	Priority   string                            `json:"priority"`
+	Template   string                            `json:"template,omitempty"`
+	Version    string                            `json:"template_version,omitempty"`
+	Error      string                            `json:"error,omitempty"`
+	CachedFrom string                            `json:"cached_from,omitempty"`
+	Prompt     comfyui.Prompt                    `json:"prompt"`
+	Parameters map[string]map[string]interface{} `json:"parameters"` // 节点 ID -> 不是连线的输入
+	Seeds      []ArchiveSeed                     `json:"seeds"`
+	Batch      *BatchOptions                     `json:"batch,omitempty"`
+	Items      []BatchItem                       `json:"items,omitempty"`
+	Timings    JobTimings                        `json:"timings"`
+	Outputs    []ArchiveOutput                   `json:"outputs"`
+}
+
+// ArchiveSeed 是任务（批量任务中为各子任务）实际使用的种子
+type ArchiveSeed struct {
+	JobID  string `json:"job_id"`
+	NodeID string `json:"node_id"`
+	Seed   int64  `json:"seed"`
+}
+
+// ArchiveOutput 是打包文件中的一个输出
+type ArchiveOutput struct {
+	Index       int    `json:"index"`
+	NodeID      string `json:"node_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+	Path        string `json:"path"` // 在打包文件中相对 manifest.json 的路径
+}
+
+// archiveWriter 逐个写入打包文件中的文件
+type archiveWriter interface {
+	// Create 开始写入一个文件，tar 需要预先知道文件大小
+	Create(name string, size int64, modified time.Time, compress bool) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a *zipArchive) Create(name string, _ int64, modified time.Time, compress bool) (io.Writer, error) {
+	method := zip.Store
+	if compress {
+		method = zip.Deflate
+	}
+	return a.w.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+}
+
+func (a *zipArchive) Close() error {
+	return a.w.Close()
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (a *tarArchive) Create(name string, size int64, modified time.Time, _ bool) (io.Writer, error) {
+	header := &tar.Header{Name: name, Size: size, Mode: 0o644, ModTime: modified, Typeflag: tar.TypeReg}
+	if err := a.w.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return a.w, nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// newArchiveWriter 按格式创建打包写入器，返回写入器与文件扩展名
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, string, error) {
+	switch format {
+	case "", "zip":
+		return &zipArchive{w: zip.NewWriter(w)}, "zip", nil
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarArchive{gz: gz, w: tar.NewWriter(gz)}, "tar.gz", nil
+	default:
+		return nil, "", fmt.Errorf("invalid archive format %q, expected zip or tar.gz", format)
+	}
+}
+
+// archiveContentTypes 是打包文件的 Content-Type
+var archiveContentTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+// manifest 返回任务的打包描述，输出按节点 ID 分目录
+func (m *JobManager) manifest(job *Job) ArchiveManifest {
+	status := job.Status()
+	manifest := ArchiveManifest{
+		JobID:      status.ID,
+		State:      status.State,
+		Priority:   status.Priority,
+		Template:   status.Template,
+		Version:    status.Version,
+		Error:      status.Error,
+		CachedFrom: status.CachedFrom,
+		Prompt:     job.spec.Prompt,
+		Parameters: make(map[string]map[string]interface{}),
+		Seeds:      []ArchiveSeed{},
+		Batch:      job.spec.Batch,
+		Items:      status.Items,
+		Timings:    status.Timings(),
+		Outputs:    []ArchiveOutput{},
+	}
+	for id, node := range job.spec.Prompt.Nodes {
+		values := node.Inputs.Values()
+		for name, value := range values {
+			// 连线输入为 [节点 ID, 输出序号]
+			if _, ok := value.([]interface{}); ok {
+				delete(values, name)
+			}
+		}
+		if len(values) > 0 {
+			manifest.Parameters[id] = values
+		}
+	}
+	// 批量任务的种子由各子任务替换
+	members := m.family(job)
+	if len(members) > 1 {
+		members = members[1:]
+	}
+	for _, member := range members {
+		manifest.Seeds = append(manifest.Seeds, promptSeeds(member.id, member.spec.Prompt)...)
+	}
+
+	used := make(map[string]bool)
+	for _, output := range status.Outputs {
+		name := path.Join(safeArchiveName(output.NodeID), safeArchiveName(output.Filename))
+		if used[name] {
+			// 批量任务中不同后端的输出可能同名
+			name = path.Join(safeArchiveName(output.NodeID), fmt.Sprintf("%d_%s", output.Index, safeArchiveName(output.Filename)))
+		}
+		used[name] = true
+		manifest.Outputs = append(manifest.Outputs, ArchiveOutput{
+			Index:       output.Index,
+			NodeID:      output.NodeID,
+			Filename:    output.Filename,
+			ContentType: output.ContentType,
+			Size:        output.Size,
+			SHA256:      output.SHA256,
+			Path:        name,
+		})
+	}
+	return manifest
+}
+
+// promptSeeds 返回提示中各节点的 seed 或 noise_seed 输入，按节点 ID 排序
+func promptSeeds(jobID string, prompt comfyui.Prompt) []ArchiveSeed {
+	var seeds []ArchiveSeed
+	for id, node := range prompt.Nodes {
+		seed := node.Inputs.Seed
+		if seed == 0 {
+			value, ok := comfyui.Int64(node.Inputs.Extra["noise_seed"])
+			if !ok {
+				continue
+			}
+			seed = value
+		}
+		seeds = append(seeds, ArchiveSeed{JobID: jobID, NodeID: id, Seed: seed})
+	}
+	sort.Slice(seeds, func(i, k int) bool { return seeds[i].NodeID < seeds[k].NodeID })
+	return seeds
+}
+
+// safeArchiveName 去掉名称中的路径分隔符，避免解包时写到目录之外
+func safeArchiveName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// writeArchive 依次写入各任务的 manifest.json 与输出，输出逐个从存储读取，不在内存中累积。
+// 只有一个任务时文件位于根目录，否则位于以任务 ID 命名的目录中。
+func (m *JobManager) writeArchive(archive archiveWriter, list []*Job) error {
+	for _, job := range list {
+		dir := ""
+		if len(list) > 1 {
+			dir = job.id
+		}
+		manifest := m.manifest(job)
+		modified := manifest.Timings.CreatedAt
+		if !manifest.Timings.FinishedAt.IsZero() {
+			modified = manifest.Timings.FinishedAt
+		}
+
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		w, err := archive.Create(path.Join(dir, "manifest.json"), int64(len(data)), modified, true)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+
+		for n, output := range manifest.Outputs {
+			_, data, err := job.Output(n)
+			if err != nil {
+				return fmt.Errorf("job %s output %d: %w", job.id, output.Index, err)
+			}
+			compress := !strings.HasPrefix(output.ContentType, "image/")
+			w, err := archive.Create(path.Join(dir, output.Path), int64(len(data)), modified, compress)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// archiveJob 打包下载当前租户任务的全部输出
+func archiveJob(c *gin.Context) {
+	streamArchive(c, []string{c.Param("id")}, c.Query("format"))
+}
+
+// archiveRequest 是打包多个任务的请求体
+type archiveRequest struct {
+	JobIDs []string `json:"job_ids"`
+	Format string   `json:"format"`
+}
+
+// archiveJobs 打包下载多个任务，任务 ID 由查询参数 ids（逗号分隔或重复）或 POST 请求体的 job_ids 指定
+func archiveJobs(c *gin.Context) {
+	req := archiveRequest{Format: c.Query("format")}
+	for _, ids := range c.QueryArray("ids") {
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				req.JobIDs = append(req.JobIDs, id)
+			}
+		}
+	}
+	if c.Request.Method == http.MethodPost {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	streamArchive(c, req.JobIDs, req.Format)
+}
+
+// streamArchive 检查任务后以流的形式返回打包文件。开始写入后出错时中断响应，客户端得到不完整的文件。
+func streamArchive(c *gin.Context, ids []string, format string) {
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no job ids"})
+		return
+	}
+	if len(ids) > maxArchiveJobs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many jobs, at most %d per archive", maxArchiveJobs)})
+		return
+	}
+	tenant := currentTenant(c)
+	seen := make(map[string]bool)
+	var list []*Job
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		job, err := jobs.GetForTenant(id, tenant)
+		if err != nil {
+			jobError(c, fmt.Errorf("%w: %s", err, id))
+			return
+		}
+		list = append(list, job)
+	}
+
+	archive, ext, err := newArchiveWriter(format, c.Writer)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := "job-" + list[0].id
+	if len(list) > 1 {
+		name = fmt.Sprintf("jobs-%d", len(list))
+	}
+	c.Header("Content-Type", archiveContentTypes[ext])
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+ext))
+	c.Status(http.StatusOK)
+	if err := jobs.writeArchive(archive, list); err != nil {
+		log.Printf("archive %s: %v", name, err)
+		// 不写入 zip 的中央目录或 gzip 的结尾，客户端无法把不完整的文件当作正常结果
+		c.Abort()
+	}
+}
@@ -0,0 +1,17 @@
+package serve
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPromptSeeds(t *testing.T) {
+	seeds := promptSeeds("job", batchPrompt(t))
+	want := []ArchiveSeed{
+		{JobID: "job", NodeID: "3", Seed: 123456789012345678},
+		{JobID: "job", NodeID: "6", Seed: 123456789012345678},
+	}
+	if !slices.Equal(seeds, want) {
+		t.Fatalf("seeds %+v, want %+v", seeds, want)
+	}
+}
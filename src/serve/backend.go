@@ -0,0 +1,303 @@
+package serve
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// backendReconnectDelay 是事件连接断开后的重连间隔
+	backendReconnectDelay = 2 * time.Second
+	// backendOrphanLimit 是每个尚未订阅的提示最多缓存的事件数
+	backendOrphanLimit = 256
+	// backendSubscriberBuffer 是订阅通道的缓冲大小
+	backendSubscriberBuffer = 128
+	// catalogTimeout 是获取 /object_info 的超时，安装了大量节点的后端响应较慢
+	catalogTimeout = time.Minute
+)
+
+// eventReconnected 是事件连接重连后发给订阅者的内部事件，
+// 断线期间的事件已经丢失，订阅者需要自行检查提示状态
+const eventReconnected = "reconnected"
+
+// Backend 是池中的一台 ComfyUI 服务器。
+// 所有提交到该服务器的提示共用同一个客户端 ID 与 WebSocket 连接，事件按 prompt_id 分发给订阅者。
+type Backend struct {
+	Name         string
+	Weight       int
+	Source       string            // 后端来源：config、api、file 或 srv
+	Labels       map[string]string // 注册时提供的标签
+	Capabilities []string          // 注册时声明的能力
+
+	url string
+
+	client        *comfyui.Client
+	health        HealthConfig
+	probeClient   *http.Client // 带探测超时，用于健康探测、调度与中断等不能无限等待的请求
+	catalogClient *http.Client
+
+	mu        sync.Mutex
+	subs      map[string]chan *comfyui.Event
+	orphans   map[string][]*comfyui.Event
+	executing string // 当前正在执行的提示，用于归属不带 prompt_id 的预览图像
+	inflight  int
+
+	// 健康状况，见 health.go
+	breaker   BreakerState
+	draining  bool
+	failures  int
+	lastError string
+	openedAt  time.Time
+	lastProbe time.Time
+	stats     *comfyui.SystemStats
+	ws        *websocket.Conn
+	lastPing  time.Time
+	lastPong  time.Time
+	queued    int // 最近一次探测得到的 ComfyUI 队列长度，未知时为 -1
+	catalog   *Catalog
+	suspect   string         // 执行超时后被标记为可疑的原因，见 watchdog.go
+	recent    map[string]int // 最近分配的提示的节点签名，见 affinity.go
+
+	heartbeat time.Time // 注册的 worker 最近一次心跳的时间
+	notify    func()    // 空出位置时通知调度器
+	stop      context.CancelFunc
+	gone      chan struct{}
+}
+
+// newBackend 创建后端
+func newBackend(cfg BackendConfig, source string, health HealthConfig, clientID string) *Backend {
+	client := comfyui.NewClient(cfg.URL)
+	client.ClientID = clientID
+	weight := cfg.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Backend{
+		Name:          cfg.Name,
+		Weight:        weight,
+		Source:        source,
+		Labels:        cfg.Labels,
+		Capabilities:  cfg.Capabilities,
+		url:           cfg.URL,
+		client:        client,
+		health:        health,
+		probeClient:   &http.Client{Timeout: time.Duration(health.Timeout)},
+		catalogClient: &http.Client{Timeout: max(catalogTimeout, time.Duration(health.Timeout))},
+		subs:          make(map[string]chan *comfyui.Event),
+		orphans:       make(map[string][]*comfyui.Event),
+		breaker:       BreakerClosed,
+		queued:        -1,
+		gone:          make(chan struct{}),
+	}
+}
+
+// timedClient 返回使用 httpClient 发送请求的客户端副本
+func (b *Backend) timedClient(httpClient *http.Client) *comfyui.Client {
+	client := *b.client
+	client.HTTPClient = httpClient
+	return &client
+}
+
+// weight 返回后端的权重
+func (b *Backend) weight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Weight
+}
+
+// update 更新后端的权重与标签
+func (b *Backend) update(cfg BackendConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.Weight > 0 {
+		b.Weight = cfg.Weight
+	}
+	b.Labels = cfg.Labels
+	b.Capabilities = cfg.Capabilities
+}
+
+// Gone 返回后端被移出池时关闭的通道
+func (b *Backend) Gone() <-chan struct{} {
+	return b.gone
+}
+
+// start 启动事件连接与健康探测
+func (b *Backend) start(ctx context.Context) {
+	ctx, b.stop = context.WithCancel(ctx)
+	go b.Run(ctx)
+	go b.probeLoop(ctx)
+}
+
+// shutdown 停止后端并通知在其上执行的任务
+func (b *Backend) shutdown() {
+	if b.stop != nil {
+		b.stop()
+	}
+	close(b.gone)
+}
+
+// Client 返回后端的 ComfyUI 客户端
+func (b *Backend) Client() *comfyui.Client {
+	return b.client
+}
+
+// Inflight 返回本服务提交到该后端且尚未结束的任务数
+func (b *Backend) Inflight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inflight
+}
+
+// acquire 与 release 维护进行中的任务数
+func (b *Backend) acquire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight++
+}
+
+func (b *Backend) release() {
+	b.mu.Lock()
+	b.inflight--
+	b.mu.Unlock()
+	if b.notify != nil {
+		b.notify()
+	}
+}
+
+// Subscribe 订阅提示的事件，返回事件通道与取消订阅函数。
+// 订阅前已收到的该提示的事件会先行送出。
+func (b *Backend) Subscribe(promptID string) (<-chan *comfyui.Event, func()) {
+	ch := make(chan *comfyui.Event, backendSubscriberBuffer+backendOrphanLimit)
+
+	b.mu.Lock()
+	for _, event := range b.orphans[promptID] {
+		ch <- event
+	}
+	delete(b.orphans, promptID)
+	b.subs[promptID] = ch
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[promptID] == ch {
+			delete(b.subs, promptID)
+		}
+	}
+}
+
+// Run 维持事件连接并分发事件，断开后自动重连，直到 ctx 结束
+func (b *Backend) Run(ctx context.Context) {
+	connected := false
+	for ctx.Err() == nil {
+		ws, err := b.client.Connect()
+		if err != nil {
+			if connected {
+				log.Printf("backend %s: event connection lost: %v", b.Name, err)
+				connected = false
+			}
+			select {
+			case <-time.After(backendReconnectDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		connected = true
+		b.setConn(ws)
+
+		// 重连后通知订阅者检查断线期间错过的状态
+		b.broadcast(&comfyui.Event{Type: eventReconnected})
+
+		stop := context.AfterFunc(ctx, func() { ws.Close() })
+		for {
+			event, err := comfyui.ReadEvent(ws)
+			if err != nil {
+				break
+			}
+			if event != nil {
+				b.dispatch(event)
+			}
+		}
+		stop()
+		b.setConn(nil)
+		ws.Close()
+	}
+}
+
+// dispatch 将事件发送给对应提示的订阅者
+func (b *Backend) dispatch(event *comfyui.Event) {
+	switch event.Type {
+	case comfyui.EventStatus:
+		b.broadcast(event)
+		return
+	case comfyui.EventPreview:
+		b.mu.Lock()
+		promptID := b.executing
+		b.mu.Unlock()
+		if promptID != "" {
+			b.deliver(promptID, event)
+		}
+		return
+	}
+
+	promptID := event.PromptID()
+	if promptID == "" {
+		return
+	}
+	if event.Type == comfyui.EventExecuting {
+		if data, err := event.Executing(); err == nil {
+			b.mu.Lock()
+			if data.Node == nil {
+				b.executing = ""
+			} else {
+				b.executing = promptID
+			}
+			b.mu.Unlock()
+		}
+	}
+	b.deliver(promptID, event)
+}
+
+// deliver 发送事件给提示的订阅者，无订阅者时暂存
+func (b *Backend) deliver(promptID string, event *comfyui.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, ok := b.subs[promptID]
+	if !ok {
+		if event.Type != comfyui.EventPreview && len(b.orphans[promptID]) < backendOrphanLimit {
+			b.orphans[promptID] = append(b.orphans[promptID], event)
+		}
+		return
+	}
+	select {
+	case ch <- event:
+	default:
+		// 订阅者处理过慢时丢弃事件，预览与进度事件可以容忍丢失
+	}
+}
+
+// broadcast 发送事件给全部订阅者
+func (b *Backend) broadcast(event *comfyui.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// forget 丢弃提示的暂存事件
+func (b *Backend) forget(promptID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.orphans, promptID)
+}
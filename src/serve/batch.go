@@ -0,0 +1,383 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/gin-gonic/gin"
+)
+
+// seedInputs 是采样节点中表示随机种子的输入名称
+var seedInputs = []string{"seed", "noise_seed"}
+
+// BatchOptions 描述如何将一个任务拆分为多个子任务并分散到后端池中执行
+type BatchOptions struct {
+	Seeds   []int64 `json:"seeds,omitempty"`   // 每个种子一个子任务
+	Split   int     `json:"split,omitempty"`   // 将工作流的 batch_size 拆分为每份不超过该值的子任务
+	Retries int     `json:"retries,omitempty"` // 失败的子任务在其他后端上重试的次数
+}
+
+// retries 返回批量或分块任务中失败的子任务可以重试的次数
+func (s JobSpec) retries() int {
+	switch {
+	case s.Batch != nil:
+		return s.Batch.Retries
+	case s.Tile != nil:
+		return s.Tile.Retries
+	}
+	return 0
+}
+
+// BatchItem 是批量任务中的一个子任务
+type BatchItem struct {
+	Index     int       `json:"index"`
+	Seed      *int64    `json:"seed,omitempty"`
+	BatchSize int       `json:"batch_size,omitempty"`
+	JobID     string    `json:"job_id,omitempty"` // 最近一次尝试的子任务 ID
+	State     JobState  `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Outputs   []int     `json:"outputs,omitempty"` // 在父任务输出中的序号
+	Tile      *TileRect `json:"tile,omitempty"`    // 分块放大任务中该子任务处理的区域
+
+	progress float64 // 0~1
+}
+
+// partialError 表示批量任务中部分子任务失败，父任务仍以成功结束
+type partialError struct {
+	failed, total int
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("%d of %d items failed", e.failed, e.total)
+}
+
+// expandBatch 根据拆分选项生成子任务：指定 seeds 时每个种子一个子任务，
+// 指定 split 时按 batch_size 拆分，第 i 份的种子为原种子加 i，保证结果可复现
+func expandBatch(prompt comfyui.Prompt, opts *BatchOptions) ([]BatchItem, error) {
+	inputs := promptInputs(prompt)
+	baseSeed, hasSeed := findInput(inputs, seedInputs...)
+
+	var items []BatchItem
+	switch {
+	case len(opts.Seeds) > 0:
+		if !hasSeed {
+			return nil, errors.New("workflow has no seed input")
+		}
+		for i := range opts.Seeds {
+			seed := opts.Seeds[i]
+			items = append(items, BatchItem{Index: i, Seed: &seed})
+		}
+	case opts.Split > 0:
+		size, ok := findInput(inputs, "batch_size")
+		if !ok || size < 1 {
+			return nil, errors.New("workflow has no batch_size input")
+		}
+		for offset := int64(0); offset < size; offset += int64(opts.Split) {
+			item := BatchItem{Index: len(items), BatchSize: int(min(int64(opts.Split), size-offset))}
+			if hasSeed {
+				seed := baseSeed + int64(item.Index)
+				item.Seed = &seed
+			}
+			items = append(items, item)
+		}
+	default:
+		return nil, errors.New("batch requires seeds or split")
+	}
+	if opts.Retries < 0 {
+		return nil, errors.New("batch retries must not be negative")
+	}
+	for i := range items {
+		items[i].State = JobQueued
+	}
+	return items, nil
+}
+
+// promptInputs 以节点 ID 为键返回全部节点的输入
+func promptInputs(prompt comfyui.Prompt) map[string]map[string]interface{} {
+	inputs := make(map[string]map[string]interface{}, len(prompt.Nodes))
+	for id, node := range prompt.Nodes {
+		inputs[id] = node.Inputs.Values()
+	}
+	return inputs
+}
+
+// findInput 按节点 ID 顺序查找第一个数值型的指定输入
+func findInput(inputs map[string]map[string]interface{}, names ...string) (int64, bool) {
+	ids := make([]string, 0, len(inputs))
+	for id := range inputs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, name := range names {
+			if value, ok := comfyui.Int64(inputs[id][name]); ok {
+				return value, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// itemPrompt 返回子任务的工作流：替换全部种子输入与 batch_size 输入
+func itemPrompt(prompt comfyui.Prompt, item BatchItem) (comfyui.Prompt, error) {
+	return patchInputs(prompt, func(id string, values map[string]interface{}) {
+		for _, name := range seedInputs {
+			if _, ok := comfyui.Int64(values[name]); ok && item.Seed != nil {
+				values[name] = *item.Seed
+			}
+		}
+		if _, ok := comfyui.Int64(values["batch_size"]); ok && item.BatchSize > 0 {
+			values["batch_size"] = item.BatchSize
+		}
+	})
+}
+
+// patchInputs 返回修改了节点输入的工作流副本，fn 对每个节点调用一次，可以增删改其输入
+func patchInputs(prompt comfyui.Prompt, fn func(id string, values map[string]interface{})) (comfyui.Prompt, error) {
+	inputs := promptInputs(prompt)
+	nodes := make(map[string]interface{}, len(prompt.Nodes))
+	for id, node := range prompt.Nodes {
+		fn(id, inputs[id])
+		nodes[id] = gin.H{"class_type": node.ClassType, "inputs": inputs[id]}
+	}
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		return comfyui.Prompt{}, err
+	}
+	var patched comfyui.Prompt
+	return patched, json.Unmarshal(data, &patched)
+}
+
+// item 返回第 i 个子任务的快照
+func (j *Job) item(i int) BatchItem {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.items[i]
+}
+
+// updateItem 修改第 i 个子任务，子任务进入终态或重试时发布 item 事件
+func (j *Job) updateItem(i int, fn func(item *BatchItem)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	before := j.items[i]
+	fn(&j.items[i])
+	item := j.items[i]
+	if item.State != before.State && (item.State.Terminal() || item.Attempts != before.Attempts) {
+		j.publishLocked(JobEventItem, item)
+	}
+}
+
+// setItemProgress 根据子任务状态更新其进度，并汇总为父任务进度：每个子任务计 100
+func (j *Job) setItemProgress(i int, status JobStatus) {
+	fraction := 0.0
+	switch {
+	case status.State == JobSucceeded:
+		fraction = 1
+	case status.State == JobRunning && status.Progress.Max > 0:
+		fraction = float64(status.Progress.Value) / float64(status.Progress.Max)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.items[i].progress = fraction
+	total := 0.0
+	for _, item := range j.items {
+		total += item.progress
+	}
+	progress := Progress{Value: int(math.Round(total * 100)), Max: 100 * len(j.items)}
+	if progress != j.progress {
+		j.progress = progress
+		j.publishLocked(JobEventProgress, progress)
+	}
+}
+
+// executeBatch 将批量任务拆分为子任务并发执行，按子任务顺序合并输出
+func (m *JobManager) executeBatch(ctx context.Context, parent *Job) ([]JobOutput, error) {
+	if parent.spec.Tile != nil {
+		// 重启时尚有分块子任务未创建，重新解码保存的输入图像
+		if err := parent.decodeTileSource(); err != nil {
+			return nil, err
+		}
+	}
+	results := make([][]JobOutput, len(parent.items))
+	var wg sync.WaitGroup
+	for i := range parent.items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = m.runItem(ctx, parent, i)
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if parent.spec.Tile != nil {
+		return m.stitchTiles(parent)
+	}
+
+	var merged []JobOutput
+	failed := 0
+	for i, outputs := range results {
+		if parent.item(i).State != JobSucceeded {
+			failed++
+			continue
+		}
+		var indexes []int
+		for _, output := range outputs {
+			output.Index = len(merged)
+			output.URL = fmt.Sprintf("/api/jobs/%s/outputs/%d", parent.id, output.Index)
+			indexes = append(indexes, output.Index)
+			merged = append(merged, output)
+		}
+		parent.updateItem(i, func(item *BatchItem) { item.Outputs = indexes })
+	}
+	if failed == len(results) {
+		return nil, fmt.Errorf("all %d items failed", failed)
+	}
+	if failed > 0 {
+		return merged, &partialError{failed: failed, total: len(results)}
+	}
+	return merged, nil
+}
+
+// runItem 提交并跟踪一个子任务，失败时按重试次数换到其他后端重新提交，返回成功时的输出
+func (m *JobManager) runItem(ctx context.Context, parent *Job, i int) []JobOutput {
+	var child, previous *Job
+	var exclude []string
+	if id := parent.item(i).JobID; id != "" {
+		// 重启后继续跟踪已提交的子任务
+		child, _ = m.Get(id)
+	}
+	// 子任务不再重试后释放其记录中的上传图像
+	defer func() {
+		for _, job := range []*Job{child, previous} {
+			if job != nil && job.releaseUploads() {
+				m.persist(job)
+			}
+		}
+	}()
+
+	for {
+		if child == nil {
+			spec, err := m.itemSpec(parent, i, exclude, previous)
+			if err == nil {
+				child, err = m.Submit(spec)
+			}
+			if err != nil {
+				parent.updateItem(i, func(item *BatchItem) {
+					item.State = JobFailed
+					item.Error = err.Error()
+				})
+				m.persist(parent)
+				return nil
+			}
+			parent.updateItem(i, func(item *BatchItem) {
+				item.JobID = child.id
+				item.State = JobQueued
+				item.Error = ""
+				item.Attempts++
+			})
+			parent.releaseTileSource()
+			m.persist(parent)
+			// 重试的子任务已沿用上一次的上传图像
+			if previous != nil && previous.releaseUploads() {
+				m.persist(previous)
+			}
+			previous = nil
+		}
+
+		status := m.follow(ctx, parent, i, child)
+		if ctx.Err() != nil {
+			_ = m.Cancel(child.id)
+			<-child.Done()
+			parent.updateItem(i, func(item *BatchItem) { item.State = JobCancelled })
+			return nil
+		}
+
+		parent.updateItem(i, func(item *BatchItem) {
+			item.State = status.State
+			item.Error = status.Error
+		})
+		m.persist(parent)
+		if status.State == JobSucceeded {
+			return status.Outputs
+		}
+		// 被单独取消的子任务不再重试
+		if status.State == JobCancelled || parent.item(i).Attempts > parent.spec.retries() {
+			return nil
+		}
+		if backend := child.getBackend(); backend != nil {
+			exclude = append(exclude, backend.Name)
+		}
+		previous, child = child, nil
+	}
+}
+
+// follow 等待子任务结束，期间汇总其进度，返回子任务的最终状态
+func (m *JobManager) follow(ctx context.Context, parent *Job, i int, child *Job) JobStatus {
+	for {
+		changed := child.Changed()
+		status := child.Status()
+		parent.setItemProgress(i, status)
+		if status.State == JobRunning {
+			parent.updateItem(i, func(item *BatchItem) { item.State = JobRunning })
+			if parent.setRunning() {
+				m.persist(parent)
+			}
+		}
+		if status.State.Terminal() {
+			return status
+		}
+		select {
+		case <-changed:
+		case <-child.Done():
+		case <-ctx.Done():
+			return status
+		}
+	}
+}
+
+// itemSpec 返回第 i 个子任务的任务描述，exclude 为重试时要避开的后端，previous 为上一次失败的子任务
+func (m *JobManager) itemSpec(parent *Job, i int, exclude []string, previous *Job) (JobSpec, error) {
+	item := parent.item(i)
+	prompt, err := itemPrompt(parent.spec.Prompt, item)
+	if err != nil {
+		return JobSpec{}, err
+	}
+	spec := JobSpec{
+		Prompt:   prompt,
+		Priority: parent.spec.Priority,
+		Tenant:   parent.spec.Tenant,
+		Template: parent.spec.Template,
+		Version:  parent.spec.Version,
+		Timeout:  parent.spec.Timeout,
+		Cache:    parent.spec.Cache,
+		ParentID: parent.id,
+		Exclude:  exclude,
+	}
+	if parent.spec.Tile != nil {
+		// 重试的分块沿用上一次子任务裁剪出的图像，父任务释放输入图像后仍可重试
+		if previous != nil && len(previous.spec.Uploads) > 0 {
+			spec.Uploads = previous.spec.Uploads
+			return spec, nil
+		}
+		src := parent.getTileSource()
+		if src == nil {
+			return JobSpec{}, errors.New("tile image is no longer available")
+		}
+		upload, err := tileUpload(src, parent.spec.Tile.Node, item)
+		if err != nil {
+			return JobSpec{}, err
+		}
+		spec.Uploads = []Upload{upload}
+	}
+	return spec, nil
+}
@@ -0,0 +1,153 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// 种子超过 2^53，float64 无法精确表示
+const batchWorkflow = `{
+	"3": {"class_type": "KSampler", "inputs": {"seed": 123456789012345678, "steps": 20, "model": ["4", 0], "latent_image": ["5", 0]}},
+	"5": {"class_type": "EmptyLatentImage", "inputs": {"batch_size": 5, "width": 512, "height": 512}},
+	"6": {"class_type": "SamplerCustom", "inputs": {"noise_seed": 123456789012345678}}
+}`
+
+func batchPrompt(t *testing.T) comfyui.Prompt {
+	t.Helper()
+	var prompt comfyui.Prompt
+	if err := json.Unmarshal([]byte(batchWorkflow), &prompt); err != nil {
+		t.Fatal(err)
+	}
+	return prompt
+}
+
+func TestExpandBatchSplit(t *testing.T) {
+	prompt := batchPrompt(t)
+	items, err := expandBatch(prompt, &BatchOptions{Split: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("%d items, want 3", len(items))
+	}
+	for i, want := range []int{2, 2, 1} {
+		item := items[i]
+		if item.BatchSize != want {
+			t.Errorf("item %d: batch_size %d, want %d", i, item.BatchSize, want)
+		}
+		if item.Seed == nil || *item.Seed != 123456789012345678+int64(i) {
+			t.Fatalf("item %d: seed %v, want %d", i, item.Seed, 123456789012345678+int64(i))
+		}
+
+		patched, err := itemPrompt(prompt, item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seed := patched.Nodes["3"].Inputs.Seed; seed != *item.Seed {
+			t.Errorf("item %d: seed %d, want %d", i, seed, *item.Seed)
+		}
+		if seed, _ := comfyui.Int64(patched.Nodes["6"].Inputs.Extra["noise_seed"]); seed != *item.Seed {
+			t.Errorf("item %d: noise_seed %d, want %d", i, seed, *item.Seed)
+		}
+		if size := patched.Nodes["5"].Inputs.BatchSize; size != want {
+			t.Errorf("item %d: patched batch_size %d, want %d", i, size, want)
+		}
+		if steps := patched.Nodes["3"].Inputs.Steps; steps != 20 {
+			t.Errorf("item %d: steps %d, want 20", i, steps)
+		}
+	}
+}
+
+func TestExpandBatchSeeds(t *testing.T) {
+	prompt := batchPrompt(t)
+	items, err := expandBatch(prompt, &BatchOptions{Seeds: []int64{9007199254740993, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := itemPrompt(prompt, items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed := patched.Nodes["3"].Inputs.Seed; seed != 9007199254740993 {
+		t.Fatalf("seed %d, want 9007199254740993", seed)
+	}
+	// 只指定种子时不修改 batch_size
+	if size := patched.Nodes["5"].Inputs.BatchSize; size != 5 {
+		t.Fatalf("batch_size %d, want 5", size)
+	}
+
+	if _, err := expandBatch(comfyui.Prompt{}, &BatchOptions{Seeds: []int64{1}}); err == nil {
+		t.Fatal("expandBatch accepted a workflow without a seed input")
+	}
+}
+
+func TestItemSpecTemplate(t *testing.T) {
+	pool, err := NewPool(PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewJobManager(NewMemoryJobStore(), NewMemoryStorage(), pool, TimeoutConfig{}, RetryConfig{}, CacheConfig{}, ThumbnailConfig{})
+	prompt := batchPrompt(t)
+	opts := &BatchOptions{Seeds: []int64{1, 2}}
+	items, err := expandBatch(prompt, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := &Job{
+		id:    "parent",
+		spec:  JobSpec{Prompt: prompt, Batch: opts, Template: "sdxl", Version: "v2", Tenant: defaultTenant},
+		items: items,
+	}
+	spec, err := m.itemSpec(parent, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Template != "sdxl" || spec.Version != "v2" || spec.ParentID != "parent" {
+		t.Fatalf("child spec template %q version %q parent %q", spec.Template, spec.Version, spec.ParentID)
+	}
+	if spec.Prompt.Nodes["3"].Inputs.Seed != 2 {
+		t.Fatalf("child seed %d, want 2", spec.Prompt.Nodes["3"].Inputs.Seed)
+	}
+}
+
+func TestReleaseUploads(t *testing.T) {
+	job := &Job{id: "tile-0", state: JobRunning, spec: JobSpec{Uploads: []Upload{{Node: "1", Input: "image", Data: []byte("png")}}}}
+	// 执行中的子任务可能因换后端而再次上传
+	if job.releaseUploads() || len(job.spec.Uploads) != 1 {
+		t.Fatal("released the uploads of a running job")
+	}
+	job.state = JobFailed
+	if !job.releaseUploads() || job.spec.Uploads != nil || job.record().Uploads != nil {
+		t.Fatal("uploads kept after the job finished")
+	}
+	if job.releaseUploads() {
+		t.Fatal("released the uploads twice")
+	}
+}
+
+func TestRequeueReleasedTile(t *testing.T) {
+	pool, err := NewPool(PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewJobManager(NewMemoryJobStore(), NewMemoryStorage(), pool, TimeoutConfig{}, RetryConfig{}, CacheConfig{}, ThumbnailConfig{})
+	parent := &Job{
+		id:    "tiled",
+		state: JobFailed,
+		dead:  true,
+		spec:  JobSpec{Prompt: batchPrompt(t), Tile: &TileOptions{Size: 512}, Tenant: defaultTenant},
+		items: []BatchItem{{JobID: "tile-0", State: JobFailed}},
+	}
+	m.jobs[parent.id] = parent
+
+	if _, err := m.Requeue(parent.id, nil); !errors.Is(err, ErrTileImageReleased) {
+		t.Fatalf("Requeue = %v, want %v", err, ErrTileImageReleased)
+	}
+	// 任务仍留在死信队列中，可以丢弃
+	if !parent.Status().DeadLetter {
+		t.Fatal("job left the dead-letter queue")
+	}
+}
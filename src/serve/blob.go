@@ -0,0 +1,269 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blobKey 返回内容哈希在输出存储中的键
+func blobKey(sum string) string {
+	return "blobs/sha256/" + sum[:2] + "/" + sum
+}
+
+// blobSum 返回内容的 SHA-256 十六进制摘要
+func blobSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validBlobSum 判断是否为小写十六进制的 SHA-256 摘要
+func validBlobSum(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range sum {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// blobEntry 是一份内容的元数据，mu 保证同一内容的写入与删除不会交错
+type blobEntry struct {
+	mu          sync.Mutex
+	refs        map[string]bool // 引用该内容的任务
+	stored      bool            // 已写入存储
+	removed     bool            // 已从索引中移除，持有旧条目的调用方需重新查找
+	size        int
+	contentType string
+}
+
+// BlobInfo 是内容的元数据快照
+type BlobInfo struct {
+	SHA256      string
+	Size        int
+	ContentType string
+	Jobs        []string // 引用该内容的任务
+}
+
+// BlobIndex 按内容哈希记录输出与引用它的任务：相同的内容只在第一次被引用时写入存储，
+// 最后一个引用释放时从存储删除。引用关系保存在任务记录的输出中，启动时由 Restore 重建。
+type BlobIndex struct {
+	mu      sync.Mutex
+	blobs   map[string]*blobEntry
+	storage Storage
+}
+
+// NewBlobIndex 创建内容索引
+func NewBlobIndex(storage Storage) *BlobIndex {
+	return &BlobIndex{blobs: make(map[string]*blobEntry), storage: storage}
+}
+
+// lock 返回已加锁的内容条目，不存在时创建
+func (x *BlobIndex) lock(sum string) *blobEntry {
+	for {
+		x.mu.Lock()
+		entry := x.blobs[sum]
+		if entry == nil {
+			entry = &blobEntry{refs: make(map[string]bool)}
+			x.blobs[sum] = entry
+		}
+		x.mu.Unlock()
+
+		entry.mu.Lock()
+		if !entry.removed {
+			return entry
+		}
+		entry.mu.Unlock()
+	}
+}
+
+// removeLocked 在条目没有引用时将其移出索引，调用方需持有 entry.mu
+func (x *BlobIndex) removeLocked(sum string, entry *blobEntry) {
+	if len(entry.refs) > 0 {
+		return
+	}
+	entry.removed = true
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.blobs[sum] == entry {
+		delete(x.blobs, sum)
+	}
+}
+
+// Add 记录任务引用的内容，内容尚未存储时写入存储，返回内容哈希
+func (x *BlobIndex) Add(ctx context.Context, jobID string, data []byte, contentType string) (string, error) {
+	sum := blobSum(data)
+	entry := x.lock(sum)
+	defer entry.mu.Unlock()
+	if !entry.stored {
+		if err := x.storage.Put(ctx, blobKey(sum), data, contentType); err != nil {
+			x.removeLocked(sum, entry)
+			return "", err
+		}
+		entry.stored = true
+		entry.size = len(data)
+		entry.contentType = contentType
+	}
+	entry.refs[jobID] = true
+	return sum, nil
+}
+
+// Ref 记录任务对已存储内容的引用，用于重建索引与批量任务合并子任务的输出
+func (x *BlobIndex) Ref(jobID, sum string, size int, contentType string) {
+	entry := x.lock(sum)
+	defer entry.mu.Unlock()
+	entry.stored = true
+	entry.size = size
+	entry.contentType = contentType
+	entry.refs[jobID] = true
+}
+
+// Release 释放任务对内容的引用，没有任务引用时从存储删除
+func (x *BlobIndex) Release(ctx context.Context, jobID, sum string) error {
+	entry := x.lock(sum)
+	defer entry.mu.Unlock()
+	delete(entry.refs, jobID)
+	if len(entry.refs) > 0 {
+		return nil
+	}
+	if entry.stored {
+		// 先删除转码结果，失败时内容仍然完整
+		variants, err := x.storage.List(ctx, variantPrefix(sum))
+		for _, key := range variants {
+			if err == nil {
+				err = x.storage.Delete(ctx, key)
+			}
+		}
+		if err == nil {
+			err = x.storage.Delete(ctx, blobKey(sum))
+		}
+		if err != nil {
+			entry.refs[jobID] = true
+			return err
+		}
+	}
+	x.removeLocked(sum, entry)
+	return nil
+}
+
+// Stat 返回内容的元数据，没有任务引用时返回 false
+func (x *BlobIndex) Stat(sum string) (BlobInfo, bool) {
+	x.mu.Lock()
+	entry := x.blobs[sum]
+	x.mu.Unlock()
+	if entry == nil {
+		return BlobInfo{}, false
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.removed || !entry.stored || len(entry.refs) == 0 {
+		return BlobInfo{}, false
+	}
+	info := BlobInfo{SHA256: sum, Size: entry.size, ContentType: entry.contentType}
+	for id := range entry.refs {
+		info.Jobs = append(info.Jobs, id)
+	}
+	slices.Sort(info.Jobs)
+	return info, true
+}
+
+// Get 读取内容
+func (x *BlobIndex) Get(ctx context.Context, sum string) ([]byte, error) {
+	return x.storage.Get(ctx, blobKey(sum))
+}
+
+// Variant 返回内容名为 name 的转码结果，存储中没有时用 render 生成并写入存储。
+// 生成期间持有内容的锁，同一内容的转码不会重复进行，也不会在内容删除后写入。
+func (x *BlobIndex) Variant(ctx context.Context, sum, name, contentType string, render func() ([]byte, error)) ([]byte, error) {
+	entry := x.lock(sum)
+	defer entry.mu.Unlock()
+	if !entry.stored || len(entry.refs) == 0 {
+		x.removeLocked(sum, entry)
+		return nil, ErrObjectNotFound
+	}
+	key := variantPrefix(sum) + name
+	data, err := x.storage.Get(ctx, key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return data, err
+	}
+	if data, err = render(); err != nil {
+		return nil, err
+	}
+	if err := x.storage.Put(ctx, key, data, contentType); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// getBlob 按 SHA-256 返回输出内容。内容不可变，响应带强 ETag 与长期缓存头；
+// 只有引用该内容的任务属于当前租户时可以访问。带 format、width 等参数时返回转码结果。
+func getBlob(c *gin.Context) {
+	sum := strings.ToLower(c.Param("sha256"))
+	if !validBlobSum(sum) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sha256"})
+		return
+	}
+	info, ok := jobs.blobs.Stat(sum)
+	tenant := currentTenant(c)
+	ok = ok && slices.ContainsFunc(info.Jobs, func(id string) bool {
+		_, err := jobs.GetForTenant(id, tenant)
+		return err == nil
+	})
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "blob not found"})
+		return
+	}
+
+	variant, err := parseVariant(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	contentType := info.ContentType
+	etag := `"` + sum + `"`
+	if variant != nil {
+		v := variant.resolve(info.ContentType)
+		variant, contentType = &v, v.contentType()
+		etag = `"` + sum + "-" + v.name() + `"`
+	}
+	c.Header("ETag", etag)
+	if len(tenants) > 0 {
+		c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if match := c.GetHeader("If-None-Match"); match != "" && (match == "*" || slices.Contains(splitETags(match), etag)) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	var data []byte
+	if variant != nil {
+		data, err = jobs.variant(c.Request.Context(), sum, nil, *variant)
+	} else {
+		data, err = jobs.blobs.Get(c.Request.Context(), sum)
+	}
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// splitETags 拆分 If-None-Match 中的 ETag 列表，弱比较时忽略 W/ 前缀
+func splitETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tags = append(tags, strings.TrimPrefix(strings.TrimSpace(tag), "W/"))
+	}
+	return tags
+}
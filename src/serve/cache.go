@@ -0,0 +1,221 @@
+package serve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// 提交任务时的结果缓存模式
+const (
+	CacheBypass = "bypass" // 总是执行，结果仍写入缓存
+	CachePrefer = "prefer" // 有缓存时直接返回，否则执行（默认）
+	CacheOnly   = "only"   // 只返回缓存，没有时拒绝
+)
+
+// ErrCacheMiss 表示 cache 为 only 时没有可用的缓存结果
+var ErrCacheMiss = errors.New("no cached result for this prompt")
+
+// cacheIgnoredInputs 是不影响输出内容、计算提示哈希时忽略的输入
+var cacheIgnoredInputs = map[string]bool{
+	"filename_prefix": true,
+}
+
+// validCacheMode 校验缓存模式，空值视为 prefer
+func validCacheMode(mode string) error {
+	switch mode {
+	case "", CacheBypass, CachePrefer, CacheOnly:
+		return nil
+	default:
+		return fmt.Errorf("invalid cache mode %q, expected bypass, prefer or only", mode)
+	}
+}
+
+// promptHash 返回提示规范化后的 SHA-256：对象键排序，数值统一格式，忽略 filename_prefix
+func promptHash(prompt comfyui.Prompt) (string, error) {
+	data, err := json.Marshal(prompt)
+	if err != nil {
+		return "", err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var nodes map[string]interface{}
+	if err := decoder.Decode(&nodes); err != nil {
+		return "", err
+	}
+	for _, node := range nodes {
+		if node, ok := node.(map[string]interface{}); ok {
+			if inputs, ok := node["inputs"].(map[string]interface{}); ok {
+				for name := range cacheIgnoredInputs {
+					delete(inputs, name)
+				}
+			}
+		}
+	}
+	// encoding/json 按键排序输出 map
+	canonical, err := json.Marshal(normalizeNumbers(nodes))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// normalizeNumbers 将数值统一为最短形式，整数值的浮点数（如 1.0、1e3）按整数输出
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+		return v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v
+		}
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return json.Number(strconv.FormatInt(int64(f), 10))
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+	default:
+		return v
+	}
+}
+
+// ResultCache 按租户、模板版本与提示哈希记录最近一次成功执行的任务
+type ResultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+// cacheEntry 是一条缓存记录，超过 TTL 后在查找或回收时删除
+type cacheEntry struct {
+	jobID string
+	at    time.Time
+}
+
+// NewResultCache 创建结果缓存，ttl 为 0 时不使用缓存
+func NewResultCache(ttl time.Duration) *ResultCache {
+	return &ResultCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// cacheKey 返回缓存键，模板与版本不同的任务即使提示相同也不共用结果
+func cacheKey(tenant, template, version, hash string) string {
+	return strings.Join([]string{tenant, template, version, hash}, "\x00")
+}
+
+// Remember 记录缓存键对应的成功任务
+func (c *ResultCache) Remember(key, jobID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{jobID: jobID, at: time.Now()}
+}
+
+// Lookup 返回缓存键对应的任务 ID，过期的记录被删除
+func (c *ResultCache) Lookup(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Since(entry.at) > c.ttl {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.jobID, true
+}
+
+// Prune 删除过期的记录，由任务回收时调用
+func (c *ResultCache) Prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if now.Sub(entry.at) > c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// remember 将执行成功的任务记入结果缓存，命中缓存完成的任务不再记入，缓存的有效期从实际执行时算起
+func (m *JobManager) remember(job *Job) {
+	status := job.Status()
+	if status.State == JobSucceeded && status.Error == "" && status.PromptHash != "" && status.CachedFrom == "" {
+		m.cache.Remember(cacheKey(status.Tenant, status.Template, status.Version, status.PromptHash), status.ID)
+	}
+}
+
+// cacheable 判断任务能否使用缓存的结果。不可见水印与来源签名标识产生内容的任务，
+// 复用其他任务的内容会指向原任务，因此适用这两项的任务总是执行。
+func (m *JobManager) cacheable(spec JobSpec) bool {
+	if m.cache.ttl <= 0 || m.signer != nil {
+		return false
+	}
+	if m.watermarks != nil {
+		if _, rule := m.watermarks.rule(spec.Template, spec.Tenant); rule.Invisible {
+			return false
+		}
+	}
+	return true
+}
+
+// cached 返回 TTL 内同一租户以相同模板版本执行相同提示成功的任务，没有时返回 nil。
+// 部分输出未存入存储或已被回收的任务不可用。
+func (m *JobManager) cached(spec JobSpec, hash string) *Job {
+	if !m.cacheable(spec) {
+		return nil
+	}
+	id, ok := m.cache.Lookup(cacheKey(spec.Tenant, spec.Template, spec.Version, hash))
+	if !ok {
+		return nil
+	}
+	source, err := m.Get(id)
+	if err != nil {
+		return nil
+	}
+	status := source.Status()
+	if status.State != JobSucceeded || status.Error != "" || status.FinishedAt == nil ||
+		time.Since(*status.FinishedAt) > m.cache.ttl {
+		return nil
+	}
+	for _, output := range status.Outputs {
+		if output.SHA256 == "" {
+			return nil
+		}
+	}
+	return source
+}
+
+// completeFromCache 以缓存任务的输出直接完成新任务，不经过队列与后端
+func (m *JobManager) completeFromCache(job, source *Job) {
+	outputs := source.Status().Outputs
+	for i := range outputs {
+		outputs[i].URL = fmt.Sprintf("/api/jobs/%s/outputs/%d", job.id, outputs[i].Index)
+		m.blobs.Ref(job.id, outputs[i].SHA256, outputs[i].Size, outputs[i].ContentType)
+	}
+	job.mu.Lock()
+	job.cachedFrom = source.id
+	job.mu.Unlock()
+	job.finish(JobSucceeded, outputs, "")
+	job.cancel()
+	close(job.done)
+	m.persist(job)
+	m.finished(job)
+}
@@ -0,0 +1,88 @@
+package serve
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/provenance"
+)
+
+func TestResultCacheExpiry(t *testing.T) {
+	c := NewResultCache(time.Hour)
+	c.Remember("fresh", "job-1")
+	c.Remember("stale", "job-2")
+	c.entries["stale"] = cacheEntry{jobID: "job-2", at: time.Now().Add(-2 * time.Hour)}
+
+	if id, ok := c.Lookup("fresh"); !ok || id != "job-1" {
+		t.Fatalf("Lookup(fresh) = %q, %v", id, ok)
+	}
+	if _, ok := c.Lookup("stale"); ok {
+		t.Fatal("Lookup returned an expired entry")
+	}
+	if _, ok := c.entries["stale"]; ok {
+		t.Fatal("Lookup kept an expired entry")
+	}
+
+	// 回收时删除从未再查找的过期记录
+	c.Remember("old", "job-3")
+	c.Prune(time.Now().Add(2 * time.Hour))
+	if len(c.entries) != 0 {
+		t.Fatalf("%d entries after Prune, want 0", len(c.entries))
+	}
+}
+
+func TestCachedJob(t *testing.T) {
+	pool, err := NewPool(PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewJobManager(NewMemoryJobStore(), NewMemoryStorage(), pool, TimeoutConfig{}, RetryConfig{}, CacheConfig{TTL: Duration(time.Hour)}, ThumbnailConfig{})
+	spec := JobSpec{Tenant: "a", Template: "sdxl", Version: "v1"}
+	source := &Job{
+		id:         "source",
+		state:      JobSucceeded,
+		spec:       spec,
+		promptHash: "hash",
+		finishedAt: time.Now(),
+		outputs:    []JobOutput{{Index: 0, SHA256: "sum", ContentType: "image/png"}},
+		changed:    make(chan struct{}),
+	}
+	m.jobs[source.id] = source
+	m.remember(source)
+
+	if got := m.cached(spec, "hash"); got != source {
+		t.Fatalf("cached = %v, want the source job", got)
+	}
+	// 模板版本或租户不同时不复用
+	for _, other := range []JobSpec{
+		{Tenant: "a", Template: "sdxl", Version: "v2"},
+		{Tenant: "a", Template: "sdxl"},
+		{Tenant: "a"},
+		{Tenant: "b", Template: "sdxl", Version: "v1"},
+	} {
+		if got := m.cached(other, "hash"); got != nil {
+			t.Errorf("cached(%+v) = %s, want nil", other, got.id)
+		}
+	}
+
+	// 不可见水印与来源签名标识产生内容的任务，不使用缓存
+	watermarks, err := NewWatermarker(WatermarkConfig{Tenants: map[string]WatermarkRule{"a": {Invisible: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetWatermarker(watermarks)
+	if got := m.cached(spec, "hash"); got != nil {
+		t.Fatal("cached returned a job under an invisible watermark rule")
+	}
+	m.SetWatermarker(nil)
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetSigner(provenance.NewSigner(key))
+	if got := m.cached(spec, "hash"); got != nil {
+		t.Fatal("cached returned a job with provenance signing enabled")
+	}
+}
@@ -0,0 +1,148 @@
+package serve
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// Catalog 是后端已安装的节点类型与各枚举输入（checkpoint、LoRA 等）的可选值，来自 /object_info
+type Catalog struct {
+	classes   map[string]map[string]map[string]bool // class_type -> 输入名称 -> 可选值
+	fetchedAt time.Time
+}
+
+// newCatalog 根据 /object_info 创建目录
+func newCatalog(info map[string]*comfyui.NodeInfo) *Catalog {
+	catalog := &Catalog{
+		classes:   make(map[string]map[string]map[string]bool, len(info)),
+		fetchedAt: time.Now(),
+	}
+	for class, node := range info {
+		inputs := make(map[string]map[string]bool)
+		for name, values := range node.Options() {
+			set := make(map[string]bool, len(values))
+			for _, value := range values {
+				set[value] = true
+			}
+			inputs[name] = set
+		}
+		catalog.classes[class] = inputs
+	}
+	return catalog
+}
+
+// Missing 返回提示引用但后端缺少的节点类型与模型，全部满足时返回空
+func (c *Catalog) Missing(prompt comfyui.Prompt) []string {
+	seen := make(map[string]bool)
+	var missing []string
+	add := func(item string) {
+		if !seen[item] {
+			seen[item] = true
+			missing = append(missing, item)
+		}
+	}
+
+	for _, node := range prompt.Nodes {
+		inputs, ok := c.classes[node.ClassType]
+		if !ok {
+			add(fmt.Sprintf("node type %q", node.ClassType))
+			continue
+		}
+		for name, value := range node.Inputs.Values() {
+			// 只检查枚举输入，连线（[节点 ID, 输出序号]）与自由输入不受限制
+			text, ok := value.(string)
+			options, isEnum := inputs[name]
+			if ok && isEnum && !options[text] {
+				add(fmt.Sprintf("%s %q", name, text))
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// UnsatisfiableError 表示没有任何后端能满足提示引用的全部模型与节点
+type UnsatisfiableError struct {
+	Missing []string // 全部后端都缺少的项；为空时表示每个后端各缺一部分
+	Partial []string // 至少有一个后端缺少的项
+}
+
+func (e *UnsatisfiableError) Error() string {
+	if len(e.Missing) > 0 {
+		return "no backend has " + strings.Join(e.Missing, ", ")
+	}
+	return "no backend has all of " + strings.Join(e.Partial, ", ")
+}
+
+// Catalog 返回后端的节点与模型目录，尚未获取时为 nil
+func (b *Backend) Catalog() *Catalog {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.catalog
+}
+
+// Supports 判断后端能否执行提示，目录尚未获取时视为可以
+func (b *Backend) Supports(prompt comfyui.Prompt) bool {
+	catalog := b.Catalog()
+	return catalog == nil || len(catalog.Missing(prompt)) == 0
+}
+
+// refreshCatalog 在目录缺失或过期时重新获取 /object_info
+func (b *Backend) refreshCatalog() {
+	b.mu.Lock()
+	fresh := b.catalog != nil && time.Since(b.catalog.fetchedAt) < time.Duration(b.health.CatalogInterval)
+	b.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	info, err := b.timedClient(b.catalogClient).GetObjectInfo()
+	if err != nil {
+		log.Printf("backend %s: failed to fetch object_info: %v", b.Name, err)
+		return
+	}
+	catalog := newCatalog(info)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.catalog = catalog
+}
+
+// Check 检查是否至少有一个后端（不论当前是否可用）能满足提示。
+// 池为空或存在尚未获取目录的后端时无法判断，视为可以满足。
+func (p *Pool) Check(prompt comfyui.Prompt) error {
+	backends := p.Backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	missingCount := make(map[string]int)
+	for _, backend := range backends {
+		catalog := backend.Catalog()
+		if catalog == nil {
+			return nil
+		}
+		missing := catalog.Missing(prompt)
+		if len(missing) == 0 {
+			return nil
+		}
+		for _, item := range missing {
+			missingCount[item]++
+		}
+	}
+
+	err := &UnsatisfiableError{}
+	for item, count := range missingCount {
+		err.Partial = append(err.Partial, item)
+		if count == len(backends) {
+			err.Missing = append(err.Missing, item)
+		}
+	}
+	sort.Strings(err.Missing)
+	sort.Strings(err.Partial)
+	return err
+}
@@ -0,0 +1,296 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config 是服务配置，从 JSON 配置文件加载
+type Config struct {
+	Listen     string           `json:"listen"`      // 监听地址
+	AdminToken string           `json:"admin_token"` // 管理接口的 Bearer 令牌，为空时禁用管理接口
+	PublicURL  string           `json:"public_url"`  // 对外访问地址，用于生成回调中的绝对 URL
+	Pool       PoolConfig       `json:"pool"`
+	Store      StoreConfig      `json:"store"`
+	Storage    StorageConfig    `json:"storage"`
+	Retention  RetentionConfig  `json:"retention"`
+	Cache      CacheConfig      `json:"cache"`
+	Thumbnails ThumbnailConfig  `json:"thumbnails"`
+	Webhook    WebhookConfig    `json:"webhook"`
+	Provenance ProvenanceConfig `json:"provenance"`
+	Watermark  WatermarkConfig  `json:"watermark"`
+	Timeouts   TimeoutConfig    `json:"timeouts"`
+	Retry      RetryConfig      `json:"retry"`
+	Tenants    []TenantConfig   `json:"tenants"` // 为空时任务 API 不校验 API key，全部任务属于 default 租户
+}
+
+// TenantConfig 是一个租户的配置
+type TenantConfig struct {
+	Name   string `json:"name"`
+	APIKey string `json:"api_key"` // 通过 X-API-Key 或 Authorization: Bearer 传入
+	Weight int    `json:"weight"`  // 公平调度中的权重，默认为 1
+}
+
+// PoolConfig 是 ComfyUI 后端池的配置
+type PoolConfig struct {
+	Strategy   string          `json:"strategy"`    // round_robin、least_queue 或 weighted
+	QueueDepth int             `json:"queue_depth"` // 每个后端最多同时提交的任务数（执行中与排队中），其余任务在服务端排队
+	Backends   []BackendConfig `json:"backends"`
+	Health     HealthConfig    `json:"health"`
+	Affinity   AffinityConfig  `json:"affinity"`
+	Discovery  DiscoveryConfig `json:"discovery"`
+}
+
+// DiscoveryConfig 是动态后端的配置：worker 通过接口注册，或从文件与 DNS SRV 记录发现
+type DiscoveryConfig struct {
+	Token        string   `json:"token"`         // worker 注册接口的 Bearer 令牌，为空时使用 admin_token，都为空时不开放注册接口
+	HeartbeatTTL Duration `json:"heartbeat_ttl"` // 注册的 worker 超过该时间没有心跳即移除
+	File         string   `json:"file"`          // 后端列表 JSON 文件，内容变化时更新
+	SRV          string   `json:"srv"`           // DNS SRV 记录名，如 _comfyui._tcp.example.com
+	Interval     Duration `json:"interval"`      // 文件与 SRV 记录的检查间隔
+}
+
+// AffinityConfig 是缓存亲和调度的配置
+type AffinityConfig struct {
+	Enabled bool `json:"enabled"`  // 优先调度到最近执行过相同上游节点的后端
+	MaxSkew int  `json:"max_skew"` // 亲和后端比最空闲后端多出的任务数超过该值时按策略调度
+}
+
+// HealthConfig 是后端健康探测与熔断的配置
+type HealthConfig struct {
+	Interval         Duration `json:"interval"`          // 探测间隔
+	Timeout          Duration `json:"timeout"`           // 单次探测超时
+	FailureThreshold int      `json:"failure_threshold"` // 连续失败多少次后摘除
+	OpenDuration     Duration `json:"open_duration"`     // 摘除后多久进行恢复探测
+	CatalogInterval  Duration `json:"catalog_interval"`  // 节点与模型目录（/object_info）的刷新间隔
+}
+
+// BackendConfig 是单个 ComfyUI 后端的配置
+type BackendConfig struct {
+	Name         string            `json:"name"`                   // 后端名称，默认为 URL
+	URL          string            `json:"url"`                    // ComfyUI 地址，如 http://127.0.0.1:8188
+	Weight       int               `json:"weight"`                 // weighted 策略下的权重，默认为 1
+	Labels       map[string]string `json:"labels,omitempty"`       // 标签，如 region、gpu
+	Capabilities []string          `json:"capabilities,omitempty"` // 声明的能力，如 sdxl、flux
+}
+
+// TimeoutConfig 是任务超时与卡死检测的配置，时间为 0 时不限制
+type TimeoutConfig struct {
+	Job      Duration `json:"job"`      // 任务开始执行后的最长时间，可被提交时的 timeout 覆盖
+	Node     Duration `json:"node"`     // 单个节点的最长执行时间
+	Stall    Duration `json:"stall"`    // 执行中超过该时间没有收到任何事件即视为卡死
+	Failover int      `json:"failover"` // 超时后换到其他后端重新提交的次数，0 表示直接失败
+}
+
+// RetryConfig 是失败任务的重试配置
+type RetryConfig struct {
+	Classes  map[string]string      `json:"classes"`  // execution_error 的 exception_type 到错误类别的映射，补充内置映射
+	Policies map[string]RetryPolicy `json:"policies"` // 按工作流模板名称的重试策略，default 用于其余任务
+}
+
+// RetryPolicy 是一类任务的重试策略
+type RetryPolicy struct {
+	MaxAttempts int      `json:"max_attempts"` // 最多执行次数，包括首次执行，1 表示不重试
+	MinBackoff  Duration `json:"min_backoff"`  // 首次重试前的等待时间，之后每次翻倍
+	MaxBackoff  Duration `json:"max_backoff"`  // 最长等待时间
+	Retryable   []string `json:"retryable"`    // 可重试的错误类别：disconnect、oom、timeout、execution、invalid
+}
+
+// StoreConfig 是任务存储的配置
+type StoreConfig struct {
+	Type string `json:"type"` // memory 或 bolt
+	Path string `json:"path"` // bolt 数据库文件路径
+}
+
+// StorageConfig 是任务输出存储的配置
+type StorageConfig struct {
+	Type string   `json:"type"` // local、s3 或 memory
+	Path string   `json:"path"` // local 存储的目录
+	S3   S3Config `json:"s3"`
+}
+
+// S3Config 是 S3 兼容对象存储的配置
+type S3Config struct {
+	Endpoint      string   `json:"endpoint"` // 如 https://s3.us-east-1.amazonaws.com 或 http://127.0.0.1:9000
+	Region        string   `json:"region"`   // 默认 us-east-1
+	Bucket        string   `json:"bucket"`   // 以路径风格访问的 bucket
+	AccessKey     string   `json:"access_key"`
+	SecretKey     string   `json:"secret_key"`
+	Prefix        string   `json:"prefix"`         // 对象键前缀，如 comfyui/
+	PublicURL     string   `json:"public_url"`     // 公开读的 bucket 或 CDN 地址，设置后返回固定 URL 而不是预签名 URL
+	PresignExpiry Duration `json:"presign_expiry"` // 预签名 URL 的有效期，默认 1 小时
+}
+
+// CacheConfig 是结果缓存的配置
+type CacheConfig struct {
+	TTL Duration `json:"ttl"` // 相同提示的成功结果在该时间内直接复用，为 0 时不使用缓存
+}
+
+// ThumbnailConfig 是任务结束时为图片输出生成的缩略图的配置
+type ThumbnailConfig struct {
+	Size    int    `json:"size"`    // 缩略图的最大宽高，为 0 时不生成
+	Format  string `json:"format"`  // png、jpeg 或 webp，为空时保持原格式
+	Quality int    `json:"quality"` // JPEG 质量
+}
+
+// RetentionConfig 是已结束任务的保留与回收配置
+type RetentionConfig struct {
+	Interval      Duration                 `json:"interval"`       // 自动回收的间隔，为 0 时只能通过管理接口回收
+	DeleteHistory bool                     `json:"delete_history"` // 回收时同时删除提示在 ComfyUI 上的历史记录
+	Default       RetentionRule            `json:"default"`        // 没有匹配的模板或租户规则时使用
+	Templates     map[string]RetentionRule `json:"templates"`      // 按工作流模板名称，优先于租户规则
+	Tenants       map[string]RetentionRule `json:"tenants"`        // 按租户名称
+}
+
+// RetentionRule 是一组任务的保留规则，满足任一条件的任务被回收，字段为 0 时不限制，置顶的任务不回收
+type RetentionRule struct {
+	MaxAge     Duration `json:"max_age"`     // 结束超过该时间的任务
+	KeepLatest int      `json:"keep_latest"` // 只保留最新结束的 N 个任务
+	MaxBytes   int64    `json:"max_bytes"`   // 输出总大小上限，超出时从最早结束的任务开始回收
+}
+
+// ProvenanceConfig 是输出来源签名的配置
+type ProvenanceConfig struct {
+	KeyFile string `json:"key_file"` // Ed25519 私钥的 PEM 文件（PKCS#8），为空时不签名
+}
+
+// WatermarkConfig 是输出水印的配置，规则按模板优先、租户其次匹配，都不匹配时使用 default
+type WatermarkConfig struct {
+	Key       string                   `json:"key"` // 决定不可见水印在图片中的分布，读取时需要相同的 key
+	Default   WatermarkRule            `json:"default"`
+	Templates map[string]WatermarkRule `json:"templates"` // 按工作流模板名称，优先于租户规则
+	Tenants   map[string]WatermarkRule `json:"tenants"`   // 按租户名称
+}
+
+// WatermarkRule 是一条水印规则，为空时不添加水印
+type WatermarkRule struct {
+	Logo      *LogoConfig `json:"logo"`      // 可见水印
+	Invisible bool        `json:"invisible"` // 嵌入任务 ID 的不可见水印
+	Strength  float64     `json:"strength"`  // 不可见水印的强度，默认 24，越大越能经受压缩，也越容易察觉
+}
+
+// LogoConfig 是可见水印的配置
+type LogoConfig struct {
+	File     string  `json:"file"`     // 水印图片，PNG、JPEG 或 WebP
+	Position string  `json:"position"` // top-left、top、top-right、left、center、right、bottom-left、bottom 或 bottom-right（默认）
+	Opacity  float64 `json:"opacity"`  // 不透明度 0-1，为 0 时为 1
+	Margin   int     `json:"margin"`   // 与图片边缘的距离（像素）
+	Scale    float64 `json:"scale"`    // 水印宽度占图片宽度的比例，为 0 时保持原始大小
+}
+
+// WebhookConfig 是任务完成回调的配置
+type WebhookConfig struct {
+	Secret      string   `json:"secret"`       // HMAC-SHA256 签名密钥，为空时不启用回调
+	Outbox      string   `json:"outbox"`       // 待投递回调的持久化目录
+	MaxAttempts int      `json:"max_attempts"` // 最大投递次数
+	MinBackoff  Duration `json:"min_backoff"`  // 首次重试间隔
+	MaxBackoff  Duration `json:"max_backoff"`  // 最大重试间隔
+	Timeout     Duration `json:"timeout"`      // 单次请求超时
+}
+
+// Duration 是可以用 "10s" 这类字符串配置的时间间隔
+type Duration time.Duration
+
+// UnmarshalJSON 解析字符串或纳秒数形式的时间间隔
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		v, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		*d = Duration(v)
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	*d = Duration(n)
+	return nil
+}
+
+// MarshalJSON 以字符串形式输出时间间隔
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig 返回默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: ":8080",
+		Pool: PoolConfig{
+			Strategy:   StrategyRoundRobin,
+			QueueDepth: 2,
+			Backends:   []BackendConfig{{Name: "local", URL: "http://127.0.0.1:8188"}},
+			Health: HealthConfig{
+				Interval:         Duration(10 * time.Second),
+				Timeout:          Duration(5 * time.Second),
+				FailureThreshold: 3,
+				OpenDuration:     Duration(30 * time.Second),
+				CatalogInterval:  Duration(5 * time.Minute),
+			},
+			Affinity: AffinityConfig{Enabled: true, MaxSkew: 2},
+			Discovery: DiscoveryConfig{
+				HeartbeatTTL: Duration(30 * time.Second),
+				Interval:     Duration(30 * time.Second),
+			},
+		},
+		Retry: RetryConfig{
+			Policies: map[string]RetryPolicy{
+				defaultRetryPolicy: {
+					MaxAttempts: 3,
+					MinBackoff:  Duration(5 * time.Second),
+					MaxBackoff:  Duration(time.Minute),
+					Retryable:   []string{ErrorClassDisconnect, ErrorClassOOM},
+				},
+			},
+		},
+		Store: StoreConfig{
+			Type: "bolt",
+			Path: "data/jobs.db",
+		},
+		Storage: StorageConfig{
+			Type: "local",
+			Path: "data/outputs",
+		},
+		Retention: RetentionConfig{
+			Interval: Duration(time.Hour),
+		},
+		Cache: CacheConfig{
+			TTL: Duration(24 * time.Hour),
+		},
+		Thumbnails: ThumbnailConfig{
+			Size:   256,
+			Format: "webp",
+		},
+		Webhook: WebhookConfig{
+			Outbox:      "data/webhooks",
+			MaxAttempts: 10,
+			MinBackoff:  Duration(5 * time.Second),
+			MaxBackoff:  Duration(30 * time.Minute),
+			Timeout:     Duration(10 * time.Second),
+		},
+	}
+}
+
+// LoadConfig 读取配置文件，未指定路径时使用默认配置
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	cfg.PublicURL = strings.TrimRight(cfg.PublicURL, "/")
+	return cfg, nil
+}
@@ -0,0 +1,231 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// discovery 管理动态加入的后端，由 StartServer 初始化
+var discovery *Discovery
+
+// Discovery 维护动态后端：worker 通过接口注册并定期发送心跳，或从文件与 DNS SRV 记录发现
+type Discovery struct {
+	pool      *Pool
+	cfg       DiscoveryConfig
+	fileState string // 上次读取时后端列表文件的修改时间与大小
+}
+
+// NewDiscovery 创建动态后端管理器
+func NewDiscovery(pool *Pool, cfg DiscoveryConfig) *Discovery {
+	defaults := DefaultConfig().Pool.Discovery
+	if cfg.HeartbeatTTL <= 0 {
+		cfg.HeartbeatTTL = defaults.HeartbeatTTL
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaults.Interval
+	}
+	return &Discovery{pool: pool, cfg: cfg}
+}
+
+// Register 注册 worker，已注册的同名 worker 视为一次心跳
+func (d *Discovery) Register(cfg BackendConfig) (*Backend, error) {
+	backend, err := d.pool.Add(cfg, SourceAPI)
+	if err != nil {
+		return nil, err
+	}
+	backend.touch()
+	return backend, nil
+}
+
+// Heartbeat 记录 worker 的心跳
+func (d *Discovery) Heartbeat(name string) (*Backend, error) {
+	backend, ok := d.pool.Get(name)
+	if !ok || backend.Source != SourceAPI {
+		return nil, ErrBackendNotFound
+	}
+	backend.touch()
+	return backend, nil
+}
+
+// Deregister 注销 worker
+func (d *Discovery) Deregister(name string) error {
+	backend, ok := d.pool.Get(name)
+	if !ok || backend.Source != SourceAPI {
+		return ErrBackendNotFound
+	}
+	return d.pool.Remove(name)
+}
+
+// Start 立即检查一次后端列表文件与 SRV 记录，之后在后台按间隔检查并移除心跳超时的 worker，直到 ctx 结束
+func (d *Discovery) Start(ctx context.Context) {
+	d.discover()
+	go d.run(ctx)
+}
+
+func (d *Discovery) run(ctx context.Context) {
+	ttl := time.Duration(d.cfg.HeartbeatTTL)
+	sweep := time.NewTicker(ttl / 3)
+	defer sweep.Stop()
+	poll := time.NewTicker(time.Duration(d.cfg.Interval))
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-sweep.C:
+			d.expire(ttl)
+		case <-poll.C:
+			d.discover()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expire 移除超过 ttl 没有心跳的 worker
+func (d *Discovery) expire(ttl time.Duration) {
+	for _, backend := range d.pool.Backends() {
+		// 心跳时间为零表示刚由 Register 加入、尚未记录心跳
+		heartbeat := backend.lastHeartbeat()
+		if backend.Source == SourceAPI && !heartbeat.IsZero() && heartbeat.Before(time.Now().Add(-ttl)) {
+			log.Printf("backend %s: no heartbeat for %s", backend.Name, ttl)
+			_ = d.pool.Remove(backend.Name)
+		}
+	}
+}
+
+// discover 检查后端列表文件与 SRV 记录
+func (d *Discovery) discover() {
+	if d.cfg.File != "" {
+		info, err := os.Stat(d.cfg.File)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// 文件被删除时移除其中的后端
+			if d.fileState != "" {
+				d.pool.Sync(SourceFile, nil)
+				d.fileState = ""
+			}
+		case err != nil:
+			log.Printf("discovery file: %v", err)
+		default:
+			state := fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+			if state != d.fileState {
+				if cfgs, err := readBackendFile(d.cfg.File); err != nil {
+					log.Printf("discovery file: %v", err)
+				} else {
+					d.pool.Sync(SourceFile, cfgs)
+					d.fileState = state
+				}
+			}
+		}
+	}
+
+	if d.cfg.SRV != "" {
+		if cfgs, err := lookupBackends(d.cfg.SRV); err != nil {
+			// 查询失败时保留现有后端，避免 DNS 短暂故障清空后端池
+			log.Printf("discovery srv: %v", err)
+		} else {
+			d.pool.Sync(SourceSRV, cfgs)
+		}
+	}
+}
+
+// readBackendFile 读取后端列表文件，内容为后端数组或 {"backends": [...]}
+func readBackendFile(path string) ([]BackendConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []BackendConfig
+	if err := json.Unmarshal(data, &cfgs); err == nil {
+		return cfgs, nil
+	}
+	var wrapped struct {
+		Backends []BackendConfig `json:"backends"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return wrapped.Backends, nil
+}
+
+// lookupBackends 通过本机解析器查询 SRV 记录，每条记录对应一个后端
+func lookupBackends(name string) ([]BackendConfig, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	cfgs := make([]BackendConfig, 0, len(records))
+	for _, record := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), fmt.Sprint(record.Port))
+		weight := int(record.Weight)
+		cfgs = append(cfgs, BackendConfig{Name: host, URL: "http://" + host, Weight: weight})
+	}
+	return cfgs, nil
+}
+
+// touch 记录一次心跳
+func (b *Backend) touch() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.heartbeat = time.Now()
+}
+
+func (b *Backend) lastHeartbeat() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.heartbeat
+}
+
+// workerResponse 是注册与心跳接口的响应
+type workerResponse struct {
+	BackendStatus
+	HeartbeatTTL Duration `json:"heartbeat_ttl"` // worker 需要在该时间内发送下一次心跳
+}
+
+// registerWorker 注册 worker 的 ComfyUI 地址、能力与标签
+func registerWorker(c *gin.Context) {
+	var cfg BackendConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if cfg.Name == "" || cfg.URL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and url are required"})
+		return
+	}
+	backend, err := discovery.Register(cfg)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, workerResponse{backend.Status(), discovery.cfg.HeartbeatTTL})
+}
+
+// workerHeartbeat 记录 worker 的心跳，worker 未注册时返回 404，需要重新注册
+func workerHeartbeat(c *gin.Context) {
+	backend, err := discovery.Heartbeat(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, workerResponse{backend.Status(), discovery.cfg.HeartbeatTTL})
+}
+
+// deregisterWorker 注销 worker，其上的任务会被重新调度
+func deregisterWorker(c *gin.Context) {
+	if err := discovery.Deregister(c.Param("name")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
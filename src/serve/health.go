@@ -0,0 +1,227 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/gorilla/websocket"
+)
+
+// BreakerState 是后端熔断器的状态
+type BreakerState string
+
+// 熔断器状态
+const (
+	BreakerClosed   BreakerState = "closed"    // 正常接收任务
+	BreakerOpen     BreakerState = "open"      // 连续失败后被摘除
+	BreakerHalfOpen BreakerState = "half_open" // 冷却结束，等待恢复探测
+)
+
+// BackendStatus 是后端健康状况的快照
+type BackendStatus struct {
+	Name         string            `json:"name"`
+	URL          string            `json:"url"`
+	Weight       int               `json:"weight"`
+	Source       string            `json:"source"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+	Heartbeat    *time.Time        `json:"last_heartbeat,omitempty"`
+
+	State     BreakerState         `json:"state"`
+	Draining  bool                 `json:"draining"`
+	Inflight  int                  `json:"inflight"`
+	Failures  int                  `json:"failures"`
+	LastError string               `json:"last_error,omitempty"`
+	Suspect   string               `json:"suspect,omitempty"` // 执行超时后不再分配任务，直到其队列清空
+	LastProbe *time.Time           `json:"last_probe,omitempty"`
+	Stats     *comfyui.SystemStats `json:"stats,omitempty"`
+	NodeTypes int                  `json:"node_types"`                     // 已安装的节点类型数
+	CatalogAt *time.Time           `json:"catalog_refreshed_at,omitempty"` // 最近一次获取 /object_info 的时间
+}
+
+// Available 判断后端是否可以接收新任务
+func (b *Backend) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.breaker == BreakerClosed && !b.draining && b.suspect == ""
+}
+
+// SetDraining 设置排空模式：排空中的后端不再接收新任务，已提交的任务继续执行
+func (b *Backend) SetDraining(draining bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.draining = draining
+}
+
+// Status 返回后端健康状况
+func (b *Backend) Status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BackendStatus{
+		Name:         b.Name,
+		URL:          "http://" + b.client.Address,
+		Weight:       b.Weight,
+		Source:       b.Source,
+		Labels:       b.Labels,
+		Capabilities: b.Capabilities,
+		State:        b.breaker,
+		Draining:     b.draining,
+		Inflight:     b.inflight,
+		Failures:     b.failures,
+		LastError:    b.lastError,
+		Suspect:      b.suspect,
+		Stats:        b.stats,
+	}
+	if !b.lastProbe.IsZero() {
+		lastProbe := b.lastProbe
+		status.LastProbe = &lastProbe
+	}
+	if !b.heartbeat.IsZero() {
+		heartbeat := b.heartbeat
+		status.Heartbeat = &heartbeat
+	}
+	if b.catalog != nil {
+		catalogAt := b.catalog.fetchedAt
+		status.NodeTypes = len(b.catalog.classes)
+		status.CatalogAt = &catalogAt
+	}
+	return status
+}
+
+// recordSuccess 记录一次成功，关闭熔断器
+func (b *Backend) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.breaker != BreakerClosed {
+		log.Printf("backend %s: recovered", b.Name)
+	}
+	b.breaker = BreakerClosed
+	b.failures = 0
+	b.lastError = ""
+}
+
+// recordFailure 记录一次失败，连续失败达到阈值或恢复探测失败时打开熔断器
+func (b *Backend) recordFailure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+
+	if b.breaker == BreakerHalfOpen || (b.breaker == BreakerClosed && b.failures >= b.health.FailureThreshold) {
+		if b.breaker == BreakerClosed {
+			log.Printf("backend %s: ejected after %d failures: %v", b.Name, b.failures, err)
+		}
+		b.breaker = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// isBackendFailure 判断错误是否由后端故障引起，提示本身无效导致的 4xx 不计入
+func isBackendFailure(err error) bool {
+	var statusErr *comfyui.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+	return err != nil
+}
+
+// probeLoop 定期探测后端健康状况，直到 ctx 结束
+func (b *Backend) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(b.health.Interval))
+	defer ticker.Stop()
+
+	for {
+		b.mu.Lock()
+		if b.breaker == BreakerOpen && time.Since(b.openedAt) >= time.Duration(b.health.OpenDuration) {
+			b.breaker = BreakerHalfOpen
+		}
+		skip := b.breaker == BreakerOpen
+		b.mu.Unlock()
+
+		if !skip {
+			if err := b.probe(); err != nil {
+				b.recordFailure(err)
+			} else {
+				b.recordSuccess()
+				b.checkSuspect()
+				b.refreshCatalog()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe 检查 /system_stats 与事件连接的 WebSocket ping，并记录 /queue 的长度供 least_queue 调度使用
+func (b *Backend) probe() error {
+	client := b.timedClient(b.probeClient)
+	stats, err := client.GetSystemStats()
+	queued := -1
+	if err == nil {
+		if queue, err := client.GetQueue(); err == nil {
+			queued = len(queue.Running) + len(queue.Pending)
+		}
+	}
+
+	b.mu.Lock()
+	b.lastProbe = time.Now()
+	b.queued = queued
+	if err == nil {
+		b.stats = stats
+	}
+	ws, lastPing, lastPong := b.ws, b.lastPing, b.lastPong
+	b.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("system_stats probe failed: %w", err)
+	}
+	if ws == nil {
+		return errors.New("event connection is down")
+	}
+	// 上一轮发出的 ping 应已在超时内收到 pong
+	if lastPing.After(lastPong) && time.Since(lastPing) > time.Duration(b.health.Timeout) {
+		return errors.New("websocket ping timed out")
+	}
+	// 先记录发送时间，pong 可能在 WriteControl 返回前就已到达
+	b.mu.Lock()
+	b.lastPing = time.Now()
+	b.mu.Unlock()
+	deadline := time.Now().Add(time.Duration(b.health.Timeout))
+	if err := ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+		return fmt.Errorf("websocket ping failed: %w", err)
+	}
+	return nil
+}
+
+// QueueDepth 返回最近一次探测得到的 ComfyUI 队列长度（执行中与等待中的提示），未知时返回 -1
+func (b *Backend) QueueDepth() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.queued
+}
+
+// setConn 记录当前事件连接，供 ping 探测使用
+func (b *Backend) setConn(ws *websocket.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ws = ws
+	b.lastPing = time.Time{}
+	b.lastPong = time.Now()
+	if ws == nil {
+		return
+	}
+	ws.SetPongHandler(func(string) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.lastPong = time.Now()
+		return nil
+	})
+}
@@ -0,0 +1,77 @@
+package serve
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/fimreal/comfyui-api/src/infotext"
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+	"github.com/gin-gonic/gin"
+)
+
+// importRequest 是以 JSON 导入 A1111 参数的请求体
+type importRequest struct {
+	Parameters     string `json:"parameters" binding:"required"` // infotext 文本
+	Checkpoint     string `json:"checkpoint"`                    // ckpt_name，为空时由参数中的 Model 推断
+	FilenamePrefix string `json:"filename_prefix"`
+}
+
+// importResponse 是导入的结果
+type importResponse struct {
+	Workflow   comfyui.Prompt       `json:"workflow"` // 可作为 /api/jobs 的 workflow 提交
+	Parameters *infotext.Parameters `json:"parameters"`
+	Warnings   []string             `json:"warnings"` // 未能转换的参数
+}
+
+// importA1111 将 A1111 / Forge 的生成参数转换为 ComfyUI 工作流。
+// 请求体可以是 JSON（{"parameters": "..."}）、纯文本的 infotext，或带 parameters 文本块的 PNG（请求体或 multipart 的 image 字段）。
+func importA1111(c *gin.Context) {
+	req := importRequest{Checkpoint: c.Query("checkpoint"), FilenamePrefix: c.Query("filename_prefix")}
+	switch {
+	case c.ContentType() == "application/json":
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	default:
+		data, err := readUpload(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if strings.HasPrefix(c.ContentType(), "text/") {
+			req.Parameters = string(data)
+			break
+		}
+		text, err := pngmeta.Text(data)
+		if errors.Is(err, pngmeta.ErrNotPNG) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Parameters = text[pngmeta.KeyParameters]; req.Parameters == "" {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "image has no parameters text chunk"})
+			return
+		}
+	}
+
+	params, err := infotext.Parse(req.Parameters)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	workflow, warnings, err := params.Workflow(infotext.Options{Checkpoint: req.Checkpoint, FilenamePrefix: req.FilenamePrefix})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if warnings == nil {
+		warnings = []string{}
+	}
+	c.JSON(http.StatusOK, importResponse{Workflow: workflow, Parameters: params, Warnings: warnings})
+}
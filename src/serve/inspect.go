@@ -0,0 +1,136 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+	"github.com/fimreal/comfyui-api/src/provenance"
+	"github.com/gin-gonic/gin"
+)
+
+// 上传检查的图片的最大大小
+const maxInspectSize = 64 << 20
+
+// 下载输出时对 PNG 元数据的处理
+const (
+	MetadataKeep  = "keep"  // 保持 ComfyUI 写入的元数据（默认）
+	MetadataStrip = "strip" // 删除 prompt、workflow、任务信息与来源签名
+	MetadataJob   = "job"   // 写入本服务的任务信息与实际执行的提示
+)
+
+// inspectResponse 是检查图片的结果
+type inspectResponse struct {
+	Prompt   *comfyui.Prompt   `json:"prompt"`   // API 格式的工作流，可作为 /api/jobs 的 workflow 重新提交
+	Workflow json.RawMessage   `json:"workflow"` // 界面格式的工作流
+	Job      *pngmeta.Job      `json:"job,omitempty"`
+	Text     map[string]string `json:"text,omitempty"` // 其他文本块
+}
+
+// inspectImage 读取上传的 PNG 中嵌入的工作流。图片可以是 multipart 表单的 image 字段，也可以是整个请求体。
+func inspectImage(c *gin.Context) {
+	data, err := readUpload(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	meta, err := pngmeta.Extract(data)
+	switch {
+	case errors.Is(err, pngmeta.ErrNotPNG):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	case meta.Prompt == nil && meta.Workflow == nil && meta.Job == nil:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "image has no embedded prompt, workflow or job metadata"})
+		return
+	}
+	resp := inspectResponse{Prompt: meta.Prompt, Workflow: meta.Workflow, Job: meta.Job}
+	if len(meta.Text) > 0 {
+		resp.Text = meta.Text
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// readUpload 读取上传的文件：multipart 表单的 image 字段，或整个请求体
+func readUpload(c *gin.Context) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxInspectSize)
+	if !strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image: %w", err)
+		}
+		return data, nil
+	}
+	file, _, err := c.Request.FormFile("image")
+	if err != nil {
+		return nil, fmt.Errorf("missing image file: %w", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	return data, nil
+}
+
+// validMetadataMode 校验下载输出时的元数据处理方式，空值视为 keep
+func validMetadataMode(mode string) error {
+	switch mode {
+	case "", MetadataKeep, MetadataStrip, MetadataJob:
+		return nil
+	default:
+		return fmt.Errorf("invalid metadata %q, expected keep, strip or job", mode)
+	}
+}
+
+// applyMetadata 按处理方式修改 PNG 输出的元数据，其他格式原样返回
+func (m *JobManager) applyMetadata(job *Job, index int, data []byte, contentType, mode string) ([]byte, error) {
+	if contentType != "image/png" {
+		return data, nil
+	}
+	switch mode {
+	case MetadataStrip:
+		return pngmeta.Strip(data, pngmeta.KeyPrompt, pngmeta.KeyWorkflow, pngmeta.KeyJob, provenance.KeyProvenance)
+	case MetadataJob:
+		return pngmeta.Inject(data, m.jobMetadata(job, index))
+	default:
+		return data, nil
+	}
+}
+
+// jobMetadata 返回写入输出的任务信息与实际执行的提示，批量任务的输出使用产生它的子任务的提示与种子
+func (m *JobManager) jobMetadata(job *Job, index int) *pngmeta.Metadata {
+	status := job.Status()
+	source := job
+	for _, item := range status.Items {
+		for _, n := range item.Outputs {
+			if n == index {
+				if child, err := m.Get(item.JobID); err == nil {
+					source = child
+				}
+			}
+		}
+	}
+	info := &pngmeta.Job{
+		JobID:      status.ID,
+		Template:   status.Template,
+		PromptHash: status.PromptHash,
+		CreatedAt:  status.CreatedAt,
+	}
+	if status.FinishedAt != nil {
+		info.FinishedAt = *status.FinishedAt
+	}
+	for _, seed := range promptSeeds(source.id, source.spec.Prompt) {
+		info.Seeds = append(info.Seeds, seed.Seed)
+	}
+	prompt := source.spec.Prompt
+	return &pngmeta.Metadata{Prompt: &prompt, Job: info}
+}
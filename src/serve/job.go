@@ -0,0 +1,1113 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/fimreal/comfyui-api/src/provenance"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// JobState 表示任务所处的状态
+type JobState string
+
+// 任务状态
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Terminal 判断状态是否为终态
+func (s JobState) Terminal() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+var (
+	// ErrJobNotFound 表示任务不存在
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished 表示任务已结束，无法取消
+	ErrJobFinished = errors.New("job already finished")
+	// ErrOutputNotFound 表示任务输出不存在
+	ErrOutputNotFound = errors.New("output not found")
+
+	errInterrupted = errors.New("execution interrupted")
+	errBackendGone = errors.New("backend removed from pool")
+)
+
+// Progress 是任务当前的执行进度
+type Progress struct {
+	Node  string `json:"node,omitempty"`
+	Value int    `json:"value"`
+	Max   int    `json:"max"`
+}
+
+// JobOutput 是任务输出文件的引用
+type JobOutput struct {
+	Index       int    `json:"index"`
+	NodeID      string `json:"node_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	URL         string `json:"url"`                 // 下载地址，S3 存储为预签名 URL
+	Key         string `json:"key,omitempty"`       // 在输出存储中的键
+	SHA256      string `json:"sha256,omitempty"`    // 内容哈希，可通过 /api/blobs/{sha256} 下载
+	Thumbnail   string `json:"thumbnail,omitempty"` // 缩略图的下载地址
+
+	Provenance *provenance.Signature `json:"provenance,omitempty"` // 来源签名，配置了签名私钥时生成
+
+	ref     comfyui.ImageRef
+	backend *Backend // 产生该输出的后端，批量任务的输出来自不同后端
+	data    []byte
+}
+
+// JobStatus 是任务状态的只读快照
+type JobStatus struct {
+	ID         string          `json:"id"`
+	State      JobState        `json:"state"`
+	Priority   string          `json:"priority"`
+	Tenant     string          `json:"tenant"`
+	Template   string          `json:"template,omitempty"`
+	Version    string          `json:"template_version,omitempty"`
+	Progress   Progress        `json:"progress"`
+	Position   *int            `json:"queue_position,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	ErrorClass string          `json:"error_class,omitempty"`        // 失败的错误类别，如 disconnect、oom
+	Retries    int             `json:"retries,omitempty"`            // 按重试策略重新执行的次数
+	DeadLetter bool            `json:"dead_letter,omitempty"`        // 重试耗尽后进入死信队列
+	DeadReason string          `json:"dead_letter_reason,omitempty"` // 进入死信队列的原因，如 retries_exhausted、not_retryable
+	RequeuedAs string          `json:"requeued_as,omitempty"`        // 从死信队列重新提交后的新任务 ID
+	ParentID   string          `json:"parent_id,omitempty"`          // 所属的批量任务
+	Items      []BatchItem     `json:"items,omitempty"`              // 批量任务的子任务
+	Failovers  int             `json:"failovers,omitempty"`          // 超时后换后端重新提交的次数
+	Pinned     bool            `json:"pinned,omitempty"`             // 置顶的任务不会被回收
+	PromptHash string          `json:"prompt_hash,omitempty"`        // 规范化提示的哈希，用于结果缓存
+	CachedFrom string          `json:"cached_from,omitempty"`        // 命中缓存时输出所来自的任务
+	Outputs    []JobOutput     `json:"outputs"`
+	History    []JobTransition `json:"history"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// JobTimings 是任务各阶段的时间
+type JobTimings struct {
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	QueueMs    int64     `json:"queue_ms"`
+	RunMs      int64     `json:"run_ms"`
+	TotalMs    int64     `json:"total_ms"`
+}
+
+// Timings 返回任务的排队、执行与总耗时，任务未开始执行或未结束时只有创建时间
+func (s JobStatus) Timings() JobTimings {
+	timings := JobTimings{CreatedAt: s.CreatedAt}
+	if s.StartedAt != nil && s.FinishedAt != nil {
+		timings.StartedAt = *s.StartedAt
+		timings.FinishedAt = *s.FinishedAt
+		timings.QueueMs = s.StartedAt.Sub(s.CreatedAt).Milliseconds()
+		timings.RunMs = s.FinishedAt.Sub(*s.StartedAt).Milliseconds()
+		timings.TotalMs = s.FinishedAt.Sub(s.CreatedAt).Milliseconds()
+	}
+	return timings
+}
+
+// JobSpec 描述要提交的任务
+type JobSpec struct {
+	Prompt      comfyui.Prompt // API 格式的工作流
+	CallbackURL string         // 任务结束时接收回调的地址，可为空
+	Priority    string         // interactive、normal 或 bulk，为空时为 normal
+	Tenant      string         // 提交任务的租户，用于公平调度
+	Batch       *BatchOptions  // 不为空时拆分为子任务执行
+	ParentID    string         // 子任务所属的批量任务
+	Exclude     []string       // 调度时避开的后端，用于换后端重试
+	Tile        *TileOptions   // 不为空时将输入图像分块，由子任务分别处理后拼接
+	Uploads     []Upload       // 提交前上传到所分配后端的图像
+	Timeout     Duration       // 任务开始执行后的最长时间，为 0 时使用配置
+	Template    string         // 工作流模板名称，用于选择重试策略
+	Version     string         // 工作流模板版本，记录在来源签名中
+	Cache       string         // 结果缓存模式：bypass、prefer 或 only，为空时为 prefer
+}
+
+// Job 是提交到 ComfyUI 的一次工作流执行
+type Job struct {
+	mu         sync.Mutex
+	id         string
+	state      JobState
+	progress   Progress
+	position   int
+	err        string
+	outputs    []JobOutput
+	history    []JobTransition
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	events     []JobEvent
+	seq        int64
+	changed    chan struct{}
+	items      []BatchItem // 批量任务的子任务
+	failovers  int         // 超时后换后端重新提交的次数
+	retries    int         // 按重试策略重新执行的次数
+	errClass   string      // 失败的错误类别
+	dead       bool        // 是否在死信队列中
+	deadReason string      // 进入死信队列的原因
+	requeuedAs string      // 从死信队列重新提交后的新任务
+	pinned     bool        // 置顶的任务不会被回收
+	promptHash string      // 规范化提示的哈希，批量与分块任务为空
+	cachedFrom string      // 命中缓存时输出所来自的任务
+	tileSource image.Image // 分块放大任务解码后的输入图像，全部分块子任务创建后释放
+
+	spec     JobSpec
+	storage  Storage
+	backend  *Backend
+	promptID string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// ID 返回任务 ID
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Done 返回任务结束时关闭的通道
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Status 返回任务状态快照
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := JobStatus{
+		ID:         j.id,
+		State:      j.state,
+		Priority:   j.spec.Priority,
+		Tenant:     j.spec.Tenant,
+		Template:   j.spec.Template,
+		Version:    j.spec.Version,
+		Progress:   j.progress,
+		Error:      j.err,
+		ParentID:   j.spec.ParentID,
+		Items:      append([]BatchItem(nil), j.items...),
+		Failovers:  j.failovers,
+		ErrorClass: j.errClass,
+		Retries:    j.retries,
+		DeadLetter: j.dead,
+		DeadReason: j.deadReason,
+		RequeuedAs: j.requeuedAs,
+		Pinned:     j.pinned,
+		PromptHash: j.promptHash,
+		CachedFrom: j.cachedFrom,
+		Outputs:    append([]JobOutput{}, j.outputs...),
+		History:    append([]JobTransition{}, j.history...),
+		CreatedAt:  j.createdAt,
+	}
+	if j.state == JobQueued && j.position >= 0 {
+		position := j.position
+		status.Position = &position
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		status.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	for i, output := range status.Outputs {
+		if output.Key == "" || j.storage == nil {
+			continue
+		}
+		if url := j.storage.URL(output.Key); url != "" {
+			status.Outputs[i].URL = url
+		}
+	}
+	return status
+}
+
+// Output 返回第 n 个输出及其内容，内容从输出存储读取，未存入存储的旧任务从 ComfyUI 重新下载
+func (j *Job) Output(n int) (JobOutput, []byte, error) {
+	j.mu.Lock()
+	if n < 0 || n >= len(j.outputs) {
+		j.mu.Unlock()
+		return JobOutput{}, nil, ErrOutputNotFound
+	}
+	output := j.outputs[n]
+	j.mu.Unlock()
+
+	if output.data != nil {
+		return output, output.data, nil
+	}
+	if output.Key != "" && j.storage != nil {
+		data, err := j.storage.Get(context.Background(), output.Key)
+		if errors.Is(err, ErrObjectNotFound) {
+			return output, nil, ErrOutputNotFound
+		}
+		if err != nil {
+			return output, nil, fmt.Errorf("failed to read output from storage: %w", err)
+		}
+		return output, data, nil
+	}
+	backend := output.backend
+	if backend == nil {
+		backend = j.getBackend()
+	}
+	if backend == nil {
+		return output, nil, ErrOutputNotFound
+	}
+	data, err := backend.client.GetImage(output.ref.Filename, output.ref.Subfolder, output.ref.Type)
+	if err != nil {
+		return output, nil, fmt.Errorf("failed to fetch output from backend: %w", err)
+	}
+	return output, data, nil
+}
+
+func (j *Job) getBackend() *Backend {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.backend
+}
+
+func (j *Job) setBackend(backend *Backend) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.backend = backend
+}
+
+func (j *Job) getPromptID() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.promptID
+}
+
+func (j *Job) setPromptID(promptID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.promptID = promptID
+}
+
+// transitionLocked 记录状态变化，调用方需持有 j.mu
+func (j *Job) transitionLocked(state JobState, reason string) {
+	j.state = state
+	j.history = append(j.history, JobTransition{State: state, Time: time.Now(), Reason: reason})
+}
+
+func (j *Job) setPosition(position int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != JobQueued || j.position == position {
+		return
+	}
+	j.position = position
+	j.publishLocked(JobEventQueue, gin.H{"position": position})
+}
+
+// setRunning 将排队中的任务置为执行中，状态发生变化时返回 true
+func (j *Job) setRunning() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != JobQueued {
+		return false
+	}
+	j.transitionLocked(JobRunning, "")
+	j.startedAt = time.Now()
+	return true
+}
+
+func (j *Job) setNode(node string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = Progress{Node: node}
+	j.publishLocked(JobEventNode, gin.H{"node": node})
+}
+
+func (j *Job) setProgress(progress Progress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = progress
+	j.publishLocked(JobEventProgress, progress)
+}
+
+// finish 将任务置为终态
+func (j *Job) finish(state JobState, outputs []JobOutput, errMsg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.transitionLocked(state, errMsg)
+	j.outputs = outputs
+	j.err = errMsg
+	j.finishedAt = time.Now()
+	if j.startedAt.IsZero() {
+		j.startedAt = j.finishedAt
+	}
+	j.publishTerminalLocked()
+}
+
+// reschedule 在后端移出池后将任务重新置为排队中，等待调度到其他后端
+func (j *Job) reschedule(reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.backend = nil
+	j.promptID = ""
+	j.position = -1
+	j.progress = Progress{}
+	j.transitionLocked(JobQueued, reason)
+	j.publishLocked(JobEventQueue, gin.H{"position": -1, "reason": reason})
+}
+
+// failover 在任务超时后将其重新置为排队中并避开原后端，超过允许的次数时返回 false
+func (j *Job) failover(limit int, reason string) bool {
+	j.mu.Lock()
+	if j.failovers >= limit || j.backend == nil {
+		j.mu.Unlock()
+		return false
+	}
+	j.failovers++
+	j.spec.Exclude = append(j.spec.Exclude, j.backend.Name)
+	j.mu.Unlock()
+	j.reschedule(reason)
+	return true
+}
+
+// abort 在 ComfyUI 上取消任务对应的提示：执行中则中断，排队中则移出队列
+func (j *Job) abort() {
+	j.mu.Lock()
+	state, promptID, backend := j.state, j.promptID, j.backend
+	j.mu.Unlock()
+
+	if promptID == "" || backend == nil {
+		return
+	}
+	// 卡住的后端可能不再响应，不能让取消与超时处理一直等待
+	client := backend.timedClient(backend.probeClient)
+	if state == JobRunning {
+		_ = client.Interrupt()
+		return
+	}
+	_ = client.DeleteFromQueue(promptID)
+}
+
+// record 返回任务的持久化形式
+func (j *Job) record() *JobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	record := &JobRecord{
+		ID:          j.id,
+		State:       j.state,
+		Error:       j.err,
+		Prompt:      j.spec.Prompt,
+		PromptID:    j.promptID,
+		CallbackURL: j.spec.CallbackURL,
+		Priority:    j.spec.Priority,
+		Tenant:      j.spec.Tenant,
+		Batch:       j.spec.Batch,
+		ParentID:    j.spec.ParentID,
+		Exclude:     j.spec.Exclude,
+		Tile:        j.tileRecord(),
+		Uploads:     j.spec.Uploads,
+		Timeout:     j.spec.Timeout,
+		Failovers:   j.failovers,
+		Template:    j.spec.Template,
+		Version:     j.spec.Version,
+		Retries:     j.retries,
+		ErrorClass:  j.errClass,
+		DeadLetter:  j.dead,
+		DeadReason:  j.deadReason,
+		RequeuedAs:  j.requeuedAs,
+		Pinned:      j.pinned,
+		Cache:       j.spec.Cache,
+		PromptHash:  j.promptHash,
+		CachedFrom:  j.cachedFrom,
+		Seq:         j.seq,
+		Items:       append([]BatchItem(nil), j.items...),
+		History:     append([]JobTransition{}, j.history...),
+		CreatedAt:   j.createdAt,
+		StartedAt:   j.startedAt,
+		FinishedAt:  j.finishedAt,
+	}
+	if j.backend != nil {
+		record.Backend = j.backend.Name
+	}
+	for _, output := range j.outputs {
+		outputRecord := OutputRecord{JobOutput: output, Ref: output.ref}
+		if output.backend != nil {
+			outputRecord.Backend = output.backend.Name
+		}
+		record.Outputs = append(record.Outputs, outputRecord)
+	}
+	return record
+}
+
+// jobFromRecord 根据持久化记录恢复任务，backend 为空表示记录中的后端已不在池中
+func jobFromRecord(record *JobRecord, backend *Backend) *Job {
+	job := &Job{
+		id:         record.ID,
+		state:      record.State,
+		position:   -1,
+		err:        record.Error,
+		history:    record.History,
+		createdAt:  record.CreatedAt,
+		startedAt:  record.StartedAt,
+		finishedAt: record.FinishedAt,
+		spec: JobSpec{
+			Prompt:      record.Prompt,
+			CallbackURL: record.CallbackURL,
+			Priority:    record.Priority,
+			Tenant:      record.Tenant,
+			Batch:       record.Batch,
+			ParentID:    record.ParentID,
+			Exclude:     record.Exclude,
+			Tile:        record.Tile,
+			Uploads:     record.Uploads,
+			Timeout:     record.Timeout,
+			Template:    record.Template,
+			Version:     record.Version,
+			Cache:       record.Cache,
+		},
+		failovers:  record.Failovers,
+		retries:    record.Retries,
+		errClass:   record.ErrorClass,
+		dead:       record.DeadLetter,
+		deadReason: record.DeadReason,
+		requeuedAs: record.RequeuedAs,
+		pinned:     record.Pinned,
+		promptHash: record.PromptHash,
+		cachedFrom: record.CachedFrom,
+		items:      record.Items,
+		seq:        record.Seq,
+		backend:    backend,
+		promptID:   record.PromptID,
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	for _, output := range record.Outputs {
+		output.JobOutput.ref = output.Ref
+		job.outputs = append(job.outputs, output.JobOutput)
+	}
+	if job.state.Terminal() {
+		close(job.done)
+	}
+	return job
+}
+
+// JobManager 管理任务的提交、执行与查询
+type JobManager struct {
+	mu         sync.RWMutex
+	jobs       map[string]*Job
+	store      JobStore
+	storage    Storage
+	blobs      *BlobIndex
+	pool       *Pool
+	scheduler  *Scheduler
+	timeouts   TimeoutConfig
+	retry      RetryConfig
+	cache      *ResultCache
+	thumbnails ThumbnailConfig
+	signer     *provenance.Signer
+	watermarks *Watermarker
+	onFinish   []func(*Job)
+}
+
+// NewJobManager 创建任务管理器，任务保存在 store 中，经服务端队列调度到 pool 的后端上，输出保存在 storage 中
+func NewJobManager(store JobStore, storage Storage, pool *Pool, timeouts TimeoutConfig, retry RetryConfig, cache CacheConfig, thumbnails ThumbnailConfig) *JobManager {
+	return &JobManager{
+		jobs:       make(map[string]*Job),
+		store:      store,
+		storage:    storage,
+		blobs:      NewBlobIndex(storage),
+		timeouts:   timeouts,
+		retry:      retry,
+		cache:      NewResultCache(time.Duration(cache.TTL)),
+		thumbnails: thumbnails,
+		pool:       pool,
+		scheduler:  NewScheduler(pool),
+	}
+}
+
+// Run 运行任务调度，直到 ctx 结束
+func (m *JobManager) Run(ctx context.Context) {
+	m.scheduler.Run(ctx)
+}
+
+// persist 保存任务当前状态
+func (m *JobManager) persist(job *Job) {
+	if err := m.store.Save(job.record()); err != nil {
+		log.Printf("job %s: failed to persist: %v", job.id, err)
+	}
+}
+
+// Restore 从存储加载任务，并重新关联重启前仍在执行的任务
+func (m *JobManager) Restore() error {
+	records, err := m.store.List()
+	if err != nil {
+		return err
+	}
+	// 先加载全部任务再启动，批量任务恢复时需要找到其子任务
+	var pending []*Job
+	for _, record := range records {
+		backend, _ := m.pool.Get(record.Backend)
+		job := jobFromRecord(record, backend)
+		job.storage = m.storage
+		for i, output := range record.Outputs {
+			if output.Backend != "" {
+				job.outputs[i].backend, _ = m.pool.Get(output.Backend)
+			}
+			if output.SHA256 != "" {
+				m.blobs.Ref(job.id, output.SHA256, output.Size, output.ContentType)
+			}
+		}
+		m.mu.Lock()
+		m.jobs[job.id] = job
+		m.mu.Unlock()
+		m.remember(job)
+
+		job.resume()
+		if job.state.Terminal() {
+			continue
+		}
+		if backend == nil && record.Backend != "" {
+			job.reschedule(fmt.Sprintf("backend %s is no longer in the pool; rescheduled", record.Backend))
+		}
+		// 保存跳过后的 seq，再次重启时不会重复使用本次发出的 ID
+		m.persist(job)
+		pending = append(pending, job)
+	}
+	for _, job := range pending {
+		m.start(job)
+	}
+	return nil
+}
+
+// SetSigner 设置签名输出来源的签名器，需要在开始执行任务之前调用
+func (m *JobManager) SetSigner(signer *provenance.Signer) {
+	m.signer = signer
+}
+
+// SetWatermarker 设置保存输出前添加水印的处理器，需要在开始执行任务之前调用
+func (m *JobManager) SetWatermarker(watermarks *Watermarker) {
+	m.watermarks = watermarks
+}
+
+// OnFinish 注册任务进入终态后调用的函数
+func (m *JobManager) OnFinish(fn func(*Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFinish = append(m.onFinish, fn)
+}
+
+// Submit 创建任务并在后台调度到后端执行，没有后端能满足提示所需的模型与节点时拒绝
+func (m *JobManager) Submit(spec JobSpec) (*Job, error) {
+	if _, err := priorityLevel(spec.Priority); err != nil {
+		return nil, err
+	}
+	if spec.Priority == "" {
+		spec.Priority = PriorityNormal
+	}
+	if spec.Tenant == "" {
+		spec.Tenant = defaultTenant
+	}
+	if err := validCacheMode(spec.Cache); err != nil {
+		return nil, err
+	}
+	if spec.Cache == "" {
+		spec.Cache = CachePrefer
+	}
+	var items []BatchItem
+	var tileSource image.Image
+	var err error
+	switch {
+	case spec.Batch != nil && spec.Tile != nil:
+		return nil, errors.New("batch and tile cannot be combined")
+	case spec.Batch != nil:
+		items, err = expandBatch(spec.Prompt, spec.Batch)
+	case spec.Tile != nil:
+		spec.Prompt, items, tileSource, err = expandTiles(spec.Prompt, spec.Tile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 只缓存单个提示的结果，批量任务由各子任务分别缓存，带上传图像的任务输出不只取决于提示
+	var hash string
+	var source *Job
+	if items == nil && len(spec.Uploads) == 0 {
+		if hash, err = promptHash(spec.Prompt); err != nil {
+			return nil, err
+		}
+		if spec.Cache != CacheBypass {
+			source = m.cached(spec, hash)
+		}
+	}
+	if source == nil && spec.Cache == CacheOnly {
+		return nil, ErrCacheMiss
+	}
+	if source == nil {
+		if err := m.pool.Check(spec.Prompt); err != nil {
+			return nil, err
+		}
+	}
+
+	job := &Job{
+		id:         uuid.New().String(),
+		state:      JobQueued,
+		position:   -1,
+		createdAt:  time.Now(),
+		spec:       spec,
+		storage:    m.storage,
+		items:      items,
+		tileSource: tileSource,
+		promptHash: hash,
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	job.history = []JobTransition{{State: JobQueued, Time: job.createdAt}}
+
+	m.mu.Lock()
+	m.jobs[job.id] = job
+	m.mu.Unlock()
+
+	if source != nil {
+		m.completeFromCache(job, source)
+		return job, nil
+	}
+	m.persist(job)
+	m.start(job)
+	return job, nil
+}
+
+// start 在后台执行任务
+func (m *JobManager) start(job *Job) {
+	go m.run(job.ctx, job)
+}
+
+// Get 根据 ID 查找任务
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// GetForTenant 查找属于 tenant 的任务，其他租户的任务视为不存在
+func (m *JobManager) GetForTenant(id, tenant string) (*Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.spec.Tenant != tenant {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// List 返回全部任务的状态，按创建时间排序
+func (m *JobManager) List() []JobStatus {
+	m.mu.RLock()
+	statuses := make([]JobStatus, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		statuses = append(statuses, job.Status())
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, k int) bool {
+		return statuses[i].CreatedAt.Before(statuses[k].CreatedAt)
+	})
+	return statuses
+}
+
+// Cancel 取消任务
+func (m *JobManager) Cancel(id string) error {
+	job, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if job.Status().State.Terminal() {
+		return ErrJobFinished
+	}
+	job.cancel()
+	return nil
+}
+
+// run 执行任务并记录最终状态
+func (m *JobManager) run(ctx context.Context, job *Job) {
+	defer close(job.done)
+	defer job.cancel()
+
+	outputs, err := m.execute(ctx, job)
+	for err != nil && ctx.Err() == nil && m.retryJob(ctx, job, err) {
+		outputs, err = m.execute(ctx, job)
+	}
+	var partial *partialError
+	if err == nil || errors.As(err, &partial) {
+		if storeErr := m.storeOutputs(ctx, job, outputs); storeErr != nil {
+			err = storeErr
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		job.finish(JobCancelled, nil, "")
+	case errors.Is(err, errInterrupted):
+		job.finish(JobCancelled, nil, err.Error())
+	case errors.As(err, &partial):
+		job.finish(JobSucceeded, outputs, err.Error())
+	case err != nil:
+		job.finish(JobFailed, nil, err.Error())
+		// 子任务的失败由批量任务处理，不单独进入死信队列
+		if job.spec.ParentID == "" {
+			job.mu.Lock()
+			job.dead = true
+			switch {
+			case job.items != nil:
+				job.deadReason = DeadLetterItemsFailed
+			case job.deadReason == "":
+				// 重试之外的失败，如保存输出出错
+				job.deadReason = DeadLetterNotRetryable
+			}
+			job.mu.Unlock()
+		}
+	default:
+		job.finish(JobSucceeded, outputs, "")
+		m.remember(job)
+	}
+	m.persist(job)
+	m.finished(job)
+}
+
+// storeOutputs 按内容哈希将输出存入输出存储，内容不再保留在内存中。
+// 存储中已有的内容（重复的输出、批量任务合并的子任务输出）只增加引用。
+func (m *JobManager) storeOutputs(ctx context.Context, job *Job, outputs []JobOutput) error {
+	for i := range outputs {
+		output := &outputs[i]
+		if output.SHA256 != "" {
+			m.blobs.Ref(job.id, output.SHA256, output.Size, output.ContentType)
+			continue
+		}
+		var sum string
+		var err error
+		if m.watermarks != nil {
+			err = m.watermark(job, output)
+		}
+		// 签名添加水印后的内容
+		if err == nil && m.signer != nil {
+			err = m.sign(job, output)
+		}
+		if err == nil {
+			sum, err = m.blobs.Add(ctx, job.id, output.data, output.ContentType)
+		}
+		if err != nil {
+			// 任务将失败且不带输出，释放已经增加的引用
+			for _, stored := range outputs[:i] {
+				_ = m.blobs.Release(context.Background(), job.id, stored.SHA256)
+			}
+			return fmt.Errorf("failed to store output %d: %w", output.Index, err)
+		}
+		output.SHA256 = sum
+		output.Key = blobKey(sum)
+		output.Thumbnail = m.thumbnail(ctx, *output)
+		output.data = nil
+	}
+	return nil
+}
+
+// finished 调用任务结束时的回调函数
+func (m *JobManager) finished(job *Job) {
+	m.mu.RLock()
+	hooks := m.onFinish
+	m.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(job)
+	}
+}
+
+// execute 执行任务，执行中的后端被移出池时重新调度到其他后端
+func (m *JobManager) execute(ctx context.Context, job *Job) ([]JobOutput, error) {
+	if job.items != nil {
+		return m.executeBatch(ctx, job)
+	}
+	for {
+		backend := job.getBackend()
+		if backend == nil {
+			var err error
+			if backend, err = m.scheduler.Wait(ctx, job); err != nil {
+				return nil, err
+			}
+			job.setBackend(backend)
+			m.persist(job)
+		} else {
+			// 重启后重新关联的任务已在后端上，不经过队列
+			backend.acquire()
+		}
+
+		outputs, err := m.attempt(ctx, job, backend)
+		backend.release()
+		var timeout *TimeoutError
+		switch {
+		case ctx.Err() != nil:
+			return outputs, err
+		case errors.Is(err, errBackendGone):
+			job.reschedule(fmt.Sprintf("backend %s removed from pool; rescheduled", backend.Name))
+		case errors.As(err, &timeout):
+			if !job.failover(m.timeouts.Failover, fmt.Sprintf("%v on backend %s; resubmitted", err, backend.Name)) {
+				return nil, fmt.Errorf("%w on backend %s", err, backend.Name)
+			}
+		default:
+			return outputs, err
+		}
+		m.persist(job)
+	}
+}
+
+// attempt 将任务提交到已分配的后端，跟踪执行事件并下载输出
+func (m *JobManager) attempt(ctx context.Context, job *Job, backend *Backend) ([]JobOutput, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	select {
+	case <-backend.Gone():
+		return nil, errBackendGone
+	default:
+	}
+
+	promptID := job.getPromptID()
+	if promptID == "" {
+		prompt, err := preparePrompt(backend, job.spec)
+		if err != nil {
+			if isBackendFailure(err) {
+				backend.recordFailure(err)
+			}
+			return nil, backendGone(backend, err)
+		}
+		result, err := backend.client.QueuePrompt(prompt)
+		if err != nil {
+			if isBackendFailure(err) {
+				backend.recordFailure(err)
+			}
+			return nil, backendGone(backend, fmt.Errorf("failed to queue prompt: %w", err))
+		}
+		promptID = result["prompt_id"].(string)
+		job.setPromptID(promptID)
+		m.persist(job)
+	}
+
+	events, unsubscribe := backend.Subscribe(promptID)
+	defer unsubscribe()
+	defer backend.forget(promptID)
+
+	// 重启后重新关联时，提示可能已在此期间结束
+	finished, err := m.checkPrompt(job, promptID)
+	if err != nil {
+		return nil, backendGone(backend, err)
+	}
+	if !finished {
+		m.refreshPosition(job, promptID)
+		if err := m.watch(ctx, events, job, promptID); err != nil {
+			var timeout *TimeoutError
+			if ctx.Err() != nil {
+				job.abort()
+			} else if errors.As(err, &timeout) {
+				// 中断卡住的提示，并在其恢复前不再向该后端分配任务
+				job.abort()
+				backend.markSuspect(err)
+			}
+			return nil, err
+		}
+	}
+	outputs, err := m.collect(job, promptID)
+	return outputs, backendGone(backend, err)
+}
+
+// backendGone 在出错且后端已被移出池时返回 errBackendGone，否则原样返回 err
+func backendGone(backend *Backend, err error) error {
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-backend.Gone():
+		return errBackendGone
+	default:
+		return err
+	}
+}
+
+// checkPrompt 检查提示在 ComfyUI 上的状态，返回提示是否已执行完毕
+func (m *JobManager) checkPrompt(job *Job, promptID string) (bool, error) {
+	client := job.getBackend().client
+	status, err := client.GetHistoryStatus(promptID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check history: %w", err)
+	}
+	if status != nil {
+		if data := status.ExecutionError(); data != nil {
+			return false, &ExecutionError{*data}
+		}
+		if msg := status.Error(); msg != "" {
+			return false, errors.New(msg)
+		}
+		return true, nil
+	}
+
+	queue, err := client.GetQueue()
+	if err != nil {
+		return false, fmt.Errorf("failed to check queue: %w", err)
+	}
+	if queue.Position(promptID) < 0 {
+		// 提示刚执行完毕但尚未写入历史记录时也会出现在这里，再检查一次历史记录
+		if status, err := client.GetHistoryStatus(promptID); err == nil && status != nil {
+			return m.checkPrompt(job, promptID)
+		}
+		return false, errors.New("prompt no longer exists on backend")
+	}
+	return false, nil
+}
+
+// collect 从历史记录获取输出并下载
+func (m *JobManager) collect(job *Job, promptID string) ([]JobOutput, error) {
+	backend := job.getBackend()
+	client := backend.client
+	refs, err := client.GetOutputImages(promptID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+
+	outputs := make([]JobOutput, 0, len(refs))
+	for i, ref := range refs {
+		data, err := client.GetImage(ref.Filename, ref.Subfolder, ref.Type)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image %s: %w", ref.Filename, err)
+		}
+		outputs = append(outputs, JobOutput{
+			Index:       i,
+			NodeID:      ref.NodeID,
+			Filename:    ref.Filename,
+			ContentType: http.DetectContentType(data),
+			Size:        len(data),
+			URL:         fmt.Sprintf("/api/jobs/%s/outputs/%d", job.id, i),
+			ref:         ref,
+			backend:     backend,
+			data:        data,
+		})
+	}
+	return outputs, nil
+}
+
+// watch 处理后端分发的事件并更新任务状态，直到提示执行结束
+func (m *JobManager) watch(ctx context.Context, events <-chan *comfyui.Event, job *Job, promptID string) error {
+	gone := job.getBackend().Gone()
+	monitor := newWatchdog(m.timeouts, job.spec.Timeout)
+	if job.Status().State == JobRunning {
+		// 重启后重新关联的任务从现在开始计时
+		monitor.event(time.Now())
+	}
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		var event *comfyui.Event
+		select {
+		case event = <-events:
+		case now := <-ticker.C:
+			if err := monitor.check(now); err != nil {
+				return err
+			}
+			continue
+		case <-gone:
+			return errBackendGone
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// status 是广播给全部订阅者的队列状态，不代表该提示有进展
+		if event.Type != comfyui.EventStatus && event.Type != eventReconnected {
+			monitor.event(time.Now())
+		}
+		switch event.Type {
+		case eventReconnected:
+			finished, err := m.checkPrompt(job, promptID)
+			if err != nil || finished {
+				return err
+			}
+		case comfyui.EventStatus:
+			m.refreshPosition(job, promptID)
+		case comfyui.EventPreview:
+			job.publish(JobEventPreview, PreviewData{ContentType: event.Preview.MimeType, Image: event.Preview.Image})
+		case comfyui.EventExecutionStart:
+			if job.setRunning() {
+				m.persist(job)
+			}
+		case comfyui.EventExecuting:
+			data, err := event.Executing()
+			if err != nil {
+				continue
+			}
+			if data.Node == nil {
+				return nil // Execution is done
+			}
+			if job.setRunning() {
+				m.persist(job)
+			}
+			monitor.executing(*data.Node, time.Now())
+			job.setNode(*data.Node)
+		case comfyui.EventExecutionCached:
+			data, err := event.ExecutionCached()
+			if err != nil {
+				continue
+			}
+			job.publish(JobEventCached, gin.H{"nodes": data.Nodes})
+		case comfyui.EventExecuted:
+			data, err := event.Executed()
+			if err != nil {
+				continue
+			}
+			job.publish(JobEventExecuted, gin.H{"node": data.Node, "output": data.Output})
+		case comfyui.EventProgress:
+			data, err := event.Progress()
+			if err != nil {
+				continue
+			}
+			job.setProgress(Progress{Node: data.Node, Value: data.Value, Max: data.Max})
+		case comfyui.EventExecutionError:
+			data, err := event.ExecutionError()
+			if err != nil {
+				return fmt.Errorf("execution error")
+			}
+			return &ExecutionError{*data}
+		case comfyui.EventExecutionInterrupted:
+			return errInterrupted
+		}
+	}
+}
+
+// refreshPosition 查询 ComfyUI 队列并更新任务的排队位置
+func (m *JobManager) refreshPosition(job *Job, promptID string) {
+	if job.Status().State != JobQueued {
+		return
+	}
+	backend := job.getBackend()
+	queue, err := backend.timedClient(backend.probeClient).GetQueue()
+	if err != nil {
+		return
+	}
+	if position := queue.Position(promptID); position >= 0 {
+		job.setPosition(position)
+	}
+}
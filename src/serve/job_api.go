@@ -0,0 +1,225 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/gin-gonic/gin"
+)
+
+// jobs 是服务使用的任务管理器，由 StartServer 初始化
+var jobs *JobManager
+
+// jobRequest 是提交任务的请求体
+type jobRequest struct {
+	Workflow    json.RawMessage `json:"workflow" binding:"required"` // 工作流对象，或其 JSON 字符串
+	CallbackURL string          `json:"callback_url"`                // 任务结束时的回调地址
+	Priority    string          `json:"priority"`                    // interactive、normal 或 bulk，默认为 normal
+	Batch       *BatchOptions   `json:"batch"`                       // 拆分为子任务分散到多个后端执行
+	Tile        *TileOptions    `json:"tile"`                        // 将输入图像分块，分散到多个后端处理后拼接
+	Timeout     Duration        `json:"timeout"`                     // 开始执行后的最长时间，如 "10m"，为空时使用配置
+	Template    string          `json:"template"`                    // 工作流模板名称，用于选择重试策略
+	Version     string          `json:"template_version"`            // 工作流模板版本，记录在来源签名中
+	Cache       string          `json:"cache"`                       // 结果缓存模式：bypass、prefer（默认）或 only
+}
+
+// spec 校验请求并转换为任务描述
+func (r *jobRequest) spec() (JobSpec, error) {
+	prompt, err := parseWorkflow(r.Workflow)
+	if err != nil {
+		return JobSpec{}, err
+	}
+	if r.CallbackURL != "" {
+		if err := validateCallbackURL(r.CallbackURL); err != nil {
+			return JobSpec{}, err
+		}
+	}
+	if _, err := priorityLevel(r.Priority); err != nil {
+		return JobSpec{}, err
+	}
+	if r.Batch != nil && r.Tile != nil {
+		return JobSpec{}, errors.New("batch and tile cannot be combined")
+	}
+	if r.Batch != nil {
+		if _, err := expandBatch(prompt, r.Batch); err != nil {
+			return JobSpec{}, err
+		}
+	}
+	if r.Tile != nil {
+		if err := checkTiles(prompt, r.Tile); err != nil {
+			return JobSpec{}, err
+		}
+	}
+	if r.Timeout < 0 {
+		return JobSpec{}, errors.New("timeout must not be negative")
+	}
+	if err := validCacheMode(r.Cache); err != nil {
+		return JobSpec{}, err
+	}
+	return JobSpec{
+		Prompt:      prompt,
+		CallbackURL: r.CallbackURL,
+		Priority:    r.Priority,
+		Batch:       r.Batch,
+		Tile:        r.Tile,
+		Timeout:     r.Timeout,
+		Template:    r.Template,
+		Version:     r.Version,
+		Cache:       r.Cache,
+	}, nil
+}
+
+// parseWorkflow 解析 API 格式的工作流，兼容以字符串形式传入的 JSON
+func parseWorkflow(raw json.RawMessage) (comfyui.Prompt, error) {
+	var prompt comfyui.Prompt
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		raw = json.RawMessage(text)
+	}
+	if err := json.Unmarshal(raw, &prompt); err != nil {
+		return prompt, fmt.Errorf("invalid workflow JSON: %w", err)
+	}
+	if len(prompt.Nodes) == 0 {
+		return prompt, errors.New("workflow has no nodes")
+	}
+	return prompt, nil
+}
+
+// jobError 将任务管理器的错误转换为 HTTP 响应
+func jobError(c *gin.Context, err error) {
+	var unsatisfiable *UnsatisfiableError
+	switch {
+	case errors.As(err, &unsatisfiable):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrJobNotFound), errors.Is(err, ErrOutputNotFound), errors.Is(err, ErrObjectNotFound), errors.Is(err, ErrCacheMiss):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNotImage):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrJobFinished), errors.Is(err, ErrNotDeadLetter), errors.Is(err, ErrTileImageReleased):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// jobForTenant 查找当前租户的任务
+func jobForTenant(c *gin.Context, id string) (*Job, error) {
+	return jobs.GetForTenant(id, currentTenant(c))
+}
+
+// createJob 提交任务并立即返回任务 ID
+func createJob(c *gin.Context) {
+	var req jobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	spec, err := req.spec()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	spec.Tenant = currentTenant(c)
+
+	job, err := jobs.Submit(spec)
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.Header("Location", "/api/jobs/"+job.ID())
+	c.JSON(http.StatusAccepted, job.Status())
+}
+
+// listJobs 返回当前租户全部任务的状态
+func listJobs(c *gin.Context) {
+	tenant := currentTenant(c)
+	statuses := []JobStatus{}
+	for _, status := range jobs.List() {
+		if status.Tenant == tenant {
+			statuses = append(statuses, status)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": statuses})
+}
+
+// getJob 返回任务状态、进度、错误与输出引用
+func getJob(c *gin.Context) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job.Status())
+}
+
+// cancelJob 取消任务
+func cancelJob(c *gin.Context) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err == nil {
+		err = jobs.Cancel(job.ID())
+	}
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, job.Status())
+}
+
+// listJobOutputs 返回任务的输出引用列表
+func listJobOutputs(c *gin.Context) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"outputs": job.Status().Outputs})
+}
+
+// getJobOutput 返回任务的第 n 个输出文件，带 format、width 等参数时返回转码结果，metadata 控制 PNG 中的元数据
+func getJobOutput(c *gin.Context) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid output index"})
+		return
+	}
+	variant, err := parseVariant(c)
+	if err == nil {
+		err = validMetadataMode(c.Query("metadata"))
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var output JobOutput
+	var data []byte
+	var filename, contentType string
+	if variant != nil {
+		var v Variant
+		output, v, data, err = jobs.OutputVariant(c.Request.Context(), job, n, *variant)
+		filename, contentType = v.filename(output.Filename), v.contentType()
+	} else {
+		output, data, err = job.Output(n)
+		filename, contentType = output.Filename, output.ContentType
+	}
+	if err == nil {
+		data, err = jobs.applyMetadata(job, n, data, contentType, c.Query("metadata"))
+	}
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	c.Data(http.StatusOK, contentType, data)
+}
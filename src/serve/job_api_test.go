@@ -0,0 +1,154 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// newTenantTestServer 启动带两个租户的任务 API，返回服务地址与租户 a 的一个排队中的任务
+func newTenantTestServer(t *testing.T) (*httptest.Server, *Job) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	pool, err := NewPool(PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedJobs, savedTenants := jobs, tenants
+	jobs = NewJobManager(NewMemoryJobStore(), NewMemoryStorage(), pool, TimeoutConfig{}, RetryConfig{}, CacheConfig{}, ThumbnailConfig{})
+	tenants = []TenantConfig{{Name: "a", APIKey: "key-a"}, {Name: "b", APIKey: "key-b"}}
+	t.Cleanup(func() { jobs, tenants = savedJobs, savedTenants })
+
+	job := &Job{
+		id:        "job-a",
+		state:     JobQueued,
+		position:  -1,
+		createdAt: time.Now(),
+		spec:      JobSpec{Tenant: "a", Priority: PriorityNormal},
+		outputs:   []JobOutput{{Index: 0, Filename: "a.png", ContentType: "image/png", data: []byte("png")}},
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	jobs.jobs[job.id] = job
+
+	r := gin.New()
+	r.GET("/api/ws", tenantAuth(), serveWebSocket)
+	api := r.Group("/api/jobs", tenantAuth())
+	api.GET("/:id", getJob)
+	api.DELETE("/:id", cancelJob)
+	api.GET("/:id/events", streamJobEvents)
+	api.GET("/:id/outputs", listJobOutputs)
+	api.GET("/:id/outputs/:n", getJobOutput)
+	api.GET("/:id/archive", archiveJob)
+	api.PUT("/:id/pin", pinJob)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server, job
+}
+
+func tenantRequest(t *testing.T, method, url, key string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestJobAPICrossTenant(t *testing.T) {
+	server, job := newTenantTestServer(t)
+	base := server.URL + "/api/jobs/" + job.ID()
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, ""},
+		{http.MethodGet, "/events"},
+		{http.MethodGet, "/outputs"},
+		{http.MethodGet, "/outputs/0"},
+		{http.MethodGet, "/archive"},
+		{http.MethodPut, "/pin"},
+		{http.MethodDelete, ""},
+	} {
+		if code := tenantRequest(t, tc.method, base+tc.path, "key-b"); code != http.StatusNotFound {
+			t.Errorf("%s %s as another tenant: status %d, want 404", tc.method, tc.path, code)
+		}
+	}
+	if job.ctx.Err() != nil {
+		t.Fatal("job was cancelled by another tenant")
+	}
+	if job.Status().Pinned {
+		t.Fatal("job was pinned by another tenant")
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, "/outputs", http.StatusOK},
+		{http.MethodGet, "/outputs/0", http.StatusOK},
+		{http.MethodDelete, "", http.StatusAccepted},
+	} {
+		if code := tenantRequest(t, tc.method, base+tc.path, "key-a"); code != tc.want {
+			t.Errorf("%s %s as owner: status %d, want %d", tc.method, tc.path, code, tc.want)
+		}
+	}
+	if job.ctx.Err() == nil {
+		t.Fatal("job was not cancelled by its owner")
+	}
+}
+
+func TestWebSocketCrossTenant(t *testing.T) {
+	server, job := newTenantTestServer(t)
+	dial := func(key string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?api_key=" + key
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		var hello wsResponse
+		if err := conn.ReadJSON(&hello); err != nil || hello.Type != wsHello {
+			t.Fatalf("hello = %+v, %v", hello, err)
+		}
+		return conn
+	}
+	send := func(conn *websocket.Conn, typ string) wsResponse {
+		t.Helper()
+		if err := conn.WriteJSON(wsRequest{Version: wsProtocolVersion, Type: typ, JobID: job.ID()}); err != nil {
+			t.Fatal(err)
+		}
+		var resp wsResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	other := dial("key-b")
+	for _, typ := range []string{wsSubscribe, wsCancel} {
+		if resp := send(other, typ); resp.Type != wsError || resp.Error != ErrJobNotFound.Error() {
+			t.Errorf("%s as another tenant: %+v, want %q", typ, resp, ErrJobNotFound)
+		}
+	}
+	if job.ctx.Err() != nil {
+		t.Fatal("job was cancelled by another tenant")
+	}
+
+	owner := dial("key-a")
+	if resp := send(owner, wsSubscribe); resp.Type != wsAck || resp.Job == nil || resp.Job.ID != job.ID() {
+		t.Fatalf("subscribe as owner: %+v", resp)
+	}
+}
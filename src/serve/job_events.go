@@ -0,0 +1,140 @@
+package serve
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 任务事件类型
+const (
+	JobEventQueue     = "queue"     // 排队位置变化
+	JobEventNode      = "node"      // 开始执行节点
+	JobEventProgress  = "progress"  // 采样步数进度
+	JobEventCached    = "cached"    // 命中缓存而跳过的节点
+	JobEventExecuted  = "executed"  // 节点执行完成并产生输出
+	JobEventPreview   = "preview"   // 采样预览图像
+	JobEventSuccess   = "success"   // 任务成功结束
+	JobEventError     = "error"     // 任务失败
+	JobEventCancelled = "cancelled" // 任务被取消
+	JobEventItem      = "item"      // 批量任务的子任务结束或重试
+	JobEventStatus    = "status"    // 服务重启后恢复的未结束任务的当前状态
+)
+
+// restoreSeqGap 是恢复未结束的任务时跳过的事件 ID 数。
+// 进度、预览等事件不会持久化，重启前发出的 ID 可能超过记录中的 seq。
+const restoreSeqGap = 1 << 20
+
+// JobEvent 是任务执行过程中产生的事件
+type JobEvent struct {
+	ID    int64       `json:"id"`
+	JobID string      `json:"job_id"`
+	Type  string      `json:"type"`
+	Data  interface{} `json:"data,omitempty"`
+	Time  time.Time   `json:"time"`
+}
+
+// PreviewData 是预览事件的数据
+type PreviewData struct {
+	ContentType string `json:"content_type"`
+	Image       []byte `json:"image"`
+}
+
+// publishLocked 追加事件并唤醒等待中的订阅者，调用方需持有 j.mu。
+// 预览图像只保留最新一张；连续的进度与排队位置事件（中间只隔着预览）只保留最新一条，
+// 避免事件日志随采样步数与排队变化膨胀。被替换的事件 ID 不再出现，续传时从更大的 ID 继续即可。
+func (j *Job) publishLocked(typ string, data interface{}) {
+	j.seq++
+	event := JobEvent{ID: j.seq, JobID: j.id, Type: typ, Data: data, Time: time.Now()}
+
+	switch typ {
+	case JobEventPreview:
+		kept := j.events[:0]
+		for _, e := range j.events {
+			if e.Type != JobEventPreview {
+				kept = append(kept, e)
+			}
+		}
+		j.events = kept
+	case JobEventProgress, JobEventQueue:
+		for i := len(j.events) - 1; i >= 0; i-- {
+			if e := j.events[i]; e.Type == JobEventPreview {
+				continue
+			} else if superseded(e, typ) {
+				j.events = append(j.events[:i], j.events[i+1:]...)
+			}
+			break
+		}
+	}
+	j.events = append(j.events, event)
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// superseded 判断事件是否会被同类型的新事件取代，重新排队的事件带有原因，需要保留
+func superseded(e JobEvent, typ string) bool {
+	if e.Type != typ {
+		return false
+	}
+	if data, ok := e.Data.(gin.H); ok {
+		if _, ok := data["reason"]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// publishTerminalLocked 追加与任务终态对应的事件，调用方需持有 j.mu
+func (j *Job) publishTerminalLocked() {
+	switch j.state {
+	case JobSucceeded:
+		j.publishLocked(JobEventSuccess, gin.H{"outputs": j.outputs})
+	case JobFailed:
+		j.publishLocked(JobEventError, gin.H{"error": j.err})
+	case JobCancelled:
+		j.publishLocked(JobEventCancelled, gin.H{"error": j.err})
+	}
+}
+
+// resume 在重启恢复任务后补发事件，使客户端通过 Last-Event-ID 续传时能收到：
+// 已结束的任务补发终态事件，未结束的任务跳过 restoreSeqGap 个 ID 后发出 status 事件。
+// 新事件的 ID 都大于记录中的 seq；未结束的任务需要随后持久化，再次重启时不会重复使用这些 ID。
+func (j *Job) resume() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state.Terminal() {
+		j.publishTerminalLocked()
+		return
+	}
+	j.seq += restoreSeqGap
+	j.publishLocked(JobEventStatus, gin.H{"state": j.state, "progress": j.progress})
+}
+
+// publish 追加事件
+func (j *Job) publish(typ string, data interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.publishLocked(typ, data)
+}
+
+// Changed 返回任务下一次产生事件时关闭的通道
+func (j *Job) Changed() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.changed
+}
+
+// EventsSince 返回 ID 大于 after 的事件、有新事件时关闭的通道，以及任务是否已结束
+func (j *Job) EventsSince(after int64) ([]JobEvent, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var events []JobEvent
+	for _, e := range j.events {
+		if e.ID > after {
+			events = append(events, e)
+		}
+	}
+	return events, j.changed, j.state.Terminal()
+}
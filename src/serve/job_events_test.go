@@ -0,0 +1,84 @@
+package serve
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func eventTypes(events []JobEvent) []string {
+	types := make([]string, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+	return types
+}
+
+func TestPublishCollapsesProgress(t *testing.T) {
+	job := &Job{id: "job", state: JobQueued, position: -1, changed: make(chan struct{})}
+	setRunning := func() {
+		job.mu.Lock()
+		job.state = JobRunning
+		job.mu.Unlock()
+	}
+	for position := 100; position >= 0; position-- {
+		job.setPosition(position)
+	}
+	setRunning()
+	job.setNode("3")
+	for step := 1; step <= 5; step++ {
+		job.setProgress(Progress{Node: "3", Value: step, Max: 50})
+		job.publish(JobEventPreview, PreviewData{ContentType: "image/jpeg"})
+	}
+	job.reschedule("backend removed")
+	job.setPosition(3)
+	job.setPosition(1)
+	setRunning()
+
+	job.setNode("3")
+	var seen int64
+	for step := 1; step <= 50; step++ {
+		job.setProgress(Progress{Node: "3", Value: step, Max: 50})
+		job.publish(JobEventPreview, PreviewData{ContentType: "image/jpeg"})
+		if step == 10 {
+			events, _, _ := job.EventsSince(0)
+			seen = events[len(events)-1].ID
+		}
+	}
+	job.publish(JobEventExecuted, gin.H{"node": "3"})
+	job.setNode("8")
+	job.setProgress(Progress{Node: "8", Value: 1, Max: 1})
+
+	events, _, _ := job.EventsSince(0)
+	want := []string{
+		JobEventQueue, JobEventNode, JobEventProgress, JobEventQueue, JobEventQueue,
+		JobEventNode, JobEventProgress, JobEventPreview, JobEventExecuted, JobEventNode, JobEventProgress,
+	}
+	if types := eventTypes(events); !slices.Equal(types, want) {
+		t.Fatalf("events %v, want %v", types, want)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].ID <= events[i-1].ID {
+			t.Fatalf("event IDs not increasing: %d after %d", events[i].ID, events[i-1].ID)
+		}
+	}
+	if position := events[0].Data.(gin.H)["position"]; position != 0 {
+		t.Fatalf("first queue event position %v, want 0", position)
+	}
+	if reason := events[3].Data.(gin.H)["reason"]; reason != "backend removed" {
+		t.Fatalf("requeue event reason %v", reason)
+	}
+	if position := events[4].Data.(gin.H)["position"]; position != 1 {
+		t.Fatalf("queue event after requeue position %v, want 1", position)
+	}
+	if progress := events[6].Data.(Progress); progress.Value != 50 {
+		t.Fatalf("kept progress %d, want 50", progress.Value)
+	}
+
+	// 从被取代的事件续传时收到之后的全部事件，不会漏掉其他类型的事件
+	resumed, _, _ := job.EventsSince(seen)
+	if types := eventTypes(resumed); !slices.Equal(types, want[6:]) {
+		t.Fatalf("events after %d: %v, want %v", seen, types, want[6:])
+	}
+}
@@ -0,0 +1,316 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/google/uuid"
+)
+
+// 负载均衡策略
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastQueue = "least_queue"
+	StrategyWeighted   = "weighted"
+)
+
+// 后端来源
+const (
+	SourceConfig = "config" // 配置文件中的静态后端
+	SourceAPI    = "api"    // 通过注册接口加入的 worker
+	SourceFile   = "file"   // 从后端列表文件发现
+	SourceSRV    = "srv"    // 从 DNS SRV 记录发现
+)
+
+var (
+	// ErrNoBackend 表示没有可用的后端
+	ErrNoBackend = errors.New("no backend available")
+	// ErrBackendNotFound 表示后端不在池中
+	ErrBackendNotFound = errors.New("backend not found")
+)
+
+// Strategy 从候选后端中选出一个
+type Strategy interface {
+	Pick(backends []*Backend) *Backend
+}
+
+// Pool 是 ComfyUI 后端池，负责为任务选择后端
+type Pool struct {
+	mu       sync.RWMutex
+	backends []*Backend
+	strategy Strategy
+	affinity AffinityConfig
+	health   HealthConfig
+	depth    int
+	host     string
+	ctx      context.Context // Start 之后加入的后端随之启动
+	changed  chan struct{}   // 后端空出位置或池发生变化时发出通知
+}
+
+// NewPool 根据配置创建后端池，配置中的后端可以为空，由 worker 注册或服务发现加入
+func NewPool(cfg PoolConfig) (*Pool, error) {
+	strategy, err := newStrategy(cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	depth := cfg.QueueDepth
+	if depth <= 0 {
+		depth = DefaultConfig().Pool.QueueDepth
+	}
+	pool := &Pool{
+		strategy: strategy,
+		affinity: cfg.Affinity,
+		health:   cfg.Health,
+		depth:    depth,
+		host:     host,
+		changed:  make(chan struct{}, 1),
+	}
+	for _, backendCfg := range cfg.Backends {
+		if _, err := pool.Add(backendCfg, SourceConfig); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+// newStrategy 根据名称创建负载均衡策略
+func newStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", StrategyRoundRobin:
+		return &roundRobin{}, nil
+	case StrategyLeastQueue:
+		return leastQueue{}, nil
+	case StrategyWeighted:
+		return &weighted{current: make(map[*Backend]int)}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling strategy: %s", name)
+	}
+}
+
+// Start 为每个后端建立事件连接并开始健康探测
+func (p *Pool) Start(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ctx = ctx
+	for _, backend := range p.backends {
+		backend.start(ctx)
+	}
+}
+
+// Add 将后端加入池中。同名且来源相同的后端地址未变时只更新权重与标签，地址变化时替换为新的后端。
+func (p *Pool) Add(cfg BackendConfig, source string) (*Backend, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("backend url is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.URL
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, existing := range p.backends {
+		if existing.Name != cfg.Name {
+			continue
+		}
+		if existing.Source != source {
+			return nil, fmt.Errorf("duplicate backend name: %s", cfg.Name)
+		}
+		if existing.url == cfg.URL {
+			existing.update(cfg)
+			return existing, nil
+		}
+		p.backends = append(p.backends[:i], p.backends[i+1:]...)
+		existing.shutdown()
+		log.Printf("backend %s: address changed to %s", cfg.Name, cfg.URL)
+		break
+	}
+
+	// 客户端 ID 在重启后保持不变，以便重新关联仍在执行的提示
+	clientID := uuid.NewSHA1(uuid.NameSpaceURL, []byte(p.host+"/"+cfg.Name)).String()
+	backend := newBackend(cfg, source, p.health, clientID)
+	backend.notify = p.notify
+	p.backends = append(p.backends, backend)
+	p.notify()
+	if p.ctx != nil {
+		backend.start(p.ctx)
+		log.Printf("backend %s: added from %s (%s)", cfg.Name, source, cfg.URL)
+	}
+	return backend, nil
+}
+
+// Changed 返回池中出现空闲位置或后端变化时收到通知的通道
+func (p *Pool) Changed() <-chan struct{} {
+	return p.changed
+}
+
+// notify 发出变化通知，已有未处理的通知时忽略
+func (p *Pool) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Remove 将后端移出池，在其上执行的任务会被重新调度
+func (p *Pool) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, backend := range p.backends {
+		if backend.Name == name {
+			p.backends = append(p.backends[:i], p.backends[i+1:]...)
+			backend.shutdown()
+			log.Printf("backend %s: removed", name)
+			return nil
+		}
+	}
+	return ErrBackendNotFound
+}
+
+// Sync 使来自 source 的后端与给定列表一致：加入新的后端，移除不再出现的后端
+func (p *Pool) Sync(source string, cfgs []BackendConfig) {
+	keep := make(map[string]bool)
+	for _, cfg := range cfgs {
+		backend, err := p.Add(cfg, source)
+		if err != nil {
+			log.Printf("discovery %s: %v", source, err)
+			continue
+		}
+		keep[backend.Name] = true
+	}
+	for _, backend := range p.Backends() {
+		if backend.Source == source && !keep[backend.Name] {
+			_ = p.Remove(backend.Name)
+		}
+	}
+}
+
+// Backends 返回池中的全部后端
+func (p *Pool) Backends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Backend{}, p.backends...)
+}
+
+// Get 根据名称查找后端
+func (p *Pool) Get(name string) (*Backend, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, backend := range p.backends {
+		if backend.Name == name {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+// Pick 从可用的后端中选择一个。熔断、排空中、已提交任务数达到 queue_depth 以及缺少提示所需模型或节点的后端不参与调度；
+// 启用缓存亲和时优先选择最近执行过相同上游节点的后端，否则按策略选择。exclude 为重试时要避开的后端。
+func (p *Pool) Pick(prompt comfyui.Prompt, exclude []string) (*Backend, error) {
+	backends := p.Backends()
+	// 只在还有其他可用后端时才避开 exclude 中的后端，否则仍可以调度到这些后端
+	excluded := make(map[string]bool, len(exclude))
+	for _, backend := range backends {
+		if !slices.Contains(exclude, backend.Name) && backend.Available() && backend.Supports(prompt) {
+			for _, name := range exclude {
+				excluded[name] = true
+			}
+			break
+		}
+	}
+
+	var candidates []*Backend
+	for _, backend := range backends {
+		if !excluded[backend.Name] && backend.Available() && backend.Inflight() < p.depth && backend.Supports(prompt) {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoBackend
+	}
+	signatures := promptSignatures(prompt)
+	var backend *Backend
+	if p.affinity.Enabled {
+		backend = p.pickAffinity(candidates, signatures)
+	}
+	if backend == nil {
+		backend = p.strategy.Pick(candidates)
+	}
+	if backend == nil {
+		return nil, ErrNoBackend
+	}
+	backend.remember(signatures)
+	return backend, nil
+}
+
+// roundRobin 依次轮流选择后端
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (s *roundRobin) Pick(backends []*Backend) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backend := backends[s.next%len(backends)]
+	s.next++
+	return backend
+}
+
+// leastQueue 选择 ComfyUI 队列最短的后端。队列长度来自健康探测，调度时不发送请求；
+// 探测之后提交的任务尚未计入，因此取队列长度与本服务进行中任务数的较大值。
+type leastQueue struct{}
+
+func (leastQueue) Pick(backends []*Backend) *Backend {
+	depths := make([]int, len(backends))
+	for i, backend := range backends {
+		depths[i] = max(backend.Inflight(), backend.QueueDepth())
+	}
+
+	best := 0
+	for i := range backends {
+		if depths[i] < depths[best] {
+			best = i
+		}
+	}
+	return backends[best]
+}
+
+// weighted 是平滑加权轮询，按权重比例分配任务
+type weighted struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (s *weighted) Pick(backends []*Backend) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 移出池或暂时不可用的后端不再保留累计值，重新加入时从 0 开始
+	for backend := range s.current {
+		if !slices.Contains(backends, backend) {
+			delete(s.current, backend)
+		}
+	}
+
+	var best *Backend
+	total := 0
+	for _, backend := range backends {
+		weight := backend.weight()
+		s.current[backend] += weight
+		total += weight
+		if best == nil || s.current[backend] > s.current[best] {
+			best = backend
+		}
+	}
+	s.current[best] -= total
+	return best
+}
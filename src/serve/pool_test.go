@@ -0,0 +1,27 @@
+package serve
+
+import "testing"
+
+func TestWeightedPick(t *testing.T) {
+	s := &weighted{current: make(map[*Backend]int)}
+	a, b, c := &Backend{Weight: 3}, &Backend{Weight: 1}, &Backend{Weight: 2}
+
+	counts := make(map[*Backend]int)
+	for i := 0; i < 8; i++ {
+		counts[s.Pick([]*Backend{a, b})]++
+	}
+	if counts[a] != 6 || counts[b] != 2 {
+		t.Fatalf("picked a %d times and b %d times, want 6 and 2", counts[a], counts[b])
+	}
+
+	// 不在本次候选中的后端被移除，池中的后端变化时累计值不会无限增长
+	for i := 0; i < 4; i++ {
+		s.Pick([]*Backend{c, b})
+	}
+	if len(s.current) != 2 {
+		t.Fatalf("%d backends tracked, want 2", len(s.current))
+	}
+	if _, ok := s.current[a]; ok {
+		t.Fatal("removed backend still tracked")
+	}
+}
@@ -0,0 +1,141 @@
+package serve
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+	"github.com/fimreal/comfyui-api/src/provenance"
+	"github.com/gin-gonic/gin"
+)
+
+// sign 签名输出，PNG 输出的内容替换为写入签名后的内容。签名保存在任务记录的输出中，
+// 清单带有任务 ID 与时间，因此签名的 PNG 在不同任务间不再是相同的内容，不会去重。
+func (m *JobManager) sign(job *Job, output *JobOutput) error {
+	// 分块任务的子任务输出只用于拼接，由拼接结果签名
+	spec := job.spec
+	if spec.ParentID != "" {
+		parent, err := m.Get(spec.ParentID)
+		if err != nil {
+			return err
+		}
+		if parent.spec.Tile != nil {
+			return nil
+		}
+	}
+	hash, err := promptHash(spec.Prompt)
+	if err != nil {
+		return err
+	}
+	backend := output.backend
+	if backend == nil {
+		backend = job.getBackend()
+	}
+	manifest := provenance.Manifest{
+		ContentType:     output.ContentType,
+		PromptHash:      hash,
+		Template:        spec.Template,
+		TemplateVersion: spec.Version,
+		JobID:           job.id,
+		ParentJobID:     spec.ParentID,
+		Output:          output.Index,
+		Timestamp:       time.Now().UTC(),
+	}
+	if backend != nil {
+		manifest.Backend = backend.Name
+	}
+	data, signature, err := m.signer.SignContent(output.data, manifest)
+	if err != nil {
+		return err
+	}
+	output.data, output.Size, output.Provenance = data, len(data), signature
+	return nil
+}
+
+// verifyResponse 是校验来源签名的结果
+type verifyResponse struct {
+	Valid    bool                 `json:"valid"`
+	KeyID    string               `json:"key_id"` // 服务的公钥标识
+	Manifest *provenance.Manifest `json:"manifest,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// verifyImage 用服务的公钥校验上传的输出。PNG 使用其中嵌入的签名；
+// 其他格式需要在 multipart 表单的 signature 字段提供输出的 provenance。
+func verifyImage(c *gin.Context) {
+	if jobs.signer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "provenance signing is not enabled on this server"})
+		return
+	}
+	data, err := readUpload(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var signature *provenance.Signature
+	if raw, err := formText(c, "signature"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &signature); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid signature JSON: " + err.Error()})
+			return
+		}
+	}
+
+	resp := verifyResponse{KeyID: jobs.signer.KeyID()}
+	resp.Manifest, err = provenance.Verify(data, signature, jobs.signer.Public())
+	switch {
+	case errors.Is(err, pngmeta.ErrNotPNG):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "not a PNG image; provide the signature for other formats"})
+		return
+	case err != nil:
+		resp.Error = err.Error()
+	default:
+		resp.Valid = true
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// formText 返回 multipart 表单中的文本字段或文件字段的内容，不是 multipart 请求时为空
+func formText(c *gin.Context, name string) (string, error) {
+	if c.Request.MultipartForm == nil {
+		return "", nil
+	}
+	if value := c.Request.FormValue(name); value != "" {
+		return value, nil
+	}
+	file, _, err := c.Request.FormFile(name)
+	if errors.Is(err, http.ErrMissingFile) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	return string(data), err
+}
+
+// provenanceKey 返回校验签名用的公钥
+func provenanceKey(c *gin.Context) {
+	if jobs.signer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "provenance signing is not enabled on this server"})
+		return
+	}
+	public := jobs.signer.Public()
+	pem, err := provenance.MarshalPublicKey(public)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"alg":        provenance.Algorithm,
+		"key_id":     jobs.signer.KeyID(),
+		"public_key": base64.StdEncoding.EncodeToString(public),
+		"pem":        string(pem),
+	})
+}
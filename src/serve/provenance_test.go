@@ -0,0 +1,86 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+	"github.com/fimreal/comfyui-api/src/provenance"
+)
+
+func TestProvenanceMetadataRoundTrip(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := provenance.NewSigner(key)
+	pool, err := NewPool(PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewJobManager(NewMemoryJobStore(), NewMemoryStorage(), pool, TimeoutConfig{}, RetryConfig{}, CacheConfig{}, ThumbnailConfig{})
+	m.SetSigner(signer)
+
+	prompt := comfyui.Prompt{Nodes: map[string]comfyui.PromptNode{
+		"3": {ClassType: "KSampler", Inputs: comfyui.Inputs{Seed: 1}},
+	}}
+	job := &Job{
+		id:         "job-1",
+		state:      JobSucceeded,
+		createdAt:  time.Now(),
+		finishedAt: time.Now(),
+		spec:       JobSpec{Prompt: prompt, Tenant: defaultTenant},
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+
+	// ComfyUI 保存的 PNG 带有 prompt 与 workflow 文本块
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	data, err := pngmeta.SetText(buf.Bytes(), map[string]string{pngmeta.KeyPrompt: "{}", pngmeta.KeyWorkflow: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := JobOutput{Index: 0, ContentType: "image/png", data: data}
+	if err := m.sign(job, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{MetadataKeep, MetadataJob, MetadataStrip} {
+		downloaded, err := m.applyMetadata(job, 0, output.data, output.ContentType, mode)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		var signature *provenance.Signature
+		if mode == MetadataStrip {
+			if _, err := provenance.Extract(downloaded); !errors.Is(err, provenance.ErrNoSignature) {
+				t.Fatalf("strip kept the provenance chunk: %v", err)
+			}
+			signature = output.Provenance
+		}
+		manifest, err := provenance.Verify(downloaded, signature, signer.Public())
+		if err != nil {
+			t.Fatalf("%s: verify: %v", mode, err)
+		}
+		if manifest.JobID != job.id {
+			t.Fatalf("%s: manifest job %q, want %q", mode, manifest.JobID, job.id)
+		}
+	}
+
+	// 像素被修改时校验失败
+	other := &bytes.Buffer{}
+	if err := png.Encode(other, image.NewNRGBA(image.Rect(0, 0, 9, 9))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provenance.Verify(other.Bytes(), output.Provenance, signer.Public()); !errors.Is(err, provenance.ErrHashMismatch) {
+		t.Fatalf("verify of other content: %v, want %v", err, provenance.ErrHashMismatch)
+	}
+}
@@ -0,0 +1,289 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// collector 按保留规则回收任务，由 StartServer 初始化
+var collector *Collector
+
+// 任务被回收的原因
+const (
+	GCReasonMaxAge     = "max_age"
+	GCReasonKeepLatest = "keep_latest"
+	GCReasonMaxBytes   = "max_bytes"
+)
+
+// GCCandidate 是一次回收中被删除（或试运行时将被删除）的任务
+type GCCandidate struct {
+	JobID      string    `json:"job_id"`
+	Tenant     string    `json:"tenant"`
+	Template   string    `json:"template,omitempty"`
+	Rule       string    `json:"rule"`   // 生效的规则：template:<名称>、tenant:<名称> 或 default
+	Reason     string    `json:"reason"` // max_age、keep_latest 或 max_bytes
+	Outputs    int       `json:"outputs"`
+	Bytes      int64     `json:"bytes"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// GCReport 是一次回收的结果
+type GCReport struct {
+	DryRun bool          `json:"dry_run"`
+	Jobs   []GCCandidate `json:"jobs"`
+	Bytes  int64         `json:"bytes"` // 被回收任务的输出总大小
+	Errors []string      `json:"errors,omitempty"`
+}
+
+// Collector 按模板或租户的保留规则定期删除已结束任务的记录与输出
+type Collector struct {
+	mu   sync.Mutex // 同一时间只进行一次回收
+	jobs *JobManager
+	cfg  RetentionConfig
+}
+
+// NewCollector 创建任务回收器
+func NewCollector(jobs *JobManager, cfg RetentionConfig) *Collector {
+	return &Collector{jobs: jobs, cfg: cfg}
+}
+
+// Run 按配置的间隔回收任务，间隔为 0 时只能通过管理接口手动回收，直到 ctx 结束
+func (c *Collector) Run(ctx context.Context) {
+	if c.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(c.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report := c.Collect(ctx, false)
+			if len(report.Jobs) > 0 || len(report.Errors) > 0 {
+				log.Printf("gc: removed %d jobs, %d bytes, %d errors", len(report.Jobs), report.Bytes, len(report.Errors))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rule 返回任务适用的保留规则及其名称：模板规则优先于租户规则，都没有时使用默认规则
+func (c *Collector) rule(status JobStatus) (string, RetentionRule) {
+	if rule, ok := c.cfg.Templates[status.Template]; ok && status.Template != "" {
+		return "template:" + status.Template, rule
+	}
+	if rule, ok := c.cfg.Tenants[status.Tenant]; ok {
+		return "tenant:" + status.Tenant, rule
+	}
+	return "default", c.cfg.Default
+}
+
+// Plan 返回按保留规则应当回收的任务。只考虑已结束的顶层任务，子任务随其批量任务一起回收；置顶的任务不回收。
+func (c *Collector) Plan(now time.Time) []GCCandidate {
+	groups := make(map[string][]JobStatus)
+	rules := make(map[string]RetentionRule)
+	for _, status := range c.jobs.List() {
+		if status.ParentID != "" || !status.State.Terminal() || status.FinishedAt == nil {
+			continue
+		}
+		name, rule := c.rule(status)
+		groups[name] = append(groups[name], status)
+		rules[name] = rule
+	}
+
+	var candidates []GCCandidate
+	for name, statuses := range groups {
+		rule := rules[name]
+		// 从最新的任务开始累计，超出数量与大小上限的是较早的任务
+		sort.Slice(statuses, func(i, k int) bool {
+			return statuses[i].FinishedAt.After(*statuses[k].FinishedAt)
+		})
+		var total int64
+		kept := 0
+		for _, status := range statuses {
+			outputs, size := c.jobs.outputUsage(status.ID)
+			if status.Pinned {
+				// 置顶的任务占用大小上限，但不占用保留数量
+				total += size
+				continue
+			}
+			reason := ""
+			switch {
+			case rule.MaxAge > 0 && now.Sub(*status.FinishedAt) > time.Duration(rule.MaxAge):
+				reason = GCReasonMaxAge
+			case rule.KeepLatest > 0 && kept >= rule.KeepLatest:
+				reason = GCReasonKeepLatest
+			case rule.MaxBytes > 0 && total+size > rule.MaxBytes:
+				reason = GCReasonMaxBytes
+			}
+			if reason == "" {
+				total += size
+				kept++
+				continue
+			}
+			candidates = append(candidates, GCCandidate{
+				JobID:      status.ID,
+				Tenant:     status.Tenant,
+				Template:   status.Template,
+				Rule:       name,
+				Reason:     reason,
+				Outputs:    outputs,
+				Bytes:      size,
+				FinishedAt: *status.FinishedAt,
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, k int) bool {
+		return candidates[i].FinishedAt.Before(candidates[k].FinishedAt)
+	})
+	return candidates
+}
+
+// Collect 回收按保留规则应当回收的任务，dryRun 为 true 时只返回将被回收的任务
+func (c *Collector) Collect(ctx context.Context, dryRun bool) GCReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := GCReport{DryRun: dryRun, Jobs: []GCCandidate{}}
+	for _, candidate := range c.Plan(time.Now()) {
+		if !dryRun {
+			job, err := c.jobs.Get(candidate.JobID)
+			if err != nil {
+				continue
+			}
+			// 规划之后被置顶的任务不再回收
+			if job.Status().Pinned {
+				continue
+			}
+			if err := c.jobs.purge(ctx, job, c.cfg.DeleteHistory); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("job %s: %v", candidate.JobID, err))
+				continue
+			}
+		}
+		report.Jobs = append(report.Jobs, candidate)
+		report.Bytes += candidate.Bytes
+	}
+	if !dryRun {
+		c.jobs.cache.Prune(time.Now())
+	}
+	return report
+}
+
+// family 返回任务及其子任务
+func (m *JobManager) family(job *Job) []*Job {
+	members := []*Job{job}
+	for _, item := range job.Status().Items {
+		if child, err := m.Get(item.JobID); err == nil && item.JobID != "" {
+			members = append(members, child)
+		}
+	}
+	return members
+}
+
+// outputUsage 返回任务及其子任务的输出文件数与总大小，批量任务合并的输出只计算一次。
+// 与其他任务共享的内容也计入，回收后不一定从存储中删除。
+func (m *JobManager) outputUsage(id string) (int, int64) {
+	job, err := m.Get(id)
+	if err != nil {
+		return 0, 0
+	}
+	seen := make(map[string]bool)
+	var size int64
+	for _, member := range m.family(job) {
+		for _, output := range member.Status().Outputs {
+			if output.Key == "" || seen[output.Key] {
+				continue
+			}
+			seen[output.Key] = true
+			size += int64(output.Size)
+		}
+	}
+	return len(seen), size
+}
+
+// purge 删除任务及其子任务的记录与存储中的输出，deleteHistory 为 true 时同时删除提示在 ComfyUI 上的历史记录
+func (m *JobManager) purge(ctx context.Context, job *Job, deleteHistory bool) error {
+	for _, member := range m.family(job) {
+		status := member.Status()
+		for _, output := range status.Outputs {
+			var err error
+			switch {
+			case output.SHA256 != "":
+				err = m.blobs.Release(ctx, status.ID, output.SHA256)
+			case output.Key != "":
+				// 按内容哈希存储之前的输出只属于该任务
+				err = m.storage.Delete(ctx, output.Key)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to delete output %s: %w", output.Key, err)
+			}
+		}
+		if deleteHistory {
+			// 后端可能已下线，历史记录删除失败不影响回收
+			if backend, promptID := member.getBackend(), member.getPromptID(); backend != nil && promptID != "" {
+				if err := backend.client.DeleteHistory(promptID); err != nil {
+					log.Printf("job %s: failed to delete history on backend %s: %v", status.ID, backend.Name, err)
+				}
+			}
+		}
+		m.mu.Lock()
+		delete(m.jobs, status.ID)
+		m.mu.Unlock()
+		if err := m.store.Delete(status.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pin 置顶或取消置顶任务，置顶的任务不会被回收
+func (m *JobManager) Pin(id string, pinned bool) (*Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	job.mu.Lock()
+	job.pinned = pinned
+	job.mu.Unlock()
+	m.persist(job)
+	return job, nil
+}
+
+// pinJob 置顶当前租户的任务
+func pinJob(c *gin.Context) {
+	setPinned(c, true)
+}
+
+// unpinJob 取消置顶当前租户的任务
+func unpinJob(c *gin.Context) {
+	setPinned(c, false)
+}
+
+func setPinned(c *gin.Context, pinned bool) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err == nil {
+		job, err = jobs.Pin(job.ID(), pinned)
+	}
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job.Status())
+}
+
+// gcReport 返回按当前保留规则将被回收的任务，不删除任何内容
+func gcReport(c *gin.Context) {
+	c.JSON(http.StatusOK, collector.Collect(c.Request.Context(), true))
+}
+
+// runGC 立即按保留规则回收任务
+func runGC(c *gin.Context) {
+	c.JSON(http.StatusOK, collector.Collect(c.Request.Context(), false))
+}
@@ -0,0 +1,339 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/gin-gonic/gin"
+)
+
+// 失败任务的错误类别，用于决定是否重试
+const (
+	ErrorClassDisconnect = "disconnect" // 与后端通信失败
+	ErrorClassOOM        = "oom"        // 显存或内存不足
+	ErrorClassTimeout    = "timeout"    // 执行超时，见 watchdog.go
+	ErrorClassExecution  = "execution"  // 其它执行错误
+	ErrorClassInvalid    = "invalid"    // 提示被 ComfyUI 拒绝
+)
+
+// 任务进入死信队列的原因
+const (
+	DeadLetterExhausted    = "retries_exhausted" // 错误可重试，但已达到 max_attempts
+	DeadLetterNotRetryable = "not_retryable"     // 错误类别不在策略的 retryable 中，如提示被 ComfyUI 拒绝
+	DeadLetterItemsFailed  = "items_failed"      // 批量或分块任务的子任务失败
+)
+
+// defaultRetryPolicy 是未指定模板或模板没有对应策略时使用的策略名称
+const defaultRetryPolicy = "default"
+
+// exceptionClasses 是内置的 exception_type 到错误类别的映射，可被配置覆盖
+var exceptionClasses = map[string]string{
+	"torch.cuda.OutOfMemoryError":          ErrorClassOOM,
+	"torch.OutOfMemoryError":               ErrorClassOOM,
+	"comfy.model_management.OOM_EXCEPTION": ErrorClassOOM,
+}
+
+// ErrNotDeadLetter 表示任务不在死信队列中
+var ErrNotDeadLetter = errors.New("job is not in the dead-letter queue")
+
+// ErrTileImageReleased 表示分块放大任务的输入图像已在创建全部分块后释放，无法重新提交
+var ErrTileImageReleased = errors.New("tile image was released after the tiles were created, submit a new job with the image")
+
+// ExecutionError 表示提示在 ComfyUI 上执行出错
+type ExecutionError struct {
+	comfyui.ExecutionErrorData
+}
+
+func (e *ExecutionError) Error() string {
+	return e.String()
+}
+
+// classify 返回任务失败的错误类别
+func (m *JobManager) classify(err error) string {
+	var execErr *ExecutionError
+	var timeoutErr *TimeoutError
+	var statusErr *comfyui.StatusError
+	switch {
+	case errors.As(err, &execErr):
+		if class := m.retry.Classes[execErr.ExceptionType]; class != "" {
+			return class
+		}
+		if class := exceptionClasses[execErr.ExceptionType]; class != "" {
+			return class
+		}
+		if strings.Contains(strings.ToLower(execErr.ExceptionMessage), "out of memory") {
+			return ErrorClassOOM
+		}
+		return ErrorClassExecution
+	case errors.As(err, &timeoutErr):
+		return ErrorClassTimeout
+	case errors.As(err, &statusErr) && statusErr.Code < 500:
+		return ErrorClassInvalid
+	default:
+		return ErrorClassDisconnect
+	}
+}
+
+// policy 返回任务模板对应的重试策略
+func (m *JobManager) policy(template string) RetryPolicy {
+	policy, ok := m.retry.Policies[template]
+	if !ok || template == "" {
+		policy = m.retry.Policies[defaultRetryPolicy]
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// backoff 返回第 attempts 次失败后的重试间隔，带 ±20% 抖动
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	delay := time.Duration(p.MinBackoff)
+	if delay <= 0 {
+		return 0
+	}
+	for i := 1; i < attempts && (p.MaxBackoff <= 0 || delay < time.Duration(p.MaxBackoff)); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > time.Duration(p.MaxBackoff) {
+		delay = time.Duration(p.MaxBackoff)
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
+
+// retryJob 按任务模板的重试策略判断失败的任务是否重试，需要重试时等待退避时间后返回 true。
+// 批量任务由各子任务自行重试，不整体重试。
+func (m *JobManager) retryJob(ctx context.Context, job *Job, err error) bool {
+	var partial *partialError
+	if job.items != nil || errors.Is(err, errInterrupted) || errors.As(err, &partial) {
+		return false
+	}
+	class := m.classify(err)
+	policy := m.policy(job.spec.Template)
+	attempts := job.Status().Retries + 1
+	switch {
+	case !slices.Contains(policy.Retryable, class):
+		job.setFailure(class, DeadLetterNotRetryable)
+		return false
+	case attempts >= policy.MaxAttempts:
+		job.setFailure(class, DeadLetterExhausted)
+		return false
+	}
+	job.setFailure(class, "")
+	delay := policy.backoff(attempts)
+	job.retry(fmt.Sprintf("attempt %d failed (%s): %v; retrying in %s", attempts, class, err, delay.Round(10*time.Millisecond)))
+	m.persist(job)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// setFailure 记录失败的错误类别，reason 为不再重试时进入死信队列的原因
+func (j *Job) setFailure(class, reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.errClass = class
+	j.deadReason = reason
+}
+
+// retry 将失败的任务重新置为排队中，并尽量避开出错的后端
+func (j *Job) retry(reason string) {
+	j.mu.Lock()
+	j.retries++
+	if j.backend != nil {
+		j.spec.Exclude = append(j.spec.Exclude, j.backend.Name)
+	}
+	j.mu.Unlock()
+	j.reschedule(reason)
+}
+
+// Requeue 以死信队列中任务的描述重新提交任务，modify 可以在提交前修改描述，原任务移出死信队列
+func (m *JobManager) Requeue(id string, modify func(spec *JobSpec)) (*Job, error) {
+	original, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	// 提交前先移出死信队列，并发的重新提交不会重复提交同一任务；提交失败时放回
+	original.mu.Lock()
+	if !original.dead {
+		original.mu.Unlock()
+		return nil, ErrNotDeadLetter
+	}
+	spec := original.spec
+	if spec.Tile != nil && len(spec.Tile.Image) == 0 {
+		original.mu.Unlock()
+		return nil, ErrTileImageReleased
+	}
+	original.dead = false
+	original.mu.Unlock()
+
+	// 换后端重试与上传记录只属于原任务
+	spec.Exclude = nil
+	spec.Uploads = nil
+	if spec.Tile != nil {
+		// 新任务释放输入图像时不影响原任务的记录
+		tile := *spec.Tile
+		spec.Tile = &tile
+	}
+	if modify != nil {
+		modify(&spec)
+	}
+	job, err := m.Submit(spec)
+	if err != nil {
+		original.mu.Lock()
+		original.dead = true
+		original.mu.Unlock()
+		return nil, err
+	}
+
+	original.mu.Lock()
+	original.requeuedAs = job.id
+	original.mu.Unlock()
+	m.persist(original)
+	return job, nil
+}
+
+// Discard 删除死信队列中的任务及其子任务，连同存储中的输出
+func (m *JobManager) Discard(id string) error {
+	job, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	status := job.Status()
+	if !status.DeadLetter {
+		return ErrNotDeadLetter
+	}
+	return m.purge(context.Background(), job, false)
+}
+
+// deadLetterEntry 是死信队列中任务的详情，带有原始工作流以便修改后重新提交
+type deadLetterEntry struct {
+	JobStatus
+	Workflow comfyui.Prompt `json:"workflow"`
+}
+
+// requeueRequest 是重新提交死信任务时的修改，未指定的字段沿用原任务
+type requeueRequest struct {
+	Workflow json.RawMessage `json:"workflow"`
+	Priority *string         `json:"priority"`
+	Template *string         `json:"template"`
+	Timeout  *Duration       `json:"timeout"`
+}
+
+// deadLetterJob 返回当前租户死信队列中的任务
+func deadLetterJob(c *gin.Context) (*Job, bool) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err == nil && !job.Status().DeadLetter {
+		err = ErrNotDeadLetter
+	}
+	if err != nil {
+		jobError(c, err)
+		return nil, false
+	}
+	return job, true
+}
+
+// listDeadLetters 返回当前租户死信队列中的任务
+func listDeadLetters(c *gin.Context) {
+	tenant := currentTenant(c)
+	statuses := []JobStatus{}
+	for _, status := range jobs.List() {
+		if status.DeadLetter && status.Tenant == tenant {
+			statuses = append(statuses, status)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": statuses})
+}
+
+// getDeadLetter 返回死信任务的状态、失败原因与原始工作流
+func getDeadLetter(c *gin.Context) {
+	job, ok := deadLetterJob(c)
+	if !ok {
+		return
+	}
+	job.mu.Lock()
+	prompt := job.spec.Prompt
+	job.mu.Unlock()
+	c.JSON(http.StatusOK, deadLetterEntry{JobStatus: job.Status(), Workflow: prompt})
+}
+
+// requeueDeadLetter 按需修改工作流、优先级、模板或超时后重新提交死信任务
+func requeueDeadLetter(c *gin.Context) {
+	if _, ok := deadLetterJob(c); !ok {
+		return
+	}
+	var req requeueRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var prompt *comfyui.Prompt
+	if len(req.Workflow) > 0 {
+		parsed, err := parseWorkflow(req.Workflow)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		prompt = &parsed
+	}
+	if req.Priority != nil {
+		if _, err := priorityLevel(*req.Priority); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Timeout != nil && *req.Timeout < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must not be negative"})
+		return
+	}
+
+	job, err := jobs.Requeue(c.Param("id"), func(spec *JobSpec) {
+		if prompt != nil {
+			spec.Prompt = *prompt
+		}
+		if req.Priority != nil {
+			spec.Priority = *req.Priority
+		}
+		if req.Template != nil {
+			spec.Template = *req.Template
+		}
+		if req.Timeout != nil {
+			spec.Timeout = *req.Timeout
+		}
+	})
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	c.Header("Location", "/api/jobs/"+job.ID())
+	c.JSON(http.StatusAccepted, job.Status())
+}
+
+// discardDeadLetter 删除死信任务
+func discardDeadLetter(c *gin.Context) {
+	if _, ok := deadLetterJob(c); !ok {
+		return
+	}
+	if err := jobs.Discard(c.Param("id")); err != nil {
+		jobError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -1,11 +1,72 @@
 package serve
 
 import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/fimreal/comfyui-api/src/provenance"
 	"github.com/gin-gonic/gin"
 )
 
 // StartServer 启动 Gin 服务器
-func StartServer() error {
+func StartServer(cfg *Config) error {
+	pool, err := NewPool(cfg.Pool)
+	if err != nil {
+		return err
+	}
+	pool.Start(context.Background())
+	backendPool = pool
+
+	// 恢复任务前先载入文件与 SRV 记录中的后端
+	discovery = NewDiscovery(pool, cfg.Pool.Discovery)
+	discovery.Start(context.Background())
+
+	store, err := NewJobStore(cfg.Store)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	storage, err := NewStorage(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	if _, ok := variantTypes[cfg.Thumbnails.Format]; !ok && cfg.Thumbnails.Format != "" {
+		return fmt.Errorf("unknown thumbnail format: %s", cfg.Thumbnails.Format)
+	}
+	jobs = NewJobManager(store, storage, pool, cfg.Timeouts, cfg.Retry, cfg.Cache, cfg.Thumbnails)
+	if cfg.Provenance.KeyFile != "" {
+		signer, err := provenance.LoadSigner(cfg.Provenance.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load provenance key: %w", err)
+		}
+		jobs.SetSigner(signer)
+	}
+	watermarks, err := NewWatermarker(cfg.Watermark)
+	if err != nil {
+		return err
+	}
+	jobs.SetWatermarker(watermarks)
+	tenants = cfg.Tenants
+	go jobs.Run(context.Background())
+	collector = NewCollector(jobs, cfg.Retention)
+	go collector.Run(context.Background())
+
+	if cfg.Webhook.Secret != "" {
+		dispatcher, err := NewWebhookDispatcher(cfg.Webhook, cfg.PublicURL)
+		if err != nil {
+			return err
+		}
+		webhooks = dispatcher
+		jobs.OnFinish(webhooks.jobFinished)
+		go webhooks.Run(context.Background())
+	}
+
+	// 回调需要在恢复任务之前注册，以便恢复后结束的任务也能触发回调
+	if err := jobs.Restore(); err != nil {
+		return err
+	}
+
 	r := gin.Default()
 	r.Static("/static", "./src/templates/static") // 访问静态资源
 	r.LoadHTMLGlob("src/templates/*")
@@ -13,7 +74,74 @@ func StartServer() error {
 	r.GET("/", showIndexPage)
 
 	// 设置处理工作流请求的API端点
-	r.POST("/api/process", processWorkflow)
+	r.POST("/api/process", tenantAuth(), processWorkflow)
+
+	// 客户端 WebSocket API
+	r.GET("/api/ws", tenantAuth(), serveWebSocket)
+
+	// 异步任务 API
+	api := r.Group("/api/jobs", tenantAuth())
+	api.POST("", createJob)
+	api.GET("", listJobs)
+	api.GET("/:id", getJob)
+	api.DELETE("/:id", cancelJob)
+	api.GET("/:id/events", streamJobEvents)
+	api.GET("/:id/outputs", listJobOutputs)
+	api.GET("/:id/outputs/:n", getJobOutput)
+	api.GET("/:id/archive", archiveJob)
+	api.PUT("/:id/pin", pinJob)
+	api.DELETE("/:id/pin", unpinJob)
+
+	// 按内容哈希下载输出
+	r.GET("/api/blobs/:sha256", tenantAuth(), getBlob)
+	r.GET("/api/archive", tenantAuth(), archiveJobs)
+	r.POST("/api/archive", tenantAuth(), archiveJobs)
+
+	// 读取图片中嵌入的工作流
+	r.POST("/api/inspect", tenantAuth(), inspectImage)
+
+	// 导入 A1111 / Forge 的生成参数
+	r.POST("/api/import/a1111", tenantAuth(), importA1111)
+
+	// 校验输出的来源签名
+	r.POST("/api/verify", verifyImage)
+	r.GET("/api/provenance/key", provenanceKey)
+
+	// 读取不可见水印中的任务 ID
+	r.POST("/api/watermark/detect", tenantAuth(), detectWatermark)
+
+	// 死信队列 API
+	dead := r.Group("/api/deadletter", tenantAuth())
+	dead.GET("", listDeadLetters)
+	dead.GET("/:id", getDeadLetter)
+	dead.POST("/:id/requeue", requeueDeadLetter)
+	dead.DELETE("/:id", discardDeadLetter)
+
+	// 管理 API
+	if cfg.AdminToken == "" {
+		log.Printf("admin_token is not configured; admin API is disabled")
+	}
+	admin := r.Group("/api/admin", adminAuth(cfg.AdminToken))
+	admin.GET("/backends", listBackends)
+	admin.GET("/backends/:name", getBackend)
+	admin.POST("/backends/:name/drain", drainBackend)
+	admin.DELETE("/backends/:name/drain", undrainBackend)
+	admin.GET("/gc", gcReport)
+	admin.POST("/gc", runGC)
+
+	// worker 注册 API，没有令牌时不开放，否则任何人都能把任意地址注册为后端并收到其他用户的提示
+	workerToken := cfg.Pool.Discovery.Token
+	if workerToken == "" {
+		workerToken = cfg.AdminToken
+	}
+	if workerToken != "" {
+		workers := r.Group("/api/workers", adminAuth(workerToken))
+		workers.POST("", registerWorker)
+		workers.POST("/:name/heartbeat", workerHeartbeat)
+		workers.DELETE("/:name", deregisterWorker)
+	} else {
+		log.Printf("neither pool.discovery.token nor admin_token is configured; worker registration is disabled")
+	}
 
-	return r.Run(":8080")
+	return r.Run(cfg.Listen)
 }
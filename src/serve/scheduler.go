@@ -0,0 +1,214 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 任务优先级，高优先级的任务总是先于低优先级的任务调度
+const (
+	PriorityInteractive = "interactive" // 交互请求，如同步接口
+	PriorityNormal      = "normal"      // 默认
+	PriorityBulk        = "bulk"        // 批量任务
+)
+
+// priorityLevels 按调度先后排列
+var priorityLevels = []string{PriorityInteractive, PriorityNormal, PriorityBulk}
+
+// priorityLevel 返回优先级的序号，空字符串视为 normal
+func priorityLevel(priority string) (int, error) {
+	if priority == "" {
+		priority = PriorityNormal
+	}
+	for level, name := range priorityLevels {
+		if name == priority {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority: %s", priority)
+}
+
+// scheduleInterval 是调度器在没有通知时重新检查后端状态的间隔，用于发现熔断恢复、取消排空等变化
+const scheduleInterval = time.Second
+
+// queueEntry 是服务端队列中等待调度的任务
+type queueEntry struct {
+	job    *Job
+	level  int
+	tenant string
+	ready  chan *Backend // 调度后收到已占用位置的后端
+}
+
+// Scheduler 是服务端任务队列。任务按优先级排序，同一优先级内按租户权重公平分配，
+// 只在后端已提交的任务数低于 queue_depth 时才提交，使 ComfyUI 自身的 FIFO 队列保持很浅。
+type Scheduler struct {
+	mu      sync.Mutex
+	pool    *Pool
+	entries []*queueEntry      // 按到达顺序排列
+	pass    map[string]float64 // 各租户的虚拟时间，每调度一个任务增加 1/权重
+	vtime   float64            // 最近一次调度的虚拟时间，重新变为活跃的租户从这里开始
+	kick    chan struct{}
+}
+
+// NewScheduler 创建调度器
+func NewScheduler(pool *Pool) *Scheduler {
+	return &Scheduler{
+		pool: pool,
+		pass: make(map[string]float64),
+		kick: make(chan struct{}, 1),
+	}
+}
+
+// Wait 将任务放入队列，阻塞到任务被调度到后端并返回该后端，调用方负责 release
+func (s *Scheduler) Wait(ctx context.Context, job *Job) (*Backend, error) {
+	level, err := priorityLevel(job.spec.Priority)
+	if err != nil {
+		return nil, err
+	}
+	entry := &queueEntry{job: job, level: level, tenant: job.spec.Tenant, ready: make(chan *Backend, 1)}
+
+	s.mu.Lock()
+	if !s.activeLocked(entry.tenant) && s.pass[entry.tenant] < s.vtime {
+		// 闲置期间不积累额度，避免租户回来后独占后端
+		s.pass[entry.tenant] = s.vtime
+	}
+	s.entries = append(s.entries, entry)
+	s.mu.Unlock()
+	s.Kick()
+
+	select {
+	case backend := <-entry.ready:
+		return backend, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		removed := s.removeLocked(entry)
+		s.mu.Unlock()
+		if !removed {
+			// 取消的同时已被调度，归还占用的位置
+			(<-entry.ready).release()
+		}
+		s.Kick()
+		return nil, ctx.Err()
+	}
+}
+
+// Kick 请求调度器尽快检查队列
+func (s *Scheduler) Kick() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run 在后端空出位置或队列变化时调度任务，直到 ctx 结束
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.kick:
+		case <-s.pool.Changed():
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		s.dispatch()
+	}
+}
+
+// dispatch 按调度顺序将任务提交到有空闲位置的后端，并更新仍在排队的任务的位置
+func (s *Scheduler) dispatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		dispatched := false
+		for _, entry := range s.orderLocked() {
+			// 排在前面的任务所需的模型或节点没有空闲后端时，后面的任务可以先行
+			backend, err := s.pool.Pick(entry.job.spec.Prompt, entry.job.spec.Exclude)
+			if err != nil {
+				continue
+			}
+			backend.acquire()
+			s.removeLocked(entry)
+			s.vtime = s.pass[entry.tenant]
+			s.pass[entry.tenant] += 1 / float64(tenantWeight(entry.tenant))
+			entry.ready <- backend
+			dispatched = true
+			break
+		}
+		if !dispatched {
+			break
+		}
+	}
+
+	for position, entry := range s.orderLocked() {
+		entry.job.setPosition(position)
+	}
+}
+
+// orderLocked 模拟调度过程，返回队列中任务的调度顺序：
+// 先按优先级，同一优先级内每次选择虚拟时间最小的租户，租户内先到先得
+func (s *Scheduler) orderLocked() []*queueEntry {
+	queues := make([]map[string][]*queueEntry, len(priorityLevels))
+	for _, entry := range s.entries {
+		if queues[entry.level] == nil {
+			queues[entry.level] = make(map[string][]*queueEntry)
+		}
+		queues[entry.level][entry.tenant] = append(queues[entry.level][entry.tenant], entry)
+	}
+
+	pass := make(map[string]float64, len(s.pass))
+	for tenant, value := range s.pass {
+		pass[tenant] = value
+	}
+
+	ordered := make([]*queueEntry, 0, len(s.entries))
+	for _, queue := range queues {
+		tenantNames := make([]string, 0, len(queue))
+		for tenant := range queue {
+			tenantNames = append(tenantNames, tenant)
+		}
+		sort.Strings(tenantNames)
+
+		for len(queue) > 0 {
+			next := ""
+			for _, tenant := range tenantNames {
+				if len(queue[tenant]) > 0 && (next == "" || pass[tenant] < pass[next]) {
+					next = tenant
+				}
+			}
+			ordered = append(ordered, queue[next][0])
+			queue[next] = queue[next][1:]
+			if len(queue[next]) == 0 {
+				delete(queue, next)
+			}
+			pass[next] += 1 / float64(tenantWeight(next))
+		}
+	}
+	return ordered
+}
+
+// activeLocked 判断租户是否有任务在排队
+func (s *Scheduler) activeLocked(tenant string) bool {
+	for _, entry := range s.entries {
+		if entry.tenant == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLocked 从队列中移除任务，任务不在队列中时返回 false
+func (s *Scheduler) removeLocked(target *queueEntry) bool {
+	for i, entry := range s.entries {
+		if entry == target {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
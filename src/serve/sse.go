@@ -0,0 +1,79 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseHeartbeat 是 SSE 心跳间隔，防止代理因空闲断开连接
+const sseHeartbeat = 15 * time.Second
+
+// writeSSE 按 SSE 格式写出一条事件
+func writeSSE(w io.Writer, event JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// streamJobEvents 以 SSE 推送任务事件，支持通过 Last-Event-ID 断线续传
+func streamJobEvents(c *gin.Context) {
+	job, err := jobForTenant(c, c.Param("id"))
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id") // EventSource 无法自定义首次请求的头
+	}
+	var after int64
+	if lastID != "" {
+		if after, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		events, changed, terminal := job.EventsSince(after)
+		for _, event := range events {
+			if err := writeSSE(c.Writer, event); err != nil {
+				return
+			}
+			after = event.ID
+		}
+		c.Writer.Flush()
+		if terminal {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrObjectNotFound 表示输出存储中没有该对象
+var ErrObjectNotFound = errors.New("object not found in storage")
+
+// Storage 保存任务的输出文件
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	// List 返回以 prefix 开头的全部对象键
+	List(ctx context.Context, prefix string) ([]string, error)
+	// URL 返回可直接下载对象的地址，为空时通过任务输出接口下载
+	URL(key string) string
+}
+
+// NewStorage 根据配置创建输出存储
+func NewStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", "local":
+		return NewLocalStorage(cfg.Path)
+	case "s3":
+		return NewS3Storage(cfg.S3)
+	case "memory":
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", cfg.Type)
+	}
+}
+
+// validKey 检查键不为空且不含 ..、空段或开头的 /，避免逃出存储目录
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid storage key: %q", key)
+	}
+	return nil
+}
+
+// MemoryStorage 是保存在内存中的输出存储，重启后丢失
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+// NewMemoryStorage 创建内存输出存储
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string][]byte)}
+}
+
+// Put 保存对象
+func (s *MemoryStorage) Put(_ context.Context, key string, data []byte, _ string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// Get 读取对象
+func (s *MemoryStorage) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return data, nil
+}
+
+// Delete 删除对象
+func (s *MemoryStorage) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// List 返回以 prefix 开头的对象键
+func (s *MemoryStorage) List(_ context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// URL 内存存储的对象只能通过任务输出接口下载
+func (s *MemoryStorage) URL(string) string {
+	return ""
+}
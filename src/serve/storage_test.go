@@ -0,0 +1,99 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]Storage{"memory": NewMemoryStorage(), "local": local} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			data := []byte("png")
+			if err := s.Put(ctx, "blobs/ab/abcd", data, "image/png"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put(ctx, "blobs/cd/cdef", []byte("jpeg"), "image/jpeg"); err != nil {
+				t.Fatal(err)
+			}
+			// 保存后修改调用方的数据不影响已保存的对象
+			data[0] = 'x'
+
+			got, err := s.Get(ctx, "blobs/ab/abcd")
+			if err != nil || string(got) != "png" {
+				t.Fatalf("Get = %q, %v", got, err)
+			}
+			keys, err := s.List(ctx, "blobs/")
+			if err != nil || !slices.Equal(keys, []string{"blobs/ab/abcd", "blobs/cd/cdef"}) {
+				t.Fatalf("List = %v, %v", keys, err)
+			}
+
+			if err := s.Delete(ctx, "blobs/ab/abcd"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(ctx, "blobs/ab/abcd"); !errors.Is(err, ErrObjectNotFound) {
+				t.Fatalf("Get after Delete: %v, want %v", err, ErrObjectNotFound)
+			}
+			// 删除不存在的对象不报错
+			if err := s.Delete(ctx, "blobs/ab/abcd"); err != nil {
+				t.Fatalf("Delete missing object: %v", err)
+			}
+			keys, err = s.List(ctx, "blobs/")
+			if err != nil || !slices.Equal(keys, []string{"blobs/cd/cdef"}) {
+				t.Fatalf("List after Delete = %v, %v", keys, err)
+			}
+
+			for _, key := range []string{"", "/abs", "../escape", "a/../../b", "a//b"} {
+				if err := s.Put(ctx, key, []byte("x"), ""); err == nil {
+					t.Errorf("Put(%q) accepted an invalid key", key)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalStorageConcurrentPut(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// 各次写入的长度不同，交错写入会留下混合的内容
+			errs <- s.Put(ctx, "blobs/ab/abcd", bytes.Repeat([]byte{byte('a' + i)}, (i+1)<<13), "")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Put: %v", err)
+		}
+	}
+
+	// 对象是某一次写入的完整内容，没有残留的临时文件
+	data, err := s.Get(ctx, "blobs/ab/abcd")
+	if err != nil || len(data) == 0 || len(data) != int(data[0]-'a'+1)<<13 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+		t.Fatalf("object is corrupt: %d bytes, %v", len(data), err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "blobs", "ab"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("directory has %d entries, want 1: %v", len(entries), err)
+	}
+}
@@ -0,0 +1,155 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+)
+
+// JobTransition 记录一次任务状态变化
+type JobTransition struct {
+	State  JobState  `json:"state"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// OutputRecord 是输出的持久化形式，Ref 指向 ComfyUI 上的原始文件
+type OutputRecord struct {
+	JobOutput
+	Ref     comfyui.ImageRef `json:"ref"`
+	Backend string           `json:"backend,omitempty"` // 产生该输出的后端，为空时与任务的后端相同
+}
+
+// JobRecord 是任务的持久化形式
+type JobRecord struct {
+	ID          string          `json:"id"`
+	State       JobState        `json:"state"`
+	Error       string          `json:"error,omitempty"`
+	Prompt      comfyui.Prompt  `json:"prompt"`
+	Backend     string          `json:"backend,omitempty"` // 后端名称
+	PromptID    string          `json:"prompt_id,omitempty"`
+	CallbackURL string          `json:"callback_url,omitempty"`
+	Priority    string          `json:"priority,omitempty"`
+	Tenant      string          `json:"tenant,omitempty"`
+	Batch       *BatchOptions   `json:"batch,omitempty"`
+	Items       []BatchItem     `json:"items,omitempty"`
+	ParentID    string          `json:"parent_id,omitempty"`
+	Exclude     []string        `json:"exclude,omitempty"`
+	Tile        *TileOptions    `json:"tile,omitempty"`
+	Uploads     []Upload        `json:"uploads,omitempty"`
+	Timeout     Duration        `json:"timeout,omitempty"`
+	Failovers   int             `json:"failovers,omitempty"`
+	Template    string          `json:"template,omitempty"`
+	Version     string          `json:"template_version,omitempty"`
+	Retries     int             `json:"retries,omitempty"`
+	ErrorClass  string          `json:"error_class,omitempty"`
+	DeadLetter  bool            `json:"dead_letter,omitempty"`
+	DeadReason  string          `json:"dead_letter_reason,omitempty"`
+	RequeuedAs  string          `json:"requeued_as,omitempty"`
+	Pinned      bool            `json:"pinned,omitempty"`
+	Cache       string          `json:"cache,omitempty"`
+	PromptHash  string          `json:"prompt_hash,omitempty"`
+	CachedFrom  string          `json:"cached_from,omitempty"`
+	Seq         int64           `json:"seq,omitempty"` // 持久化时已发出的最大事件 ID
+	Outputs     []OutputRecord  `json:"outputs,omitempty"`
+	History     []JobTransition `json:"history,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   time.Time       `json:"started_at,omitempty"`
+	FinishedAt  time.Time       `json:"finished_at,omitempty"`
+}
+
+// JobStore 保存任务记录
+type JobStore interface {
+	Save(record *JobRecord) error
+	Get(id string) (*JobRecord, error)
+	List() ([]*JobRecord, error)
+	Delete(id string) error
+	Close() error
+}
+
+// NewJobStore 根据配置创建任务存储
+func NewJobStore(cfg StoreConfig) (JobStore, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return NewMemoryJobStore(), nil
+	case "bolt":
+		return NewBoltJobStore(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown job store type: %s", cfg.Type)
+	}
+}
+
+// MemoryJobStore 是保存在内存中的任务存储，重启后丢失
+type MemoryJobStore struct {
+	mu      sync.RWMutex
+	records map[string][]byte
+}
+
+// NewMemoryJobStore 创建内存任务存储
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{records: make(map[string][]byte)}
+}
+
+// Save 保存任务记录
+func (s *MemoryJobStore) Save(record *JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.ID] = data
+	return nil
+}
+
+// Get 读取任务记录
+func (s *MemoryJobStore) Get(id string) (*JobRecord, error) {
+	s.mu.RLock()
+	data, ok := s.records[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	var record JobRecord
+	return &record, json.Unmarshal(data, &record)
+}
+
+// List 返回全部任务记录，按创建时间排序
+func (s *MemoryJobStore) List() ([]*JobRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]*JobRecord, 0, len(s.records))
+	for _, data := range s.records {
+		var record JobRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// Delete 删除任务记录
+func (s *MemoryJobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+// Close 关闭存储
+func (s *MemoryJobStore) Close() error {
+	return nil
+}
+
+// sortRecords 按创建时间排序任务记录
+func sortRecords(records []*JobRecord) {
+	sort.Slice(records, func(i, k int) bool {
+		return records[i].CreatedAt.Before(records[k].CreatedAt)
+	})
+}
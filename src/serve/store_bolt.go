@@ -0,0 +1,98 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// jobsBucket 是保存任务记录的 bucket
+var jobsBucket = []byte("jobs")
+
+// BoltJobStore 是基于 bbolt 的本地磁盘任务存储
+type BoltJobStore struct {
+	db *bolt.DB
+}
+
+// NewBoltJobStore 打开或创建 bbolt 数据库文件
+func NewBoltJobStore(path string) (*BoltJobStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltJobStore{db: db}, nil
+}
+
+// Save 保存任务记录
+func (s *BoltJobStore) Save(record *JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(record.ID), data)
+	})
+}
+
+// Get 读取任务记录
+func (s *BoltJobStore) Get(id string) (*JobRecord, error) {
+	var record JobRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrJobNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// List 返回全部任务记录，按创建时间排序
+func (s *BoltJobStore) List() ([]*JobRecord, error) {
+	var records []*JobRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, data []byte) error {
+			var record JobRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, &record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// Delete 删除任务记录
+func (s *BoltJobStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+// Close 关闭数据库
+func (s *BoltJobStore) Close() error {
+	return s.db.Close()
+}
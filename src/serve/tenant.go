@@ -0,0 +1,64 @@
+package serve
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultTenant 是未配置租户时全部任务所属的租户
+const defaultTenant = "default"
+
+// tenantKey 是 gin.Context 中保存当前租户名称的键
+const tenantKey = "tenant"
+
+// tenants 是配置的租户，为空时不校验 API key，由 StartServer 初始化
+var tenants []TenantConfig
+
+// tenantWeight 返回租户在公平调度中的权重，未知租户为 1
+func tenantWeight(name string) int {
+	for _, tenant := range tenants {
+		if tenant.Name == name && tenant.Weight > 0 {
+			return tenant.Weight
+		}
+	}
+	return 1
+}
+
+// tenantAuth 根据 X-API-Key、Bearer 令牌或 api_key 查询参数（供无法设置请求头的 WebSocket 客户端使用）识别租户，
+// 未配置租户时全部请求属于 default
+func tenantAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(tenants) == 0 {
+			c.Set(tenantKey, defaultTenant)
+			c.Next()
+			return
+		}
+
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			key = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if key == "" {
+			key = c.Query("api_key")
+		}
+		for _, tenant := range tenants {
+			if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(tenant.APIKey)) == 1 {
+				c.Set(tenantKey, tenant.Name)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+	}
+}
+
+// currentTenant 返回请求所属的租户
+func currentTenant(c *gin.Context) string {
+	if name := c.GetString(tenantKey); name != "" {
+		return name
+	}
+	return defaultTenant
+}
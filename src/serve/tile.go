@@ -0,0 +1,376 @@
+package serve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+
+	"github.com/fimreal/comfyui-api/src/comfyui"
+	"github.com/google/uuid"
+)
+
+// 分块放大的默认参数
+const (
+	defaultTileSize    = 512
+	defaultTileOverlap = 64
+)
+
+// TileOptions 描述分块放大：输入图像被切分为相互重叠的分块，每块由工作流模板在不同后端上处理，结果羽化拼接为一张图像
+type TileOptions struct {
+	Image   []byte `json:"image,omitempty"`   // 输入图像，base64 编码的 PNG 或 JPEG；全部分块子任务创建后不再保存
+	Node    string `json:"node,omitempty"`    // 接收分块的 LoadImage 节点 ID，工作流中只有一个 LoadImage 时可省略
+	Size    int    `json:"size,omitempty"`    // 分块边长，默认 512
+	Overlap int    `json:"overlap,omitempty"` // 相邻分块的重叠像素，默认 64
+	Retries int    `json:"retries,omitempty"` // 失败的分块在其他后端上重试的次数
+}
+
+// TileRect 是分块在输入图像中的区域
+type TileRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Upload 是提交提示前上传到所分配后端的图像，上传后的文件名写入节点的输入
+type Upload struct {
+	Node     string `json:"node"`
+	Input    string `json:"input"`
+	Filename string `json:"filename"`
+	Data     []byte `json:"data"`
+}
+
+// checkTiles 校验分块选项与输入图像的格式，只读取图像尺寸，供提交前校验请求使用
+func checkTiles(prompt comfyui.Prompt, opts *TileOptions) error {
+	if err := tileOptions(prompt, opts); err != nil {
+		return err
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(opts.Image)); err != nil {
+		return fmt.Errorf("invalid tile image: %w", err)
+	}
+	return nil
+}
+
+// tileOptions 校验分块选项并填入默认值，未指定节点时找出工作流中唯一的 LoadImage 节点
+func tileOptions(prompt comfyui.Prompt, opts *TileOptions) error {
+	if len(opts.Image) == 0 {
+		return errors.New("tile requires an image")
+	}
+	if opts.Size <= 0 {
+		opts.Size = defaultTileSize
+	}
+	if opts.Overlap == 0 {
+		opts.Overlap = defaultTileOverlap
+	}
+	if opts.Overlap < 0 || opts.Overlap >= opts.Size {
+		return errors.New("tile overlap must be between 0 and the tile size")
+	}
+	if opts.Retries < 0 {
+		return errors.New("tile retries must not be negative")
+	}
+
+	if opts.Node == "" {
+		for id, node := range prompt.Nodes {
+			if node.ClassType == "LoadImage" {
+				if opts.Node != "" {
+					return errors.New("workflow has several LoadImage nodes; set tile.node")
+				}
+				opts.Node = id
+			}
+		}
+		if opts.Node == "" {
+			return errors.New("workflow has no LoadImage node")
+		}
+	} else if _, ok := prompt.Nodes[opts.Node]; !ok {
+		return fmt.Errorf("tile node %s not found in workflow", opts.Node)
+	}
+
+	return nil
+}
+
+// expandTiles 校验分块选项、解码输入图像并按行优先顺序生成分块子任务，
+// 返回去掉 LoadImage 图像输入的工作流模板与解码后的图像，各分块从中裁剪
+func expandTiles(prompt comfyui.Prompt, opts *TileOptions) (comfyui.Prompt, []BatchItem, image.Image, error) {
+	if err := tileOptions(prompt, opts); err != nil {
+		return prompt, nil, nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(opts.Image))
+	if err != nil {
+		return prompt, nil, nil, fmt.Errorf("invalid tile image: %w", err)
+	}
+	size := src.Bounds().Size()
+	var items []BatchItem
+	for _, y := range tilePositions(size.Y, opts.Size, opts.Overlap) {
+		for _, x := range tilePositions(size.X, opts.Size, opts.Overlap) {
+			tile := &TileRect{X: x, Y: y, Width: min(opts.Size, size.X), Height: min(opts.Size, size.Y)}
+			items = append(items, BatchItem{Index: len(items), State: JobQueued, Tile: tile})
+		}
+	}
+
+	// 模板中的图像由各分块上传后填入，不参与模型与节点的检查
+	template, err := patchInputs(prompt, func(id string, values map[string]interface{}) {
+		if id == opts.Node {
+			delete(values, "image")
+		}
+	})
+	return template, items, src, err
+}
+
+// tilePositions 返回一个方向上各分块的起点，相邻分块至少重叠 overlap，最后一块与边缘对齐
+func tilePositions(length, size, overlap int) []int {
+	if length <= size {
+		return []int{0}
+	}
+	var positions []int
+	for pos := 0; ; pos += size - overlap {
+		if pos+size >= length {
+			return append(positions, length-size)
+		}
+		positions = append(positions, pos)
+	}
+}
+
+// tileUpload 从解码后的输入图像中裁剪出子任务的分块，编码为 PNG 作为子任务的上传图像
+func tileUpload(src image.Image, node string, item BatchItem) (Upload, error) {
+	tile := item.Tile
+	crop := image.NewNRGBA(image.Rect(0, 0, tile.Width, tile.Height))
+	draw.Draw(crop, crop.Bounds(), src, src.Bounds().Min.Add(image.Pt(tile.X, tile.Y)), draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, crop); err != nil {
+		return Upload{}, err
+	}
+	return Upload{
+		Node:     node,
+		Input:    "image",
+		Filename: fmt.Sprintf("tile_%s.png", uuid.New().String()),
+		Data:     buf.Bytes(),
+	}, nil
+}
+
+// getTileSource 返回分块放大任务解码后的输入图像，已释放时为 nil
+func (j *Job) getTileSource() image.Image {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.tileSource
+}
+
+// decodeTileSource 在尚有分块子任务未创建而输入图像未解码时（如重启后）解码保存的输入图像
+func (j *Job) decodeTileSource() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.tileSource != nil || len(j.spec.Tile.Image) == 0 || j.tilesCreatedLocked() {
+		return nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(j.spec.Tile.Image))
+	if err != nil {
+		return fmt.Errorf("invalid tile image: %w", err)
+	}
+	j.tileSource = src
+	return nil
+}
+
+// releaseTileSource 在全部分块子任务创建后释放输入图像，此后持久化的记录中不再包含原图
+func (j *Job) releaseTileSource() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.spec.Tile == nil || !j.tilesCreatedLocked() {
+		return
+	}
+	j.tileSource = nil
+	j.spec.Tile.Image = nil
+}
+
+// releaseUploads 在子任务结束且不再重试后释放其上传图像，有释放时返回 true
+func (j *Job) releaseUploads() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.spec.Uploads) == 0 || !j.state.Terminal() {
+		return false
+	}
+	j.spec.Uploads = nil
+	return true
+}
+
+func (j *Job) tilesCreatedLocked() bool {
+	for _, item := range j.items {
+		if item.JobID == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// tileRecord 返回分块选项的副本，持久化时在锁外编码而输入图像可能被释放
+func (j *Job) tileRecord() *TileOptions {
+	if j.spec.Tile == nil {
+		return nil
+	}
+	tile := *j.spec.Tile
+	return &tile
+}
+
+// preparePrompt 将任务的图像上传到后端并把文件名写入对应节点的输入，返回要提交的提示
+func preparePrompt(backend *Backend, spec JobSpec) (comfyui.Prompt, error) {
+	if len(spec.Uploads) == 0 {
+		return spec.Prompt, nil
+	}
+	names := make(map[string]map[string]string)
+	for _, upload := range spec.Uploads {
+		ref, err := backend.client.UploadImage(upload.Filename, upload.Data, "input")
+		if err != nil {
+			return comfyui.Prompt{}, fmt.Errorf("failed to upload %s: %w", upload.Filename, err)
+		}
+		name := ref.Filename
+		if ref.Subfolder != "" {
+			name = ref.Subfolder + "/" + name
+		}
+		if names[upload.Node] == nil {
+			names[upload.Node] = make(map[string]string)
+		}
+		names[upload.Node][upload.Input] = name
+	}
+	return patchInputs(spec.Prompt, func(id string, values map[string]interface{}) {
+		for input, name := range names[id] {
+			values[input] = name
+		}
+	})
+}
+
+// stitchTiles 按行优先顺序将各分块的第一个输出羽化拼接，结果作为任务的唯一输出存入输出存储。
+// 放大倍数由第一个分块的输出尺寸决定，任一分块失败时任务失败。
+func (m *JobManager) stitchTiles(parent *Job) ([]JobOutput, error) {
+	items := parent.Status().Items
+	failed := 0
+	for _, item := range items {
+		if item.State != JobSucceeded {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("%d of %d tiles failed", failed, len(items))
+	}
+
+	var canvas *image.NRGBA
+	var first JobOutput
+	scaleX, scaleY := 0.0, 0.0
+	for i, item := range items {
+		child, err := m.Get(item.JobID)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		output, data, err := child.Output(0)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: invalid output image: %w", i, err)
+		}
+		tile := toNRGBA(decoded)
+
+		rect := item.Tile
+		if canvas == nil {
+			first = output
+			scaleX = float64(tile.Rect.Dx()) / float64(rect.Width)
+			scaleY = float64(tile.Rect.Dy()) / float64(rect.Height)
+			width, height := 0, 0
+			for _, item := range items {
+				width = max(width, item.Tile.X+item.Tile.Width)
+				height = max(height, item.Tile.Y+item.Tile.Height)
+			}
+			canvas = image.NewNRGBA(image.Rect(0, 0, scaled(width, scaleX), scaled(height, scaleY)))
+		}
+		wantX, wantY := scaled(rect.Width, scaleX), scaled(rect.Height, scaleY)
+		if abs(tile.Rect.Dx()-wantX) > 1 || abs(tile.Rect.Dy()-wantY) > 1 {
+			return nil, fmt.Errorf("tile %d: output is %dx%d, expected %dx%d", i, tile.Rect.Dx(), tile.Rect.Dy(), wantX, wantY)
+		}
+
+		overlapX, overlapY := tileOverlaps(items, i)
+		at := image.Pt(scaled(rect.X, scaleX), scaled(rect.Y, scaleY))
+		blendTile(canvas, tile, at, scaled(overlapX, scaleX), scaled(overlapY, scaleY))
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	return []JobOutput{{
+		Index:       0,
+		NodeID:      first.NodeID,
+		Filename:    fmt.Sprintf("upscale_%s.png", parent.id),
+		ContentType: "image/png",
+		Size:        len(data),
+		URL:         fmt.Sprintf("/api/jobs/%s/outputs/0", parent.id),
+		data:        data,
+	}}, nil
+}
+
+// tileOverlaps 返回第 i 个分块与左侧、上方分块重叠的像素，没有相邻分块时为 0
+func tileOverlaps(items []BatchItem, i int) (int, int) {
+	tile := items[i].Tile
+	overlapX, overlapY := 0, 0
+	for _, item := range items[:i] {
+		other := item.Tile
+		if other.Y == tile.Y && other.X < tile.X {
+			overlapX = max(overlapX, other.X+other.Width-tile.X)
+		}
+		if other.X == tile.X && other.Y < tile.Y {
+			overlapY = max(overlapY, other.Y+other.Height-tile.Y)
+		}
+	}
+	return overlapX, overlapY
+}
+
+// blendTile 将分块叠加到画布的 at 处。与左侧、上方已放置分块重叠的 rampX、rampY 像素内，
+// 分块的权重从 0 线性增加到 1，其余部分直接覆盖，从而消除拼接缝
+func blendTile(canvas, tile *image.NRGBA, at image.Point, rampX, rampY int) {
+	bounds := canvas.Rect
+	for y := 0; y < tile.Rect.Dy() && at.Y+y < bounds.Max.Y; y++ {
+		weightY := ramp(y, rampY)
+		for x := 0; x < tile.Rect.Dx() && at.X+x < bounds.Max.X; x++ {
+			weight := weightY * ramp(x, rampX)
+			dst := canvas.Pix[canvas.PixOffset(at.X+x, at.Y+y):]
+			src := tile.Pix[tile.PixOffset(x, y):]
+			for c := 0; c < 4; c++ {
+				dst[c] = uint8(float64(dst[c])*(1-weight) + float64(src[c])*weight + 0.5)
+			}
+		}
+	}
+}
+
+// ramp 返回距边缘 pos 像素处的羽化权重，width 为羽化宽度
+func ramp(pos, width int) float64 {
+	if pos >= width {
+		return 1
+	}
+	return (float64(pos) + 0.5) / float64(width)
+}
+
+// toNRGBA 将图像转换为原点在 (0, 0) 的 NRGBA 图像
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+func scaled(value int, scale float64) int {
+	return int(math.Round(float64(value) * scale))
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,309 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/fimreal/comfyui-api/src/webp"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // 注册 WebP 解码
+)
+
+// 转码后的最大宽高与可解码的最大像素数
+const (
+	maxVariantSize     = 4096
+	maxSourcePixels    = 1 << 26
+	defaultJPEGQuality = 90
+)
+
+// 缩放方式
+const (
+	FitContain = "contain" // 等比缩放到框内，不放大（默认）
+	FitCover   = "cover"   // 等比缩放并居中裁剪，填满整个框
+	FitFill    = "fill"    // 拉伸到指定宽高
+)
+
+// ErrNotImage 表示输出不是可以转码的图片
+var ErrNotImage = errors.New("output is not a supported image")
+
+// variantTypes 是支持的输出格式及其 Content-Type
+var variantTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// Variant 是输出的转码参数
+type Variant struct {
+	Format  string // png、jpeg 或 webp，为空时保持原格式
+	Quality int    // JPEG 质量 1-100，默认 90；WebP 为无损编码，忽略质量
+	Width   int    // 为 0 时按高度等比缩放
+	Height  int    // 为 0 时按宽度等比缩放
+	Fit     string // 同时指定宽高时的缩放方式：contain、cover 或 fill
+}
+
+// parseVariant 从查询参数 format、quality、width、height、fit 读取转码参数，都没有时返回 nil
+func parseVariant(c *gin.Context) (*Variant, error) {
+	query := c.Request.URL.Query()
+	if !query.Has("format") && !query.Has("quality") && !query.Has("width") && !query.Has("height") && !query.Has("fit") {
+		return nil, nil
+	}
+	v := &Variant{Format: strings.ToLower(query.Get("format")), Fit: strings.ToLower(query.Get("fit"))}
+	for name, field := range map[string]*int{"quality": &v.Quality, "width": &v.Width, "height": &v.Height} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", name, value)
+			}
+			*field = n
+		}
+	}
+	if v.Format == "jpg" {
+		v.Format = "jpeg"
+	}
+	if _, ok := variantTypes[v.Format]; !ok && v.Format != "" {
+		return nil, fmt.Errorf("invalid format %q, expected png, jpeg or webp", v.Format)
+	}
+	if query.Get("quality") != "" && (v.Quality < 1 || v.Quality > 100) {
+		return nil, errors.New("quality must be between 1 and 100")
+	}
+	if v.Width < 0 || v.Height < 0 || v.Width > maxVariantSize || v.Height > maxVariantSize {
+		return nil, fmt.Errorf("width and height must be between 0 and %d", maxVariantSize)
+	}
+	switch v.Fit {
+	case "", FitContain, FitCover, FitFill:
+	default:
+		return nil, fmt.Errorf("invalid fit %q, expected contain, cover or fill", v.Fit)
+	}
+	return v, nil
+}
+
+// resolve 按原内容的类型补全格式，并去掉不影响结果的参数，使相同的结果对应同一个缓存键
+func (v Variant) resolve(contentType string) Variant {
+	if v.Format == "" {
+		v.Format = "png"
+		for format, ct := range variantTypes {
+			if ct == contentType {
+				v.Format = format
+			}
+		}
+	}
+	if v.Format == "jpeg" {
+		if v.Quality == 0 {
+			v.Quality = defaultJPEGQuality
+		}
+	} else {
+		v.Quality = 0
+	}
+	if v.Width == 0 || v.Height == 0 {
+		v.Fit = ""
+	} else if v.Fit == "" {
+		v.Fit = FitContain
+	}
+	return v
+}
+
+// name 返回转码结果的文件名，如 256x256-cover.webp、0x0-q85.jpeg
+func (v Variant) name() string {
+	name := fmt.Sprintf("%dx%d", v.Width, v.Height)
+	if v.Fit != "" {
+		name += "-" + v.Fit
+	}
+	if v.Quality > 0 {
+		name += fmt.Sprintf("-q%d", v.Quality)
+	}
+	return name + "." + v.Format
+}
+
+// contentType 返回转码结果的 Content-Type
+func (v Variant) contentType() string {
+	return variantTypes[v.Format]
+}
+
+// query 返回下载该转码结果的查询参数
+func (v Variant) query() string {
+	query := url.Values{"format": {v.Format}}
+	if v.Width > 0 {
+		query.Set("width", strconv.Itoa(v.Width))
+	}
+	if v.Height > 0 {
+		query.Set("height", strconv.Itoa(v.Height))
+	}
+	if v.Fit != "" {
+		query.Set("fit", v.Fit)
+	}
+	if v.Quality > 0 {
+		query.Set("quality", strconv.Itoa(v.Quality))
+	}
+	return query.Encode()
+}
+
+// filename 将输出文件名的扩展名替换为转码后的格式
+func (v Variant) filename(original string) string {
+	return strings.TrimSuffix(original, path.Ext(original)) + "." + v.Format
+}
+
+// variantPrefix 返回内容的全部转码结果在输出存储中的键前缀
+func variantPrefix(sum string) string {
+	return "variants/sha256/" + sum[:2] + "/" + sum + "/"
+}
+
+// transcode 按参数缩放并重新编码图片，v 需已经过 resolve
+func transcode(data []byte, v Variant) ([]byte, error) {
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeImage(resize(src, v), v.Format, v.Quality)
+}
+
+// decodeImage 解码 PNG、JPEG 或 WebP 图片，像素数超过上限时视为不支持
+func decodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > maxSourcePixels {
+		return nil, ErrNotImage
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	return img, nil
+}
+
+// encodeImage 按格式编码图片，JPEG 的透明背景合成为白色
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+	case "webp":
+		err = webp.Encode(&buf, img)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// resize 按宽高与缩放方式缩放图片，不需要缩放时返回原图
+func resize(src image.Image, v Variant) image.Image {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	crop := bounds
+	width, height := v.Width, v.Height
+	switch {
+	case width == 0 && height == 0:
+		return src
+	case height == 0:
+		width = min(width, sw)
+		height = max(1, sh*width/sw)
+	case width == 0:
+		height = min(height, sh)
+		width = max(1, sw*height/sh)
+	case v.Fit == FitContain:
+		// 按宽度与高度中缩小更多的一边等比缩放
+		if sw*height > sh*width {
+			width = min(width, sw)
+			height = max(1, sh*width/sw)
+		} else {
+			height = min(height, sh)
+			width = max(1, sw*height/sh)
+		}
+	case v.Fit == FitCover:
+		// 从原图中部裁出与目标宽高比相同的区域
+		cw, ch := sw, sh
+		if sw*height > sh*width {
+			cw = max(1, sh*width/height)
+		} else {
+			ch = max(1, sw*height/width)
+		}
+		x, y := bounds.Min.X+(sw-cw)/2, bounds.Min.Y+(sh-ch)/2
+		crop = image.Rect(x, y, x+cw, y+ch)
+	}
+	if width == sw && height == sh && crop == bounds {
+		return src
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// flatten 将透明像素合成到白色背景上，JPEG 不支持透明度
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// variant 返回内容的转码结果。结果缓存在输出存储中，没有时从原内容生成；data 为 nil 时从存储读取原内容。
+func (m *JobManager) variant(ctx context.Context, sum string, data []byte, v Variant) ([]byte, error) {
+	return m.blobs.Variant(ctx, sum, v.name(), v.contentType(), func() ([]byte, error) {
+		if data == nil {
+			var err error
+			if data, err = m.blobs.Get(ctx, sum); err != nil {
+				return nil, err
+			}
+		}
+		return transcode(data, v)
+	})
+}
+
+// OutputVariant 返回任务第 n 个输出的转码结果与补全后的参数
+func (m *JobManager) OutputVariant(ctx context.Context, job *Job, n int, v Variant) (JobOutput, Variant, []byte, error) {
+	outputs := job.Status().Outputs
+	if n < 0 || n >= len(outputs) {
+		return JobOutput{}, v, nil, ErrOutputNotFound
+	}
+	output := outputs[n]
+	v = v.resolve(output.ContentType)
+	if output.SHA256 != "" {
+		data, err := m.variant(ctx, output.SHA256, nil, v)
+		return output, v, data, err
+	}
+	// 按内容哈希存储之前的输出不缓存转码结果
+	output, data, err := job.Output(n)
+	if err != nil {
+		return output, v, nil, err
+	}
+	data, err = transcode(data, v)
+	return output, v, data, err
+}
+
+// thumbnail 在任务结束时为图片输出生成缩略图，返回缩略图的下载地址，未开启或不是图片时返回空
+func (m *JobManager) thumbnail(ctx context.Context, output JobOutput) string {
+	if m.thumbnails.Size <= 0 || !strings.HasPrefix(output.ContentType, "image/") {
+		return ""
+	}
+	v := Variant{
+		Format:  m.thumbnails.Format,
+		Quality: m.thumbnails.Quality,
+		Width:   m.thumbnails.Size,
+		Height:  m.thumbnails.Size,
+	}.resolve(output.ContentType)
+	if _, err := m.variant(ctx, output.SHA256, output.data, v); err != nil {
+		if !errors.Is(err, ErrNotImage) {
+			log.Printf("failed to generate thumbnail for %s: %v", output.SHA256, err)
+		}
+		return ""
+	}
+	return "/api/blobs/" + output.SHA256 + "?" + v.query()
+}
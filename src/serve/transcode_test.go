@@ -0,0 +1,37 @@
+package serve
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVariantName(t *testing.T) {
+	for _, tc := range []struct {
+		query       string
+		contentType string
+		want        string
+	}{
+		// WebP 与 PNG 为无损编码，quality 不进入缓存键
+		{"format=webp&quality=40", "image/png", "0x0.webp"},
+		{"format=webp", "image/png", "0x0.webp"},
+		{"format=png&quality=40", "image/jpeg", "0x0.png"},
+		{"quality=40", "image/png", "0x0.png"},
+		{"format=jpg", "image/png", "0x0-q90.jpeg"},
+		{"format=jpeg&quality=40", "image/png", "0x0-q40.jpeg"},
+		{"width=256", "image/webp", "256x0.webp"},
+		{"width=256&height=128", "image/png", "256x128-contain.png"},
+		{"width=256&height=128&fit=cover&format=webp&quality=80", "image/png", "256x128-cover.webp"},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/?"+tc.query, nil)
+		v, err := parseVariant(c)
+		if err != nil || v == nil {
+			t.Fatalf("parseVariant(%q) = %v, %v", tc.query, v, err)
+		}
+		if got := v.resolve(tc.contentType).name(); got != tc.want {
+			t.Errorf("%s: name %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package serve
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// watchdogInterval 是检查任务是否超时或卡死的间隔
+const watchdogInterval = time.Second
+
+// 超时类型
+const (
+	TimeoutJob   = "job"   // 任务执行时间超过限制
+	TimeoutNode  = "node"  // 单个节点执行时间超过限制
+	TimeoutStall = "stall" // 执行中长时间没有收到后端的事件
+)
+
+// TimeoutError 表示任务在后端上执行超时或卡死
+type TimeoutError struct {
+	Kind  string
+	Node  string // 超时的节点，Kind 为 node 时有效
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	switch e.Kind {
+	case TimeoutNode:
+		return fmt.Sprintf("node %s timed out after %s", e.Node, e.Limit)
+	case TimeoutStall:
+		return fmt.Sprintf("no progress from backend for %s", e.Limit)
+	default:
+		return fmt.Sprintf("job timed out after %s", e.Limit)
+	}
+}
+
+// watchdog 跟踪提示在后端上的执行，判断是否超过任务或节点的时间限制，或长时间没有进展
+type watchdog struct {
+	job, node, stall time.Duration // 为 0 时不限制
+
+	started   time.Time // 开始执行的时间，排队中为零
+	current   string    // 正在执行的节点
+	nodeStart time.Time
+	lastEvent time.Time
+}
+
+// newWatchdog 根据配置创建 watchdog，任务自身的超时优先于配置
+func newWatchdog(cfg TimeoutConfig, jobTimeout Duration) *watchdog {
+	if jobTimeout <= 0 {
+		jobTimeout = cfg.Job
+	}
+	return &watchdog{job: time.Duration(jobTimeout), node: time.Duration(cfg.Node), stall: time.Duration(cfg.Stall)}
+}
+
+// event 记录一次来自后端的事件，提示在后端排队时不计时
+func (w *watchdog) event(now time.Time) {
+	if w.started.IsZero() {
+		w.started = now
+	}
+	w.lastEvent = now
+}
+
+// executing 记录开始执行的节点
+func (w *watchdog) executing(node string, now time.Time) {
+	w.event(now)
+	if node != w.current {
+		w.current = node
+		w.nodeStart = now
+	}
+}
+
+// check 返回已超过的时间限制，未超时返回 nil
+func (w *watchdog) check(now time.Time) error {
+	if w.started.IsZero() {
+		return nil
+	}
+	switch {
+	case w.job > 0 && now.Sub(w.started) > w.job:
+		return &TimeoutError{Kind: TimeoutJob, Limit: w.job}
+	case w.node > 0 && w.current != "" && now.Sub(w.nodeStart) > w.node:
+		return &TimeoutError{Kind: TimeoutNode, Node: w.current, Limit: w.node}
+	case w.stall > 0 && now.Sub(w.lastEvent) > w.stall:
+		return &TimeoutError{Kind: TimeoutStall, Limit: w.stall}
+	}
+	return nil
+}
+
+// markSuspect 将卡住的后端标记为可疑，不再分配新任务，直到探测发现其队列中没有执行中的提示
+func (b *Backend) markSuspect(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.suspect == "" {
+		log.Printf("backend %s: marked suspect: %v", b.Name, err)
+	}
+	b.suspect = err.Error()
+}
+
+// checkSuspect 在可疑后端的执行队列清空后解除标记
+func (b *Backend) checkSuspect() {
+	b.mu.Lock()
+	suspect := b.suspect
+	b.mu.Unlock()
+	if suspect == "" {
+		return
+	}
+
+	queue, err := b.timedClient(b.probeClient).GetQueue()
+	if err != nil || len(queue.Running) > 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.suspect = ""
+	log.Printf("backend %s: no longer suspect", b.Name)
+}
@@ -0,0 +1,186 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/fimreal/comfyui-api/src/pngmeta"
+	"github.com/fimreal/comfyui-api/src/watermark"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// 添加水印后重新编码 JPEG 的质量
+const watermarkJPEGQuality = 95
+
+// Watermarker 按模板或租户规则在输出保存前添加水印
+type Watermarker struct {
+	cfg   WatermarkConfig
+	logos map[string]image.Image // 按文件路径
+}
+
+// NewWatermarker 校验水印规则并加载其中的水印图片
+func NewWatermarker(cfg WatermarkConfig) (*Watermarker, error) {
+	w := &Watermarker{cfg: cfg, logos: make(map[string]image.Image)}
+	rules := map[string]WatermarkRule{"default": cfg.Default}
+	for name, rule := range cfg.Templates {
+		rules["template "+name] = rule
+	}
+	for name, rule := range cfg.Tenants {
+		rules["tenant "+name] = rule
+	}
+	for name, rule := range rules {
+		if rule.Strength < 0 {
+			return nil, fmt.Errorf("watermark %s: strength must not be negative", name)
+		}
+		if rule.Logo == nil {
+			continue
+		}
+		logo := rule.Logo
+		if err := watermark.ValidPosition(logo.Position); err != nil {
+			return nil, fmt.Errorf("watermark %s: %w", name, err)
+		}
+		if logo.Opacity < 0 || logo.Opacity > 1 || logo.Scale < 0 || logo.Scale > 1 || logo.Margin < 0 {
+			return nil, fmt.Errorf("watermark %s: opacity and scale must be between 0 and 1, margin must not be negative", name)
+		}
+		if _, ok := w.logos[logo.File]; ok {
+			continue
+		}
+		data, err := os.ReadFile(logo.File)
+		if err != nil {
+			return nil, fmt.Errorf("watermark %s: %w", name, err)
+		}
+		img, err := decodeImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("watermark %s: %s: %w", name, logo.File, err)
+		}
+		w.logos[logo.File] = img
+	}
+	return w, nil
+}
+
+// rule 返回任务适用的水印规则及其名称：模板规则优先于租户规则，都没有时使用默认规则
+func (w *Watermarker) rule(template, tenant string) (string, WatermarkRule) {
+	if rule, ok := w.cfg.Templates[template]; ok && template != "" {
+		return "template:" + template, rule
+	}
+	if rule, ok := w.cfg.Tenants[tenant]; ok {
+		return "tenant:" + tenant, rule
+	}
+	return "default", w.cfg.Default
+}
+
+// apply 按规则为图片添加水印并以原格式重新编码，PNG 保留原有的文本块
+func (w *Watermarker) apply(rule WatermarkRule, data []byte, format, jobID string) ([]byte, error) {
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	if rule.Logo != nil {
+		watermark.Overlay(img, w.logos[rule.Logo.File], watermark.OverlayOptions{
+			Position: rule.Logo.Position,
+			Opacity:  rule.Logo.Opacity,
+			Margin:   rule.Logo.Margin,
+			Scale:    rule.Logo.Scale,
+		})
+	}
+	if rule.Invisible {
+		id, err := uuid.Parse(jobID)
+		if err != nil {
+			return nil, err
+		}
+		switch err := watermark.Embed(img, id, w.cfg.Key, rule.Strength); {
+		case errors.Is(err, watermark.ErrTooSmall):
+			// 小图仍然保存，只是没有不可见水印
+			log.Printf("watermark: job %s: %v (%dx%d)", jobID, err, img.Rect.Dx(), img.Rect.Dy())
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	out, err := encodeImage(img, format, watermarkJPEGQuality)
+	if err != nil || format != "png" {
+		return out, err
+	}
+	text, err := pngmeta.Text(data)
+	if err != nil || len(text) == 0 {
+		return out, err
+	}
+	return pngmeta.SetText(out, text)
+}
+
+// watermark 按任务的模板与租户为输出添加水印，不可见水印中嵌入顶层任务的 ID。
+// 分块任务的子任务输出在拼接后统一处理，非图片输出不处理。
+func (m *JobManager) watermark(job *Job, output *JobOutput) error {
+	root := job
+	if job.spec.ParentID != "" {
+		parent, err := m.Get(job.spec.ParentID)
+		if err != nil {
+			return err
+		}
+		if parent.spec.Tile != nil {
+			return nil
+		}
+		root = parent
+	}
+	_, rule := m.watermarks.rule(root.spec.Template, root.spec.Tenant)
+	if rule.Logo == nil && !rule.Invisible {
+		return nil
+	}
+	format := ""
+	for name, contentType := range variantTypes {
+		if contentType == output.ContentType {
+			format = name
+		}
+	}
+	if format == "" {
+		return nil
+	}
+	data, err := m.watermarks.apply(rule, output.data, format, root.id)
+	if err != nil {
+		return err
+	}
+	output.data, output.Size = data, len(data)
+	return nil
+}
+
+// detectWatermark 读取上传图片中的不可见水印，返回嵌入的本租户任务 ID
+func detectWatermark(c *gin.Context) {
+	data, err := readUpload(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	key := ""
+	if jobs.watermarks != nil {
+		key = jobs.watermarks.cfg.Key
+	}
+	payload, err := watermark.Detect(img, key)
+	if err == nil {
+		// 只返回本租户的任务，其他租户与已回收的任务按没有水印处理，不泄露任务 ID
+		if _, lookupErr := jobs.GetForTenant(uuid.UUID(payload).String(), currentTenant(c)); lookupErr != nil {
+			err = watermark.ErrNotFound
+		}
+	}
+	switch {
+	case errors.Is(err, watermark.ErrNotFound), errors.Is(err, watermark.ErrTooSmall):
+		c.JSON(http.StatusOK, gin.H{"found": false, "error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"found": true, "job_id": uuid.UUID(payload).String()})
+	}
+}
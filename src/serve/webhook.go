@@ -0,0 +1,366 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 回调请求头
+const (
+	WebhookIDHeader        = "X-Webhook-ID"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhooks 是服务使用的回调投递器，未配置密钥时为空
+var webhooks *WebhookDispatcher
+
+// WebhookPayload 是任务结束时回调的请求体
+type WebhookPayload struct {
+	JobID   string          `json:"job_id"`
+	Status  JobState        `json:"status"`
+	Outputs []WebhookOutput `json:"outputs"`
+	Error   *WebhookError   `json:"error,omitempty"`
+	Timings JobTimings      `json:"timings"`
+}
+
+// WebhookOutput 是回调中的输出引用
+type WebhookOutput struct {
+	Index       int    `json:"index"`
+	NodeID      string `json:"node_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
+}
+
+// WebhookError 是回调中的错误详情
+type WebhookError struct {
+	Message string `json:"message"`
+}
+
+// webhookDelivery 是发件箱中的一次待投递回调
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	JobID       string          `json:"job_id"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+
+	inflight bool
+}
+
+// errPermanent 表示不应重试的投递失败
+var errPermanent = errors.New("permanent delivery failure")
+
+// WebhookDispatcher 签名并投递回调，失败时按指数退避重试。
+// 待投递的回调保存在发件箱目录中，重启后继续投递。
+type WebhookDispatcher struct {
+	cfg       WebhookConfig
+	publicURL string
+	client    *http.Client
+
+	mu      sync.Mutex
+	pending map[string]*webhookDelivery
+	wake    chan struct{}
+}
+
+// NewWebhookDispatcher 创建回调投递器并加载发件箱中未完成的回调
+func NewWebhookDispatcher(cfg WebhookConfig, publicURL string) (*WebhookDispatcher, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("webhook secret is required")
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Outbox, "failed"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create webhook outbox: %w", err)
+	}
+
+	d := &WebhookDispatcher{
+		cfg:       cfg,
+		publicURL: publicURL,
+		client:    &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		pending:   make(map[string]*webhookDelivery),
+		wake:      make(chan struct{}, 1),
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.Outbox, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var delivery webhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			log.Printf("webhook: skipping corrupt outbox entry %s: %v", file, err)
+			continue
+		}
+		d.pending[delivery.ID] = &delivery
+	}
+	return d, nil
+}
+
+// validateCallbackURL 检查回调地址是否可用
+func validateCallbackURL(raw string) error {
+	if webhooks == nil {
+		return errors.New("callbacks are not enabled on this server")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback_url: %s", raw)
+	}
+	return nil
+}
+
+// Sign 计算回调签名：HMAC-SHA256(secret, timestamp + "." + body) 的十六进制，带 sha256= 前缀
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// jobFinished 在任务结束时将回调写入发件箱
+func (d *WebhookDispatcher) jobFinished(job *Job) {
+	if job.spec.CallbackURL == "" {
+		return
+	}
+	payload, err := json.Marshal(d.payload(job.Status()))
+	if err != nil {
+		log.Printf("webhook: failed to encode payload for job %s: %v", job.ID(), err)
+		return
+	}
+	delivery := &webhookDelivery{
+		ID:          uuid.New().String(),
+		JobID:       job.ID(),
+		URL:         job.spec.CallbackURL,
+		Payload:     payload,
+		NextAttempt: time.Now(),
+		CreatedAt:   time.Now(),
+	}
+	if err := d.save(delivery); err != nil {
+		log.Printf("webhook: failed to persist delivery for job %s: %v", job.ID(), err)
+	}
+
+	d.mu.Lock()
+	d.pending[delivery.ID] = delivery
+	d.mu.Unlock()
+	d.notify()
+}
+
+// payload 根据任务状态生成回调内容
+func (d *WebhookDispatcher) payload(status JobStatus) WebhookPayload {
+	payload := WebhookPayload{
+		JobID:   status.ID,
+		Status:  status.State,
+		Outputs: make([]WebhookOutput, 0, len(status.Outputs)),
+		Timings: status.Timings(),
+	}
+	for _, output := range status.Outputs {
+		// 预签名 URL 已是绝对地址
+		url := output.URL
+		if strings.HasPrefix(url, "/") {
+			url = d.publicURL + url
+		}
+		thumbnail := output.Thumbnail
+		if thumbnail != "" {
+			thumbnail = d.publicURL + thumbnail
+		}
+		payload.Outputs = append(payload.Outputs, WebhookOutput{
+			Index:       output.Index,
+			NodeID:      output.NodeID,
+			Filename:    output.Filename,
+			ContentType: output.ContentType,
+			URL:         url,
+			Thumbnail:   thumbnail,
+		})
+	}
+	if status.Error != "" {
+		payload.Error = &WebhookError{Message: status.Error}
+	}
+	return payload
+}
+
+// Run 持续投递到期的回调，直到 ctx 结束
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+
+		next := d.dispatchDue(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// notify 唤醒投递循环
+func (d *WebhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchDue 开始投递所有到期的回调，返回下一次需要检查的时间
+func (d *WebhookDispatcher) dispatchDue(ctx context.Context) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	next := now.Add(time.Minute)
+	for _, delivery := range d.pending {
+		if delivery.inflight {
+			continue
+		}
+		if delivery.NextAttempt.After(now) {
+			if delivery.NextAttempt.Before(next) {
+				next = delivery.NextAttempt
+			}
+			continue
+		}
+		delivery.inflight = true
+		go d.attempt(ctx, delivery)
+	}
+	return next
+}
+
+// attempt 投递一次回调并根据结果删除、重排或放弃
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery *webhookDelivery) {
+	err := d.send(ctx, delivery)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.notify()
+	delivery.inflight = false
+	delivery.Attempts++
+
+	if err == nil {
+		delete(d.pending, delivery.ID)
+		_ = os.Remove(d.path(delivery.ID))
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if errors.Is(err, errPermanent) || delivery.Attempts >= d.cfg.MaxAttempts {
+		log.Printf("webhook: giving up on job %s after %d attempts: %v", delivery.JobID, delivery.Attempts, err)
+		delete(d.pending, delivery.ID)
+		if err := d.save(delivery); err == nil {
+			_ = os.Rename(d.path(delivery.ID), filepath.Join(d.cfg.Outbox, "failed", delivery.ID+".json"))
+		}
+		return
+	}
+
+	delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+	if err := d.save(delivery); err != nil {
+		log.Printf("webhook: failed to persist delivery for job %s: %v", delivery.JobID, err)
+	}
+}
+
+// send 签名并发送回调请求
+func (d *WebhookDispatcher) send(ctx context.Context, delivery *webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "comfyui-api-webhook")
+	req.Header.Set(WebhookIDHeader, delivery.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, Sign([]byte(d.cfg.Secret), timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: unexpected response status: %s", errPermanent, resp.Status)
+	}
+}
+
+// backoff 返回第 attempts 次失败后的重试间隔，带 ±20% 抖动
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := time.Duration(d.cfg.MinBackoff)
+	for i := 1; i < attempts && delay < time.Duration(d.cfg.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(d.cfg.MaxBackoff) {
+		delay = time.Duration(d.cfg.MaxBackoff)
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
+
+// path 返回回调在发件箱中的文件路径
+func (d *WebhookDispatcher) path(id string) string {
+	return filepath.Join(d.cfg.Outbox, id+".json")
+}
+
+// save 原子地写入发件箱文件
+func (d *WebhookDispatcher) save(delivery *webhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.cfg.Outbox, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(delivery.ID))
+}
+
+// VerifySignature 校验回调签名，供接收方使用
+func VerifySignature(secret []byte, timestamp string, body []byte, signature string) bool {
+	expected := Sign(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature)))
+}
@@ -0,0 +1,205 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver 记录收到的回调，前 failures 次返回 503
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func newWebhookReceiver(failures int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{failures: failures, received: make(chan struct{}, 16)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		fail := len(r.requests) <= r.failures
+		r.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		r.received <- struct{}{}
+	}))
+	return r, server
+}
+
+func (r *webhookReceiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d webhooks", i, n)
+		}
+	}
+}
+
+func newTestDispatcher(t *testing.T, secret string) *WebhookDispatcher {
+	t.Helper()
+	d, err := NewWebhookDispatcher(WebhookConfig{
+		Secret:      secret,
+		Outbox:      t.TempDir(),
+		MaxAttempts: 3,
+		MinBackoff:  Duration(10 * time.Millisecond),
+		MaxBackoff:  Duration(50 * time.Millisecond),
+		Timeout:     Duration(time.Second),
+	}, "http://api.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go d.Run(ctx)
+	return d
+}
+
+func finishedJob(callbackURL string) *Job {
+	now := time.Now()
+	return &Job{
+		id:         "job-1",
+		state:      JobSucceeded,
+		spec:       JobSpec{CallbackURL: callbackURL},
+		createdAt:  now,
+		startedAt:  now,
+		finishedAt: now,
+		outputs:    []JobOutput{{Index: 0, Filename: "a.png", ContentType: "image/png", URL: "/api/jobs/job-1/outputs/0"}},
+	}
+}
+
+// waitDelivered 等待投递器处理完全部回调
+func waitDelivered(t *testing.T, d *WebhookDispatcher) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		pending := len(d.pending)
+		d.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d deliveries still pending", pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func outboxEntries(t *testing.T, d *WebhookDispatcher) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(d.cfg.Outbox, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver, server := newWebhookReceiver(0)
+	defer server.Close()
+	d := newTestDispatcher(t, "s3cret")
+
+	d.jobFinished(finishedJob(server.URL))
+	receiver.wait(t, 1)
+
+	receiver.mu.Lock()
+	req, body := receiver.requests[0], receiver.bodies[0]
+	receiver.mu.Unlock()
+	timestamp := req.Header.Get(WebhookTimestampHeader)
+	signature := req.Header.Get(WebhookSignatureHeader)
+	if !VerifySignature([]byte("s3cret"), timestamp, body, signature) {
+		t.Fatalf("signature %q does not verify", signature)
+	}
+	if VerifySignature([]byte("other"), timestamp, body, signature) {
+		t.Fatal("signature verifies with a different secret")
+	}
+	if VerifySignature([]byte("s3cret"), timestamp, append(body, ' '), signature) {
+		t.Fatal("signature verifies for a modified body")
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.JobID != "job-1" || payload.Status != JobSucceeded {
+		t.Fatalf("payload = %+v", payload)
+	}
+	if len(payload.Outputs) != 1 || payload.Outputs[0].URL != "http://api.example/api/jobs/job-1/outputs/0" {
+		t.Fatalf("outputs = %+v", payload.Outputs)
+	}
+
+	// 投递成功后从发件箱删除
+	waitDelivered(t, d)
+	if files := outboxEntries(t, d); len(files) > 0 {
+		t.Fatalf("outbox still has %v", files)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver, server := newWebhookReceiver(2)
+	defer server.Close()
+	d := newTestDispatcher(t, "s3cret")
+
+	d.jobFinished(finishedJob(server.URL))
+	receiver.wait(t, 3)
+	waitDelivered(t, d)
+	if files := outboxEntries(t, d); len(files) > 0 {
+		t.Fatalf("outbox still has %v", files)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	id := receiver.requests[0].Header.Get(WebhookIDHeader)
+	for i, req := range receiver.requests {
+		if got := req.Header.Get(WebhookIDHeader); got != id {
+			t.Errorf("attempt %d: delivery ID %q, want %q", i, got, id)
+		}
+		if !VerifySignature([]byte("s3cret"), req.Header.Get(WebhookTimestampHeader), receiver.bodies[i], req.Header.Get(WebhookSignatureHeader)) {
+			t.Errorf("attempt %d: signature does not verify", i)
+		}
+	}
+}
+
+func TestWebhookOutboxReload(t *testing.T) {
+	receiver, server := newWebhookReceiver(0)
+	defer server.Close()
+
+	// 未启动投递循环的投递器只写入发件箱，模拟重启前未投递的回调
+	outbox := t.TempDir()
+	cfg := WebhookConfig{Secret: "s3cret", Outbox: outbox, MaxAttempts: 3, MinBackoff: Duration(time.Millisecond), MaxBackoff: Duration(time.Millisecond), Timeout: Duration(time.Second)}
+	stopped, err := NewWebhookDispatcher(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.jobFinished(finishedJob(server.URL))
+	if files, _ := filepath.Glob(filepath.Join(outbox, "*.json")); len(files) != 1 {
+		t.Fatalf("outbox has %d entries, want 1", len(files))
+	}
+
+	d, err := NewWebhookDispatcher(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	receiver.wait(t, 1)
+	waitDelivered(t, d)
+	if files := outboxEntries(t, d); len(files) > 0 {
+		t.Fatalf("outbox still has %v", files)
+	}
+}
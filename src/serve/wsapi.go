@@ -0,0 +1,293 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsProtocolVersion 是客户端 WebSocket 协议版本
+const wsProtocolVersion = 1
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 2 * wsPingInterval
+	wsSendBuffer   = 64
+)
+
+// 客户端发送的消息类型
+const (
+	wsSubmit      = "submit"
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsCancel      = "cancel"
+	wsPing        = "ping"
+)
+
+// 服务端发送的消息类型
+const (
+	wsHello     = "hello"
+	wsSubmitted = "submitted"
+	wsAck       = "ack"
+	wsEvent     = "event"
+	wsError     = "error"
+	wsPong      = "pong"
+)
+
+// wsRequest 是客户端发送的消息
+type wsRequest struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"` // 由客户端生成，原样带回响应
+	JobID     string      `json:"job_id,omitempty"`
+	After     int64       `json:"after,omitempty"` // 订阅时从该事件 ID 之后开始推送
+	Job       *jobRequest `json:"job,omitempty"`   // submit 的任务内容，与 POST /api/jobs 相同
+}
+
+// wsResponse 是服务端发送的消息
+type wsResponse struct {
+	Version   int        `json:"v"`
+	Type      string     `json:"type"`
+	RequestID string     `json:"request_id,omitempty"`
+	JobID     string     `json:"job_id,omitempty"`
+	Job       *JobStatus `json:"job,omitempty"`
+	Event     *JobEvent  `json:"event,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsSession 是一个客户端 WebSocket 连接的会话状态
+type wsSession struct {
+	conn   *websocket.Conn
+	send   chan wsResponse
+	ctx    context.Context
+	tenant string
+
+	mu   sync.Mutex
+	subs map[string]*wsSubscription
+}
+
+// wsSubscription 是一次任务订阅，推送协程结束时只移除自己的订阅
+type wsSubscription struct {
+	cancel context.CancelFunc
+}
+
+// serveWebSocket 提供客户端 WebSocket API，用于提交、订阅与取消任务
+func serveWebSocket(c *gin.Context) {
+	if wsUpgradeRequired(c) {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // Upgrade 已写出错误响应
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	s := &wsSession{
+		conn:   conn,
+		send:   make(chan wsResponse, wsSendBuffer),
+		ctx:    ctx,
+		tenant: currentTenant(c),
+		subs:   make(map[string]*wsSubscription),
+	}
+	go s.writeLoop(cancel)
+
+	s.reply(wsResponse{Type: wsHello})
+	s.readLoop()
+}
+
+// readLoop 读取并处理客户端消息，直到连接关闭
+func (s *wsSession) readLoop() {
+	s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		var req wsRequest
+		if err := json.Unmarshal(message, &req); err != nil {
+			s.reply(wsResponse{Type: wsError, Error: "invalid message: " + err.Error()})
+			continue
+		}
+		if req.Version != wsProtocolVersion {
+			s.reply(wsResponse{Type: wsError, RequestID: req.RequestID, Error: "unsupported protocol version"})
+			continue
+		}
+		s.handle(req)
+	}
+}
+
+// writeLoop 串行写出消息并定期发送 ping
+func (s *wsSession) writeLoop(cancel context.CancelFunc) {
+	defer cancel()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(wsWriteTimeout)
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// reply 将消息放入发送队列
+func (s *wsSession) reply(msg wsResponse) {
+	msg.Version = wsProtocolVersion
+	select {
+	case s.send <- msg:
+	case <-s.ctx.Done():
+	}
+}
+
+// handle 处理一条客户端消息
+func (s *wsSession) handle(req wsRequest) {
+	fail := func(err string) {
+		s.reply(wsResponse{Type: wsError, RequestID: req.RequestID, JobID: req.JobID, Error: err})
+	}
+
+	switch req.Type {
+	case wsSubmit:
+		if req.Job == nil || len(req.Job.Workflow) == 0 {
+			fail("job.workflow is required")
+			return
+		}
+		spec, err := req.Job.spec()
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		spec.Tenant = s.tenant
+		job, err := jobs.Submit(spec)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		status := job.Status()
+		s.reply(wsResponse{Type: wsSubmitted, RequestID: req.RequestID, JobID: job.ID(), Job: &status})
+		s.subscribe(job, 0)
+
+	case wsSubscribe:
+		job, err := jobs.GetForTenant(req.JobID, s.tenant)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		status := job.Status()
+		s.reply(wsResponse{Type: wsAck, RequestID: req.RequestID, JobID: job.ID(), Job: &status})
+		s.subscribe(job, req.After)
+
+	case wsUnsubscribe:
+		s.unsubscribe(req.JobID)
+		s.reply(wsResponse{Type: wsAck, RequestID: req.RequestID, JobID: req.JobID})
+
+	case wsCancel:
+		job, err := jobs.GetForTenant(req.JobID, s.tenant)
+		if err == nil {
+			err = jobs.Cancel(job.ID())
+		}
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		s.reply(wsResponse{Type: wsAck, RequestID: req.RequestID, JobID: req.JobID})
+
+	case wsPing:
+		s.reply(wsResponse{Type: wsPong, RequestID: req.RequestID})
+
+	default:
+		fail("unknown message type: " + req.Type)
+	}
+}
+
+// subscribe 开始推送任务事件，已订阅的任务不会重复推送
+func (s *wsSession) subscribe(job *Job, after int64) {
+	s.mu.Lock()
+	if _, ok := s.subs[job.ID()]; ok {
+		s.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	sub := &wsSubscription{cancel: cancel}
+	s.subs[job.ID()] = sub
+	s.mu.Unlock()
+
+	go func() {
+		defer s.remove(job.ID(), sub)
+		for {
+			events, changed, terminal := job.EventsSince(after)
+			for i := range events {
+				s.reply(wsResponse{Type: wsEvent, JobID: job.ID(), Event: &events[i]})
+				after = events[i].ID
+			}
+			if terminal {
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// unsubscribe 停止推送任务事件
+func (s *wsSession) unsubscribe(jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.subs[jobID]; ok {
+		sub.cancel()
+		delete(s.subs, jobID)
+	}
+}
+
+// remove 在推送结束时移除订阅，同一任务已被重新订阅时保留新的订阅
+func (s *wsSession) remove(jobID string, sub *wsSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub.cancel()
+	if s.subs[jobID] == sub {
+		delete(s.subs, jobID)
+	}
+}
+
+// wsUpgradeRequired 在非 WebSocket 请求时返回说明
+func wsUpgradeRequired(c *gin.Context) bool {
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		return false
+	}
+	c.JSON(http.StatusUpgradeRequired, gin.H{"error": "WebSocket upgrade required"})
+	return true
+}
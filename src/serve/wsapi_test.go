@@ -0,0 +1,60 @@
+package serve
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWebSocketResubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &wsSession{send: make(chan wsResponse, wsSendBuffer), ctx: ctx, subs: make(map[string]*wsSubscription)}
+	job := &Job{id: "job", state: JobRunning, changed: make(chan struct{}), done: make(chan struct{})}
+
+	// 取消后立即重新订阅，旧的推送协程退出时不能移除新的订阅
+	s.subscribe(job, 0)
+	s.unsubscribe(job.ID())
+	s.subscribe(job, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	s.mu.Lock()
+	_, ok := s.subs[job.ID()]
+	s.mu.Unlock()
+	if !ok {
+		t.Fatal("the new subscription was removed by the old one")
+	}
+	job.publish(JobEventProgress, nil)
+	select {
+	case msg := <-s.send:
+		if msg.Type != wsEvent || msg.Event.Type != JobEventProgress {
+			t.Fatalf("got %+v, want a progress event", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event after resubscribing")
+	}
+	select {
+	case msg := <-s.send:
+		t.Fatalf("event delivered twice: %+v", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// 任务结束后推送协程移除自己的订阅
+	job.mu.Lock()
+	job.state = JobSucceeded
+	job.publishTerminalLocked()
+	job.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.subs)
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription kept after the job finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,210 @@
+package watermark
+
+import (
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+)
+
+// 不可见水印以 Koch-Zhao 方法嵌入：每个 8x8 亮度块的两个中频 DCT 系数的大小关系表示一个比特。
+// 16 字节标识加 16 位 CRC 共 144 比特，按密钥打乱后重复分布到全部块中，读取时按块投票。
+// 可以经受 JPEG 压缩（质量 75 以上）、WebP 无损与轻微的亮度调整，不能经受缩放、裁剪与旋转。
+
+// PayloadSize 是嵌入的标识的字节数
+const PayloadSize = 16
+
+// DefaultStrength 是默认的嵌入强度：两个系数之差的最小值
+const DefaultStrength = 24
+
+// 嵌入的比特数与每个比特最少重复的块数
+const (
+	frameBits   = (PayloadSize + 2) * 8
+	minRepeats  = 3
+	blockSize   = 8
+	coeffU      = 2 // 两个系数为 (2,3) 与 (3,2)，JPEG 的量化步长相近
+	coeffV      = 3
+	defaultSeed = "comfyui-api"
+)
+
+var (
+	ErrTooSmall = errors.New("image is too small for an invisible watermark") // 块数不足以重复嵌入每个比特
+	ErrNotFound = errors.New("no invisible watermark found")                  // 没有水印，或密钥不同
+)
+
+// dctTable[k][n] 是 8 点正交 DCT 的基
+var dctTable = func() (table [blockSize][blockSize]float64) {
+	for k := 0; k < blockSize; k++ {
+		scale := math.Sqrt(2.0 / blockSize)
+		if k == 0 {
+			scale = math.Sqrt(1.0 / blockSize)
+		}
+		for n := 0; n < blockSize; n++ {
+			table[k][n] = scale * math.Cos(float64((2*n+1)*k)*math.Pi/(2*blockSize))
+		}
+	}
+	return table
+}()
+
+// coefficient 返回块中 (u,v) 的 DCT 系数
+func coefficient(block *[blockSize][blockSize]float64, u, v int) float64 {
+	var sum float64
+	for y := 0; y < blockSize; y++ {
+		for x := 0; x < blockSize; x++ {
+			sum += dctTable[u][y] * dctTable[v][x] * block[y][x]
+		}
+	}
+	return sum
+}
+
+// addBasis 在块上叠加系数 (u,v) 的变化 delta
+func addBasis(block *[blockSize][blockSize]float64, u, v int, delta float64) {
+	for y := 0; y < blockSize; y++ {
+		for x := 0; x < blockSize; x++ {
+			block[y][x] += delta * dctTable[u][y] * dctTable[v][x]
+		}
+	}
+}
+
+// layout 返回每个块承载的比特，块按行优先编号
+func layout(blocks int, key string) []int {
+	if key == "" {
+		key = defaultSeed
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	perm := rand.New(rand.NewSource(int64(h.Sum64()))).Perm(blocks)
+	bits := make([]int, blocks)
+	for i, block := range perm {
+		bits[block] = i % frameBits
+	}
+	return bits
+}
+
+// frame 返回标识与 CRC 的各个比特
+func frame(payload [PayloadSize]byte) []bool {
+	data := append(payload[:], 0, 0)
+	crc := crc32.ChecksumIEEE(payload[:])
+	data[PayloadSize], data[PayloadSize+1] = byte(crc>>8), byte(crc)
+	bits := make([]bool, frameBits)
+	for i := range bits {
+		bits[i] = data[i/8]&(0x80>>(i%8)) != 0
+	}
+	return bits
+}
+
+// luma 返回像素的亮度
+func luma(img *image.NRGBA, x, y int) float64 {
+	p := img.Pix[img.PixOffset(x, y):]
+	return 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+}
+
+// Embed 将标识嵌入图片的亮度，key 决定比特在块中的分布，读取时需要相同的 key
+func Embed(img *image.NRGBA, payload [PayloadSize]byte, key string, strength float64) error {
+	bounds := img.Bounds()
+	cols, rows := bounds.Dx()/blockSize, bounds.Dy()/blockSize
+	if cols*rows < frameBits*minRepeats {
+		return ErrTooSmall
+	}
+	if strength <= 0 {
+		strength = DefaultStrength
+	}
+	bits := frame(payload)
+	assignment := layout(cols*rows, key)
+
+	var block, original [blockSize][blockSize]float64
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			x0, y0 := bounds.Min.X+bx*blockSize, bounds.Min.Y+by*blockSize
+			for y := 0; y < blockSize; y++ {
+				for x := 0; x < blockSize; x++ {
+					block[y][x] = luma(img, x0+x, y0+y)
+				}
+			}
+			original = block
+
+			c1, c2 := coefficient(&block, coeffU, coeffV), coefficient(&block, coeffV, coeffU)
+			want := strength
+			if !bits[assignment[by*cols+bx]] {
+				want = -strength
+			}
+			if (want > 0 && c1-c2 >= want) || (want < 0 && c1-c2 <= want) {
+				continue
+			}
+			// 保持两个系数的均值不变，使差值恰好为 want
+			mean := (c1 + c2) / 2
+			addBasis(&block, coeffU, coeffV, mean+want/2-c1)
+			addBasis(&block, coeffV, coeffU, mean-want/2-c2)
+
+			for y := 0; y < blockSize; y++ {
+				for x := 0; x < blockSize; x++ {
+					delta := block[y][x] - original[y][x]
+					p := img.Pix[img.PixOffset(x0+x, y0+y):]
+					for c := 0; c < 3; c++ {
+						p[c] = clamp(float64(p[c]) + delta)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func clamp(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
+
+// Detect 读取图片中的标识，CRC 不匹配时返回 ErrNotFound
+func Detect(img image.Image, key string) ([PayloadSize]byte, error) {
+	var payload [PayloadSize]byte
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(img.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	bounds := nrgba.Bounds()
+	cols, rows := bounds.Dx()/blockSize, bounds.Dy()/blockSize
+	if cols*rows < frameBits*minRepeats {
+		return payload, ErrTooSmall
+	}
+	assignment := layout(cols*rows, key)
+
+	votes := make([]float64, frameBits)
+	var block [blockSize][blockSize]float64
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			x0, y0 := bounds.Min.X+bx*blockSize, bounds.Min.Y+by*blockSize
+			for y := 0; y < blockSize; y++ {
+				for x := 0; x < blockSize; x++ {
+					block[y][x] = luma(nrgba, x0+x, y0+y)
+				}
+			}
+			diff := coefficient(&block, coeffU, coeffV) - coefficient(&block, coeffV, coeffU)
+			// 限制单个块的票数，避免少数高对比度的块决定结果
+			votes[assignment[by*cols+bx]] += math.Max(-1, math.Min(1, diff/DefaultStrength))
+		}
+	}
+
+	var data [PayloadSize + 2]byte
+	for i, vote := range votes {
+		if vote > 0 {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	copy(payload[:], data[:PayloadSize])
+	crc := crc32.ChecksumIEEE(payload[:])
+	if data[PayloadSize] != byte(crc>>8) || data[PayloadSize+1] != byte(crc) {
+		return [PayloadSize]byte{}, ErrNotFound
+	}
+	return payload, nil
+}
@@ -0,0 +1,68 @@
+package watermark
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// testImage 返回带渐变与噪声的图片，接近生成图片的纹理
+func testImage(width, height int) *image.NRGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := rng.Intn(32)
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8((x + noise) % 256),
+				G: uint8((y + noise) % 256),
+				B: uint8((x + y) / 2 % 256),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+func TestEmbedDetectJPEG(t *testing.T) {
+	var payload [PayloadSize]byte
+	copy(payload[:], "0123456789abcdef")
+	img := testImage(320, 240)
+	if err := Embed(img, payload, "secret", DefaultStrength); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Detect(decoded, "secret")
+	if err != nil {
+		t.Fatalf("Detect after JPEG q75: %v", err)
+	}
+	if got != payload {
+		t.Fatalf("Detect = %q, want %q", got[:], payload[:])
+	}
+	if _, err := Detect(decoded, "other"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Detect with another key: %v, want %v", err, ErrNotFound)
+	}
+	if _, err := Detect(testImage(320, 240), "secret"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Detect without watermark: %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestEmbedTooSmall(t *testing.T) {
+	var payload [PayloadSize]byte
+	if err := Embed(testImage(64, 64), payload, "", DefaultStrength); !errors.Is(err, ErrTooSmall) {
+		t.Fatalf("Embed = %v, want %v", err, ErrTooSmall)
+	}
+}
@@ -0,0 +1,80 @@
+// Package watermark 为图片添加可见的图片水印，以及在频域中嵌入、读取不可见的 16 字节标识。
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// 可见水印的位置
+const (
+	TopLeft     = "top-left"
+	Top         = "top"
+	TopRight    = "top-right"
+	Left        = "left"
+	Center      = "center"
+	Right       = "right"
+	BottomLeft  = "bottom-left"
+	Bottom      = "bottom"
+	BottomRight = "bottom-right"
+)
+
+// OverlayOptions 是可见水印的参数
+type OverlayOptions struct {
+	Position string  // 位置，默认为 bottom-right
+	Opacity  float64 // 不透明度 0-1，默认为 1
+	Margin   int     // 与图片边缘的距离（像素）
+	Scale    float64 // 水印宽度占图片宽度的比例，为 0 时保持水印原始大小
+}
+
+// ValidPosition 校验位置，空值视为默认位置
+func ValidPosition(position string) error {
+	switch position {
+	case "", TopLeft, Top, TopRight, Left, Center, Right, BottomLeft, Bottom, BottomRight:
+		return nil
+	default:
+		return fmt.Errorf("invalid watermark position %q", position)
+	}
+}
+
+// Overlay 将 logo 按参数叠加到 img 上
+func Overlay(img *image.NRGBA, logo image.Image, opts OverlayOptions) {
+	bounds := img.Bounds()
+	size := logo.Bounds().Size()
+	if opts.Scale > 0 {
+		width := int(float64(bounds.Dx())*opts.Scale + 0.5)
+		height := size.Y * width / max(size.X, 1)
+		if width > 0 && height > 0 && (width != size.X || height != size.Y) {
+			scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+			xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), logo, logo.Bounds(), draw.Src, nil)
+			logo, size = scaled, scaled.Bounds().Size()
+		}
+	}
+
+	free := bounds.Size().Sub(size).Sub(image.Pt(2*opts.Margin, 2*opts.Margin))
+	at := image.Pt(opts.Margin, opts.Margin)
+	switch opts.Position {
+	case Top, Center, Bottom:
+		at.X += free.X / 2
+	case TopRight, Right, "", BottomRight:
+		at.X += free.X
+	}
+	switch opts.Position {
+	case Left, Center, Right:
+		at.Y += free.Y / 2
+	case BottomLeft, Bottom, "", BottomRight:
+		at.Y += free.Y
+	}
+
+	opacity := opts.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity*255 + 0.5)})
+	target := image.Rectangle{Min: bounds.Min.Add(at), Max: bounds.Min.Add(at).Add(size)}
+	draw.DrawMask(img, target, logo, logo.Bounds().Min, mask, image.Point{}, draw.Over)
+}
@@ -0,0 +1,339 @@
+package webp
+
+import "container/heap"
+
+const (
+	numLiterals     = 256
+	numLengthCodes  = 24
+	numDistanceCode = 40
+	maxCodeLength   = 15
+	minMatch        = 3
+	maxMatch        = 4096
+)
+
+// 码长码的写入顺序
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// token 是一个字面像素或一段向前引用
+type token struct {
+	pixel    uint32
+	length   int // 大于 0 时为引用
+	distCode int // 距离编码：1 为上一行，2 为左侧像素
+}
+
+// tokenize 以贪心方式查找与左侧像素或上一行相同的连续像素
+func tokenize(pixels []uint32, width int) []token {
+	var tokens []token
+	for i := 0; i < len(pixels); {
+		length, distCode := 0, 0
+		for _, candidate := range []struct{ dist, code int }{{width, 1}, {1, 2}} {
+			if i < candidate.dist {
+				continue
+			}
+			n := 0
+			for i+n < len(pixels) && n < maxMatch && pixels[i+n] == pixels[i+n-candidate.dist] {
+				n++
+			}
+			if n > length {
+				length, distCode = n, candidate.code
+			}
+		}
+		if length >= minMatch {
+			tokens = append(tokens, token{length: length, distCode: distCode})
+			i += length
+			continue
+		}
+		tokens = append(tokens, token{pixel: pixels[i]})
+		i++
+	}
+	return tokens
+}
+
+// prefixEncode 返回长度或距离值的前缀码、额外比特数与额外比特的值
+func prefixEncode(value int) (int, uint, uint32) {
+	if value <= 4 {
+		return value - 1, 0, 0
+	}
+	v := value - 1
+	highest := 31
+	for v>>highest&1 == 0 {
+		highest--
+	}
+	second := v >> (highest - 1) & 1
+	extraBits := uint(highest - 1)
+	return 2*highest + second, extraBits, uint32(v & (1<<extraBits - 1))
+}
+
+// writeImage 写入以前缀码编码的图片，main 为 true 时是主图片，需要写入是否使用分组前缀码
+func writeImage(b *bitWriter, pixels []uint32, width int, main bool) {
+	tokens := tokenize(pixels, width)
+
+	green := make([]int, numLiterals+numLengthCodes)
+	red := make([]int, numLiterals)
+	blue := make([]int, numLiterals)
+	alpha := make([]int, numLiterals)
+	dist := make([]int, numDistanceCode)
+	for _, t := range tokens {
+		if t.length > 0 {
+			code, _, _ := prefixEncode(t.length)
+			green[numLiterals+code]++
+			code, _, _ = prefixEncode(t.distCode)
+			dist[code]++
+			continue
+		}
+		green[t.pixel>>8&0xff]++
+		red[t.pixel>>16&0xff]++
+		blue[t.pixel&0xff]++
+		alpha[t.pixel>>24]++
+	}
+
+	b.write(0, 1) // 不使用颜色缓存
+	if main {
+		b.write(0, 1) // 整张图片使用同一组前缀码
+	}
+	greenCode := writeCode(b, green)
+	redCode := writeCode(b, red)
+	blueCode := writeCode(b, blue)
+	alphaCode := writeCode(b, alpha)
+	distCode := writeCode(b, dist)
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			code, n, extra := prefixEncode(t.length)
+			greenCode.write(b, numLiterals+code)
+			b.write(extra, n)
+			code, n, extra = prefixEncode(t.distCode)
+			distCode.write(b, code)
+			b.write(extra, n)
+			continue
+		}
+		greenCode.write(b, int(t.pixel>>8&0xff))
+		redCode.write(b, int(t.pixel>>16&0xff))
+		blueCode.write(b, int(t.pixel&0xff))
+		alphaCode.write(b, int(t.pixel>>24))
+	}
+}
+
+// prefixCode 是按码长构造的规范前缀码，码字已按写入顺序反转
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (c *prefixCode) write(b *bitWriter, symbol int) {
+	b.write(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// writeCode 按频率构造前缀码并写入码长。只用到不超过两个小于 256 的符号时使用简单编码，
+// 只有一个符号时码长为 0，写入符号不占用比特。
+func writeCode(b *bitWriter, freq []int) *prefixCode {
+	var used []int
+	for symbol, n := range freq {
+		if n > 0 {
+			used = append(used, symbol)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+
+	if len(used) <= 2 && used[len(used)-1] < numLiterals {
+		b.write(1, 1)
+		b.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			b.write(0, 1)
+			b.write(uint32(used[0]), 1)
+		} else {
+			b.write(1, 1)
+			b.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			b.write(uint32(used[1]), 8)
+		}
+		lengths := make([]uint8, len(freq))
+		if len(used) == 2 {
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		}
+		return newPrefixCode(lengths)
+	}
+
+	if len(used) == 1 {
+		// 正常编码需要完整的码树，补一个不会出现的符号
+		dummy := 0
+		if used[0] == 0 {
+			dummy = 1
+		}
+		freq = append([]int(nil), freq...)
+		freq[dummy] = 1
+	}
+	lengths := codeLengths(freq, maxCodeLength)
+	b.write(0, 1)
+	writeCodeLengths(b, lengths)
+	return newPrefixCode(lengths)
+}
+
+// writeCodeLengths 用码长码写入码长，连续的 0 用 17、18 表示
+func writeCodeLengths(b *bitWriter, lengths []uint8) {
+	type lengthToken struct {
+		symbol int
+		extra  uint32
+	}
+	var tokens []lengthToken
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens = append(tokens, lengthToken{symbol: int(lengths[i])})
+			i++
+			continue
+		}
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run >= 11:
+			tokens = append(tokens, lengthToken{symbol: 18, extra: uint32(run - 11)})
+		case run >= 3:
+			tokens = append(tokens, lengthToken{symbol: 17, extra: uint32(run - 3)})
+		default:
+			for k := 0; k < run; k++ {
+				tokens = append(tokens, lengthToken{symbol: 0})
+			}
+		}
+		i += run
+	}
+
+	freq := make([]int, len(codeLengthOrder))
+	distinct := 0
+	for _, t := range tokens {
+		if freq[t.symbol] == 0 {
+			distinct++
+		}
+		freq[t.symbol]++
+	}
+	if distinct == 1 {
+		// 码长码同样需要完整的码树
+		for symbol := range freq {
+			if freq[symbol] == 0 {
+				freq[symbol] = 1
+				break
+			}
+		}
+	}
+	code := newPrefixCode(codeLengths(freq, 7))
+
+	count := len(codeLengthOrder)
+	for count > 4 && code.lengths[codeLengthOrder[count-1]] == 0 {
+		count--
+	}
+	b.write(uint32(count-4), 4)
+	for _, symbol := range codeLengthOrder[:count] {
+		b.write(uint32(code.lengths[symbol]), 3)
+	}
+	b.write(0, 1) // 码长写到字母表末尾
+	for _, t := range tokens {
+		code.write(b, t.symbol)
+		switch t.symbol {
+		case 17:
+			b.write(t.extra, 3)
+		case 18:
+			b.write(t.extra, 7)
+		}
+	}
+}
+
+// newPrefixCode 按码长分配规范码字
+func newPrefixCode(lengths []uint8) *prefixCode {
+	var count [maxCodeLength + 1]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [maxCodeLength + 1]uint32
+	code := uint32(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		codes[symbol] = reverseBits(next[l], l)
+		next[l]++
+	}
+	return &prefixCode{lengths: lengths, codes: codes}
+}
+
+func reverseBits(code uint32, n uint8) uint32 {
+	var out uint32
+	for i := uint8(0); i < n; i++ {
+		out = out<<1 | code>>i&1
+	}
+	return out
+}
+
+// huffmanNode 是构造霍夫曼树时的节点
+type huffmanNode struct {
+	freq        int
+	symbol      int // 叶子的符号，内部节点为 -1
+	left, right *huffmanNode
+}
+
+type nodeHeap []*huffmanNode
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, k int) bool {
+	if h[i].freq != h[k].freq {
+		return h[i].freq < h[k].freq
+	}
+	return h[i].symbol < h[k].symbol
+}
+func (h nodeHeap) Swap(i, k int)       { h[i], h[k] = h[k], h[i] }
+func (h *nodeHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	node := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return node
+}
+
+// codeLengths 按频率计算霍夫曼码长，超过 limit 时将频率减半后重新计算。调用方保证至少有两个符号的频率大于 0。
+func codeLengths(freq []int, limit int) []uint8 {
+	freq = append([]int(nil), freq...)
+	for {
+		lengths := make([]uint8, len(freq))
+		h := &nodeHeap{}
+		for symbol, n := range freq {
+			if n > 0 {
+				*h = append(*h, &huffmanNode{freq: n, symbol: symbol})
+			}
+		}
+		heap.Init(h)
+		for h.Len() > 1 {
+			a := heap.Pop(h).(*huffmanNode)
+			b := heap.Pop(h).(*huffmanNode)
+			heap.Push(h, &huffmanNode{freq: a.freq + b.freq, symbol: -1, left: a, right: b})
+		}
+		longest := assignLengths(heap.Pop(h).(*huffmanNode), 0, lengths)
+		if longest <= limit {
+			return lengths
+		}
+		for symbol, n := range freq {
+			if n > 0 {
+				freq[symbol] = (n + 1) / 2
+			}
+		}
+	}
+}
+
+func assignLengths(node *huffmanNode, depth int, lengths []uint8) int {
+	if node.left == nil {
+		if depth < 255 {
+			lengths[node.symbol] = uint8(depth)
+		}
+		return depth
+	}
+	return max(assignLengths(node.left, depth+1, lengths), assignLengths(node.right, depth+1, lengths))
+}
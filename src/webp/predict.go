@@ -0,0 +1,113 @@
+package webp
+
+// predictorBits 是预测块大小的位数，每 32x32 个像素选择一种预测模式
+const predictorBits = 5
+
+// 候选的预测模式：左、上、左与上的平均、左+上-左上
+var predictorModes = []int{1, 2, 7, 12}
+
+func subSampleSize(size int) int {
+	return (size + 1<<predictorBits - 1) >> predictorBits
+}
+
+// choosePredictors 为每个块选择残差绝对值之和最小的预测模式
+func choosePredictors(pixels []uint32, width, height int) []int {
+	tilesX, tilesY := subSampleSize(width), subSampleSize(height)
+	modes := make([]int, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			best, bestCost := predictorModes[0], -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := ty << predictorBits; y < min((ty+1)<<predictorBits, height); y++ {
+					for x := tx << predictorBits; x < min((tx+1)<<predictorBits, width); x++ {
+						if x == 0 || y == 0 {
+							continue
+						}
+						i := y*width + x
+						cost += residualCost(sub(pixels[i], predictor(mode, pixels, i, width)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesX+tx] = best
+		}
+	}
+	return modes
+}
+
+// predict 返回各像素与预测值之差。左上角像素以不透明黑色预测，第一行以左侧像素、第一列以上方像素预测。
+func predict(pixels []uint32, modes []int, width, height int) []uint32 {
+	tilesX := subSampleSize(width)
+	residuals := make([]uint32, len(pixels))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			var pred uint32
+			switch {
+			case x == 0 && y == 0:
+				pred = 0xff000000
+			case y == 0:
+				pred = pixels[i-1]
+			case x == 0:
+				pred = pixels[i-width]
+			default:
+				pred = predictor(modes[(y>>predictorBits)*tilesX+x>>predictorBits], pixels, i, width)
+			}
+			residuals[i] = sub(pixels[i], pred)
+		}
+	}
+	return residuals
+}
+
+// predictor 返回第 i 个像素按模式得到的预测值，调用方保证像素不在第一行与第一列
+func predictor(mode int, pixels []uint32, i, width int) uint32 {
+	left, top, topLeft := pixels[i-1], pixels[i-width], pixels[i-width-1]
+	switch mode {
+	case 1:
+		return left
+	case 2:
+		return top
+	case 7:
+		return average2(left, top)
+	case 12:
+		return clampAddSubtractFull(left, top, topLeft)
+	default:
+		panic("webp: unsupported predictor mode")
+	}
+}
+
+// sub 按分量相减，结果对 256 取模
+func sub(a, b uint32) uint32 {
+	alphaGreen := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	redBlue := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return alphaGreen&0xff00ff00 | redBlue&0x00ff00ff
+}
+
+// residualCost 估算残差的编码代价：各分量按有符号数取绝对值后求和
+func residualCost(p uint32) int {
+	cost := 0
+	for s := 0; s < 32; s += 8 {
+		v := int(int8(p >> s))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+func average2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+	var out uint32
+	for s := 0; s < 32; s += 8 {
+		v := int(a>>s&0xff) + int(b>>s&0xff) - int(c>>s&0xff)
+		out |= uint32(max(0, min(255, v))) << s
+	}
+	return out
+}
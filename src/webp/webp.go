@@ -0,0 +1,145 @@
+// Package webp 实现 WebP 无损（VP8L）编码，标准库与 golang.org/x/image 只提供解码。
+//
+// 编码使用减绿变换、按块选择的预测变换与简单的 LZ77（只引用左侧像素与上一行），
+// 不使用颜色缓存与分组的前缀码，压缩率低于 libwebp，但输出可被所有解码器读取。
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// MaxSize 是 WebP 图片的最大宽高
+const MaxSize = 16384
+
+// Encode 将图片编码为无损 WebP
+func Encode(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > MaxSize || height > MaxSize {
+		return errors.New("webp: invalid image size")
+	}
+
+	pixels, alpha := argbPixels(img)
+
+	b := &bitWriter{}
+	b.write(0x2f, 8)
+	b.write(uint32(width-1), 14)
+	b.write(uint32(height-1), 14)
+	if alpha {
+		b.write(1, 1)
+	} else {
+		b.write(0, 1)
+	}
+	b.write(0, 3) // 版本
+
+	// 解码时按相反的顺序逆变换：先恢复预测，再加回绿色
+	b.write(1, 1)
+	b.write(transformSubtractGreen, 2)
+	subtractGreen(pixels)
+
+	b.write(1, 1)
+	b.write(transformPredictor, 2)
+	b.write(predictorBits-2, 3)
+	modes := choosePredictors(pixels, width, height)
+	residuals := predict(pixels, modes, width, height)
+	tilesX := subSampleSize(width)
+	modeImage := make([]uint32, len(modes))
+	for i, mode := range modes {
+		modeImage[i] = 0xff000000 | uint32(mode)<<8
+	}
+	writeImage(b, modeImage, tilesX, false)
+
+	b.write(0, 1) // 没有更多变换
+	writeImage(b, residuals, width, true)
+
+	data := b.bytes()
+	size := len(data)
+	padded := size + size&1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+padded))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(size))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if size&1 == 1 {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// argbPixels 返回非预乘的 ARGB 像素与是否含有透明像素
+func argbPixels(img image.Image) ([]uint32, bool) {
+	bounds := img.Bounds()
+	pixels := make([]uint32, 0, bounds.Dx()*bounds.Dy())
+	alpha := false
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := nrgba.Pix[nrgba.PixOffset(bounds.Min.X, y):nrgba.PixOffset(bounds.Max.X, y)]
+			for i := 0; i < len(row); i += 4 {
+				if row[i+3] != 0xff {
+					alpha = true
+				}
+				pixels = append(pixels, uint32(row[i+3])<<24|uint32(row[i])<<16|uint32(row[i+1])<<8|uint32(row[i+2]))
+			}
+		}
+		return pixels, alpha
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A != 0xff {
+				alpha = true
+			}
+			pixels = append(pixels, uint32(c.A)<<24|uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B))
+		}
+	}
+	return pixels, alpha
+}
+
+// 变换类型
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+)
+
+// subtractGreen 从红色与蓝色分量中减去绿色分量
+func subtractGreen(pixels []uint32) {
+	for i, p := range pixels {
+		g := p >> 8 & 0xff
+		r := (p>>16 - g) & 0xff
+		b := (p - g) & 0xff
+		pixels[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// bitWriter 按 VP8L 的约定从低位开始写入比特
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) write(value uint32, n uint) {
+	b.acc |= uint64(value) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nbits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nbits = 0, 0
+	}
+	return b.buf
+}
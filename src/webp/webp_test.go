@@ -0,0 +1,114 @@
+package webp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testImage 返回混合了平滑渐变、重复花纹与噪声的图片，覆盖各种预测模式与 LZ77 引用
+func testImage(width, height int, alpha bool) *image.NRGBA {
+	rng := rand.New(rand.NewSource(int64(width*1000 + height)))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: uint8(x * 7), G: uint8(y * 3), B: uint8((x + y) * 5), A: 255}
+			switch {
+			case x%16 < 4:
+				c = color.NRGBA{R: 10, G: 200, B: 30, A: 255}
+			case (x+y)%7 == 0:
+				c.R, c.G, c.B = uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))
+			}
+			if alpha {
+				c.A = uint8((x*11 + y*13) % 256)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		width, height int
+		alpha         bool
+	}{
+		{1, 1, false},
+		{1, 1, true},
+		{3, 5, false},
+		{3, 5, true},
+		{257, 130, false},
+		{257, 130, true},
+		{16, 16, false},
+	} {
+		t.Run(fmt.Sprintf("%dx%d alpha=%v", tc.width, tc.height, tc.alpha), func(t *testing.T) {
+			src := testImage(tc.width, tc.height, tc.alpha)
+			var buf bytes.Buffer
+			if err := Encode(&buf, src); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := webp.DecodeConfig(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Width != tc.width || config.Height != tc.height {
+				t.Fatalf("size %dx%d, want %dx%d", config.Width, config.Height, tc.width, tc.height)
+			}
+			decoded, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < tc.height; y++ {
+				for x := 0; x < tc.width; x++ {
+					want := src.NRGBAAt(x, y)
+					got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+					if got != want {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeFromOtherModels(t *testing.T) {
+	// 非 NRGBA 的图片按颜色模型转换后编码
+	gray := image.NewGray(image.Rect(0, 0, 5, 3))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 17)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, gray.SubImage(image.Rect(1, 1, 5, 3))); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := webp.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := decoded.Bounds().Size(); size != image.Pt(4, 2) {
+		t.Fatalf("size %v, want 4x2", size)
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			want := color.NRGBAModel.Convert(gray.At(x+1, y+1))
+			if got := color.NRGBAModel.Convert(decoded.At(x, y)); got != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	if err := Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 0, 4))); err == nil {
+		t.Fatal("Encode accepted an empty image")
+	}
+	if err := Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, MaxSize+1, 1))); err == nil {
+		t.Fatal("Encode accepted an image wider than MaxSize")
+	}
+}